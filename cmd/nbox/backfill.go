@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"nbox/internal/adapters/aws"
+)
+
+// backfill writes the index attributes on the records stored before the listing
+// indexes existed, nbox backfill. It can run again, indexed records are skipped.
+func backfill(args []string) {
+	run(func(stages *aws.Stages) error {
+		updated, err := stages.Backfill(commandContext())
+		if err != nil {
+			return err
+		}
+		log.Printf("%d records updated\n", updated)
+		return nil
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/usecases"
+	"os"
+
+	"go.uber.org/fx"
+)
+
+// backup writes the encrypted archive of the installation, nbox backup -out nbox.bak [-secrets]
+func backup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "nbox.bak", "--out=nbox.bak")
+	secrets := flags.Bool("secrets", false, "--secrets include the decrypted secure values")
+	_ = flags.Parse(args)
+
+	run(func(backups *usecases.BackupUseCase) error {
+		archive, err := backups.Backup(commandContext(), *secrets)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(*out, archive, 0o600); err != nil {
+			return err
+		}
+		log.Printf("backup written to %s\n", *out)
+		return nil
+	})
+}
+
+// restore writes the archive content, nbox restore -in nbox.bak [-mode overwrite|skip|fail]
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "nbox.bak", "--in=nbox.bak")
+	mode := flags.String("mode", usecases.RestoreFail, "--mode=overwrite|skip|fail")
+	_ = flags.Parse(args)
+
+	run(func(backups *usecases.BackupUseCase) error {
+		archive, err := os.ReadFile(*in)
+		if err != nil {
+			return err
+		}
+		report, err := backups.Restore(commandContext(), archive, *mode)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(report)
+	})
+}
+
+// run the command in process with the same providers of the server, invoke receives
+// the dependencies and returns the command error
+func run(invoke interface{}) {
+	app := fx.New(providers, fx.NopLogger, fx.Invoke(invoke))
+	if err := app.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// commandContext operations of the commands are tracked under the local user
+func commandContext() context.Context {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "nbox-cli"
+	}
+	return context.WithValue(context.Background(), application.RequestUserName, user)
+}
@@ -5,19 +5,86 @@ import (
 	"flag"
 	"log"
 	"nbox/internal/adapters/aws"
+	"nbox/internal/adapters/local"
 	"nbox/internal/application"
+	"nbox/internal/domain"
 	"nbox/internal/entrypoints/api"
 	"nbox/internal/entrypoints/api/handlers"
 	"nbox/internal/entrypoints/api/health"
 	"nbox/internal/usecases"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"go.uber.org/fx"
 )
 
+// providers shared by the server and the commands
+var providers = fx.Options(
+	fx.Provide(aws.NewAwsConfig),
+	fx.Provide(aws.NewS3Client),
+	fx.Provide(aws.NewDynamodbClient),
+	fx.Provide(aws.NewSsmClient),
+	fx.Provide(aws.NewSecretsManagerClient),
+	fx.Provide(aws.NewStages),
+	fx.Provide(aws.NewStageTemplateRouter),
+	fx.Provide(aws.NewStageEntryRouter),
+	fx.Provide(aws.NewStageSecretRouter),
+	fx.Provide(aws.NewStageParameterSource),
+	fx.Provide(aws.NewStageUsageRouter),
+	fx.Provide(aws.NewStageSearchRouter),
+	fx.Provide(snapshotStore),
+	fx.Provide(handlers.NewEntryHandler),
+	fx.Provide(handlers.NewBoxHandler),
+	fx.Provide(handlers.NewSnapshotHandler),
+	fx.Provide(handlers.NewBackupHandler),
+	fx.Provide(usecases.NewPathUseCase),
+	fx.Provide(usecases.NewEntryUseCase),
+	fx.Provide(usecases.NewReferenceUseCase),
+	fx.Provide(usecases.NewSchemaUseCase),
+	fx.Provide(usecases.NewBox),
+	fx.Provide(usecases.NewMoveUseCase),
+	fx.Provide(usecases.NewSnapshotUseCase),
+	fx.Provide(usecases.NewBackupUseCase),
+	fx.Provide(usecases.NewMigrationUseCase),
+	fx.Provide(usecases.NewImportUseCase),
+	fx.Provide(application.NewConfigFromEnv),
+	fx.Provide(api.NewApi),
+	fx.Provide(health.NewHealthy),
+)
+
+// snapshotStore snapshots in the bucket of each stage, or in NBOX_LOCAL_DIR with NBOX_SNAPSHOT_BACKEND=local
+func snapshotStore(stages *aws.Stages, config *application.Config) (domain.SnapshotAdapter, error) {
+	if config.SnapshotBackend != "local" {
+		return aws.NewStageSnapshotRouter(stages), nil
+	}
+
+	store, err := local.NewStore(config)
+	if err != nil {
+		return nil, err
+	}
+	return local.NewSnapshotStore(store), nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			backup(os.Args[2:])
+			return
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "backfill":
+			backfill(os.Args[2:])
+			return
+		}
+	}
+
 	var port string
 	var address string
 
@@ -26,21 +93,7 @@ func main() {
 	flag.Parse()
 
 	fx.New(
-		fx.Provide(aws.NewAwsConfig),
-		fx.Provide(aws.NewS3Client),
-		fx.Provide(aws.NewDynamodbClient),
-		fx.Provide(aws.NewSsmClient),
-		fx.Provide(aws.NewS3TemplateStore),
-		fx.Provide(aws.NewDynamodbBackend),
-		fx.Provide(aws.NewSecureParameterStore),
-		fx.Provide(handlers.NewEntryHandler),
-		fx.Provide(handlers.NewBoxHandler),
-		fx.Provide(usecases.NewPathUseCase),
-		fx.Provide(usecases.NewEntryUseCase),
-		fx.Provide(usecases.NewBox),
-		fx.Provide(application.NewConfigFromEnv),
-		fx.Provide(api.NewApi),
-		fx.Provide(health.NewHealthy),
+		providers,
 		fx.Invoke(func(api *api.Api, config *application.Config) {
 			done := make(chan error)
 			ctx := context.Background()
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"nbox/internal/adapters/aws"
+	"nbox/internal/adapters/local"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"os"
+)
+
+// migrate copies the service backend into the target configured with NBOX_TARGET_<variable>,
+// nbox migrate -checkpoint nbox-migrate.json [-profile target] [-verify]
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	checkpointFile := flags.String("checkpoint", "nbox-migrate.json", "--checkpoint=nbox-migrate.json")
+	profile := flags.String("profile", "", "--profile=<aws shared config profile of the target>")
+	verifyOnly := flags.Bool("verify", false, "--verify only compares both backends")
+	_ = flags.Parse(args)
+
+	run(func(
+		migrations *usecases.MigrationUseCase,
+		entries domain.EntryAdapter,
+		templates domain.TemplateAdapter,
+		secrets domain.SecretAdapter,
+		pathUseCase *usecases.PathUseCase,
+		config *application.Config,
+	) error {
+		source := usecases.Backend{Entries: entries, Templates: templates, Secrets: secrets, Config: config}
+
+		target, err := targetBackend(application.NewTargetConfigFromEnv(), *profile, pathUseCase)
+		if err != nil {
+			return err
+		}
+
+		ctx := commandContext()
+
+		if *verifyOnly {
+			verification, err := migrations.Verify(ctx, source, target)
+			if err != nil {
+				return err
+			}
+			return report(verification, verification.Verified())
+		}
+
+		checkpoint, err := readCheckpoint(*checkpointFile)
+		if err != nil {
+			return err
+		}
+
+		result, err := migrations.Migrate(ctx, source, target, checkpoint, func(checkpoint *models.MigrationCheckpoint) error {
+			return writeCheckpoint(*checkpointFile, checkpoint)
+		})
+		if err != nil {
+			return fmt.Errorf("migration interrupted, run it again to resume from %s: %w", *checkpointFile, err)
+		}
+		return report(result, result.Verification.Verified())
+	})
+}
+
+// targetBackend adapters of the target, the local backend when NBOX_TARGET_NBOX_STORAGE_BACKEND=local
+func targetBackend(config *application.Config, profile string, pathUseCase *usecases.PathUseCase) (usecases.Backend, error) {
+	if config.StorageBackend == "local" {
+		return local.NewBackend(config, pathUseCase)
+	}
+
+	cfg, err := aws.NewAwsConfigFor(config, profile, os.Getenv("NBOX_TARGET_AWS_REGION"))
+	if err != nil {
+		return usecases.Backend{}, err
+	}
+	return aws.NewBackend(cfg, config, pathUseCase)
+}
+
+func report(value any, verified bool) error {
+	if err := json.NewEncoder(os.Stdout).Encode(value); err != nil {
+		return err
+	}
+	if !verified {
+		return errors.New("source and target don't match")
+	}
+	log.Println("source and target match")
+	return nil
+}
+
+// readCheckpoint progress of a previous run, empty when the file doesn't exist
+func readCheckpoint(file string) (*models.MigrationCheckpoint, error) {
+	checkpoint := &models.MigrationCheckpoint{}
+
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, checkpoint); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", file, err)
+	}
+	return checkpoint, nil
+}
+
+// writeCheckpoint replaces the file through a rename so an interruption never leaves it half written
+func writeCheckpoint(file string, checkpoint *models.MigrationCheckpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(file+".tmp", content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
@@ -2,25 +2,62 @@ package aws
 
 import (
 	"context"
+	"nbox/internal/application"
+	"nbox/internal/usecases"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-func NewAwsConfig() *aws.Config {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithDefaultRegion("us-east-1"))
+// NewAwsConfig config of the region of the environment or the shared profile, us-east-1
+// when neither sets one. NBOX_AWS_ENDPOINT replaces the endpoint of every client.
+func NewAwsConfig(appConfig *application.Config) *aws.Config {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithDefaultRegion(appConfig.RegionName))
 	if err != nil {
 		panic(err)
 	}
+	// the parameter ARNs are built with the region the clients use
+	appConfig.RegionName = cfg.Region
+	if appConfig.AwsEndpoint != "" {
+		cfg.BaseEndpoint = aws.String(appConfig.AwsEndpoint)
+	}
 	return &cfg
 }
 
-// NewS3Client Create an Amazon S3 service client
+// NewStageAwsConfig copy of the config with the region and endpoint of the stage. With a
+// role the credentials of the stage are the ones of the role, assumed with the service
+// credentials and refreshed before they expire.
+func NewStageAwsConfig(cfg *aws.Config, stage application.StageConfig) *aws.Config {
+	stageCfg := cfg.Copy()
+	if stage.Region != "" {
+		stageCfg.Region = stage.Region
+	}
+	if stage.Endpoint != "" {
+		stageCfg.BaseEndpoint = aws.String(stage.Endpoint)
+	}
+	if stage.RoleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), stage.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "nbox"
+			if stage.ExternalId != "" {
+				o.ExternalID = aws.String(stage.ExternalId)
+			}
+		})
+		stageCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return &stageCfg
+}
+
+// NewS3Client Create an Amazon S3 service client, with path style addressing when the
+// endpoint is replaced, stand-ins don't resolve bucket subdomains
 func NewS3Client(cfg *aws.Config) *s3.Client {
-	return s3.NewFromConfig(*cfg)
+	return s3.NewFromConfig(*cfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.BaseEndpoint != nil
+	})
 }
 
 func NewDynamodbClient(cfg *aws.Config) *dynamodb.Client {
@@ -30,3 +67,41 @@ func NewDynamodbClient(cfg *aws.Config) *dynamodb.Client {
 func NewSsmClient(cfg *aws.Config) *ssm.Client {
 	return ssm.NewFromConfig(*cfg)
 }
+
+// NewAwsConfigFor config of the endpoint of the config, with the shared config profile
+// when it's set. The region is the explicit one, or the one of the environment or the
+// profile like NewAwsConfig.
+func NewAwsConfigFor(appConfig *application.Config, profile string, region string) (*aws.Config, error) {
+	options := []func(*config.LoadOptions) error{config.WithDefaultRegion(appConfig.RegionName)}
+	if region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+	if profile != "" {
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		return nil, err
+	}
+	appConfig.RegionName = cfg.Region
+	if appConfig.AwsEndpoint != "" {
+		cfg.BaseEndpoint = aws.String(appConfig.AwsEndpoint)
+	}
+	return &cfg, nil
+}
+
+// NewBackend adapters of the tables, bucket and parameters of the config and its stages,
+// used as migration target
+func NewBackend(cfg *aws.Config, config *application.Config, pathUseCase *usecases.PathUseCase) (usecases.Backend, error) {
+	stages, err := NewStages(cfg, NewS3Client(cfg), NewDynamodbClient(cfg), NewSsmClient(cfg), NewSecretsManagerClient(cfg), config, pathUseCase)
+	if err != nil {
+		return usecases.Backend{}, err
+	}
+	return usecases.Backend{
+		Entries:   NewStageEntryRouter(stages),
+		Templates: NewStageTemplateRouter(stages),
+		Secrets:   NewStageSecretRouter(stages),
+		Config:    config,
+	}, nil
+}
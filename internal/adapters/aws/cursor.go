@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"nbox/internal/domain"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// cursorValue key attribute of a LastEvaluatedKey, keys are only strings or numbers
+type cursorValue struct {
+	S *string `json:"s,omitempty"`
+	N *string `json:"n,omitempty"`
+}
+
+// encodeCursor opaque continuation cursor of a query, empty when there are no more pages
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	values := map[string]cursorValue{}
+	for name, attr := range key {
+		switch v := attr.(type) {
+		case *types.AttributeValueMemberS:
+			values[name] = cursorValue{S: &v.Value}
+		case *types.AttributeValueMemberN:
+			values[name] = cursorValue{N: &v.Value}
+		default:
+			return "", fmt.Errorf("%w: unsupported key attribute %s", domain.ErrInvalidCursor, name)
+		}
+	}
+
+	out, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// decodeCursor ExclusiveStartKey of the cursor, nil for the first page
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidCursor, err)
+	}
+
+	var values map[string]cursorValue
+	if err = json.Unmarshal(decoded, &values); err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidCursor, err)
+	}
+
+	key := map[string]types.AttributeValue{}
+	for name, v := range values {
+		switch {
+		case v.S != nil:
+			key[name] = &types.AttributeValueMemberS{Value: *v.S}
+		case v.N != nil:
+			key[name] = &types.AttributeValueMemberN{Value: *v.N}
+		default:
+			return nil, fmt.Errorf("%w: empty key attribute %s", domain.ErrInvalidCursor, name)
+		}
+	}
+
+	return key, nil
+}
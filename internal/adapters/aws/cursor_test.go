@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"errors"
+	"nbox/internal/domain"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCursor(t *testing.T) {
+	key := map[string]types.AttributeValue{
+		"Service":   &types.AttributeValueMemberS{Value: "payments-api"},
+		"Stage":     &types.AttributeValueMemberS{Value: "production/task_definition.json"},
+		"UpdatedAt": &types.AttributeValueMemberN{Value: "1760000000"},
+	}
+
+	cursor, err := encodeCursor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(key, decoded) {
+		t.Errorf("decodeCursor() = %v, want %v", decoded, key)
+	}
+
+	if cursor, _ = encodeCursor(nil); cursor != "" {
+		t.Errorf("encodeCursor(nil) = %q, want empty", cursor)
+	}
+
+	if _, err = decodeCursor("not a cursor"); !errors.Is(err, domain.ErrInvalidCursor) {
+		t.Errorf("decodeCursor() error = %v, want %v", err, domain.ErrInvalidCursor)
+	}
+}
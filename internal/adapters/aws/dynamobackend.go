@@ -25,6 +25,14 @@ import (
 const (
 	DynamoDBLockPrefix        = "_"
 	DefaultParallelOperations = 128
+
+	TrackingRecordKind              = "tracking"
+	TrackingKindIndexName           = "Kind-UpdatedAt-index"
+	TrackingUpdatedByIndexName      = "UpdatedBy-UpdatedAt-index"
+	TrackingStageIndexName          = "Stage-UpdatedAt-index"          // TrackingStageIndexName GSI hash: Stage, range: UpdatedAt
+	TrackingUpdatedByStageIndexName = "UpdatedByStage-UpdatedAt-index" // TrackingUpdatedByStageIndexName GSI hash: UpdatedByStage, range: UpdatedAt
+	TrackingListDefaultLimit        = 50
+	TrackingListMaximumLimit        = 500
 )
 
 type BatchResult models.Exchange[map[string][]types.WriteRequest, error]
@@ -44,11 +52,77 @@ type Record struct {
 	*RecordBase
 }
 
+// TrashRecord soft deleted entry (hash: Stage, range: Key), Key is the full key
+type TrashRecord struct {
+	Stage string `dynamodbav:"Stage"`
+	*RecordBase
+	Deleted models.Metadata `dynamodbav:"Deleted"`
+	PurgeAt int64           `dynamodbav:"PurgeAt"` // TTL of the trash records
+}
+
+// RecordTracking history of the entries (hash: Key, range: Timestamp). Kind, Stage, UpdatedBy
+// and UpdatedAt repeat the metadata as top level attributes for the activity indexes.
 type RecordTracking struct {
-	Timestamp string `dynamodbav:"Timestamp"`
+	Timestamp      string    `dynamodbav:"Timestamp"`
+	MovedFrom      string    `dynamodbav:"MovedFrom,omitempty"`
+	MovedTo        string    `dynamodbav:"MovedTo,omitempty"`
+	Kind           string    `dynamodbav:"Kind"`
+	Stage          string    `dynamodbav:"Stage,omitempty"`
+	UpdatedBy      string    `dynamodbav:"UpdatedBy,omitempty"`      // omitempty, index keys can't be empty strings
+	UpdatedByStage string    `dynamodbav:"UpdatedByStage,omitempty"` // UpdatedByStage "<user>#<stage>"
+	UpdatedAt      time.Time `dynamodbav:"UpdatedAt,unixtime"`
 	*RecordBase
 }
 
+// index sets the attributes of the activity indexes from the key and the metadata
+func (r *RecordTracking) index() {
+	r.Kind = TrackingRecordKind
+	r.Stage = stageOf(r.Key)
+	r.UpdatedBy = r.Metadata.UpdatedBy
+	r.UpdatedByStage = ""
+	if r.UpdatedBy != "" && r.Stage != "" {
+		r.UpdatedByStage = r.UpdatedBy + "#" + r.Stage
+	}
+	r.UpdatedAt = r.Metadata.UpdatedAt
+}
+
+// indexed the record has the attributes of the activity indexes
+func (r RecordTracking) indexed() bool {
+	expected := r
+	expected.index()
+	return r.Kind == expected.Kind && r.Stage == expected.Stage && r.UpdatedBy == expected.UpdatedBy &&
+		r.UpdatedByStage == expected.UpdatedByStage && r.UpdatedAt.Equal(expected.UpdatedAt)
+}
+
+func (r RecordTracking) tracking() models.Tracking {
+	return models.Tracking{
+		Key:       r.Key,
+		Value:     string(r.Value),
+		Secure:    r.Metadata.Secure,
+		UpdatedAt: r.Metadata.UpdatedAt,
+		UpdatedBy: r.Metadata.UpdatedBy,
+		Action:    r.Metadata.Action,
+		MovedFrom: r.MovedFrom,
+		MovedTo:   r.MovedTo,
+
+		SecretVersion: r.Metadata.SecretVersion,
+		SecretUser:    r.Metadata.SecretUser,
+	}
+}
+
+func newRecordTracking(key string, value []byte, metadata models.Metadata) RecordTracking {
+	record := RecordTracking{
+		Timestamp: strconv.FormatInt(metadata.UpdatedAt.Unix(), 10),
+		RecordBase: &RecordBase{
+			Key:      key,
+			Value:    value,
+			Metadata: metadata,
+		},
+	}
+	record.index()
+	return record
+}
+
 func NewPermitPool(permits int) *PermitPool {
 	if permits < 1 {
 		permits = DefaultParallelOperations
@@ -90,25 +164,8 @@ func NewDynamodbBackend(dynamodb *dynamodb.Client, config *application.Config, p
 	}
 }
 
-func (d *dynamodbBackend) cleanedKey(key string) string {
-	for _, prefix := range d.config.AllowedPrefixes {
-		if strings.HasPrefix(key, prefix) {
-			return key
-		}
-	}
-	return fmt.Sprintf(
-		"%s/%s", strings.Trim(d.config.DefaultPrefix, "/"), key,
-	)
-}
-
 func (d *dynamodbBackend) sanitize(key string) string {
-	key = strings.ToLower(key)
-	key = strings.TrimSpace(key)
-	key = strings.Trim(key, "/")
-
-	key = d.cleanedKey(key)
-
-	return key
+	return d.config.StoredKey(key)
 }
 
 // Upsert is used to insert or update an entry
@@ -128,11 +185,9 @@ func (d *dynamodbBackend) Upsert(ctx context.Context, entries []models.Entry) ma
 		path := d.pathUseCase.PathWithoutKey(entryKey)
 		key := d.pathUseCase.BaseKey(entryKey)
 
-		metadata := models.Metadata{
-			UpdatedAt: now,
-			UpdatedBy: updatedBy,
-			Secure:    entry.Secure,
-		}
+		metadata := entry.Metadata()
+		metadata.UpdatedAt = now
+		metadata.UpdatedBy = updatedBy
 
 		records[fmt.Sprintf("%s/%s", path, key)] = Record{
 			Path: path,
@@ -143,34 +198,11 @@ func (d *dynamodbBackend) Upsert(ctx context.Context, entries []models.Entry) ma
 			},
 		}
 
-		tracking[entryKey] = RecordTracking{
-			Timestamp: strconv.FormatInt(now.Unix(), 10),
-			RecordBase: &RecordBase{
-				Key:   entryKey,
-				Value: []byte(entry.Value),
-				Metadata: models.Metadata{
-					UpdatedAt: now,
-					UpdatedBy: updatedBy,
-					Secure:    entry.Secure,
-					Action:    action,
-				},
-			},
-		}
+		tracked := metadata
+		tracked.Action = action
+		tracking[entryKey] = newRecordTracking(entryKey, []byte(entry.Value), tracked)
 
-		for _, prefix := range d.pathUseCase.Prefixes(entryKey) {
-			path = d.pathUseCase.PathWithoutKey(prefix)
-			key = fmt.Sprintf("%s/", d.pathUseCase.BaseKey(prefix))
-			records[fmt.Sprintf("%s%s", path, key)] = Record{
-				Path: path,
-				RecordBase: &RecordBase{
-					Key: key,
-					Metadata: models.Metadata{
-						UpdatedAt: now,
-						UpdatedBy: updatedBy,
-					},
-				},
-			}
-		}
+		d.folders(records, entryKey, now, updatedBy)
 	}
 
 	ch := make(chan BatchResult)
@@ -187,17 +219,40 @@ func (d *dynamodbBackend) Upsert(ctx context.Context, entries []models.Entry) ma
 		log.Printf("Err save tracking. %v \n", result2)
 	}
 
+	// the batches stop at the first failure, the keys written before it are reported
+	// failed too, writing them again is idempotent
 	summary := map[string]error{}
-	for _, req := range result1.Out[d.config.EntryTableName] {
-		key := req.PutRequest.Item["Key"]
-		path := req.PutRequest.Item["Path"]
-		summary[fmt.Sprintf("%s/%s", path, key)] = result1.Err
+	for _, entry := range entries {
+		summary[entry.Key] = result1.Err
 	}
 
 	return summary
 }
 
+// folders adds the folder records of every prefix of the key
+func (d *dynamodbBackend) folders(records map[string]Record, entryKey string, now time.Time, updatedBy string) {
+	for _, prefix := range d.pathUseCase.Prefixes(entryKey) {
+		path := d.pathUseCase.PathWithoutKey(prefix)
+		key := fmt.Sprintf("%s/", d.pathUseCase.BaseKey(prefix))
+		records[fmt.Sprintf("%s%s", path, key)] = Record{
+			Path: path,
+			RecordBase: &RecordBase{
+				Key: key,
+				Metadata: models.Metadata{
+					UpdatedAt: now,
+					UpdatedBy: updatedBy,
+				},
+			},
+		}
+	}
+}
+
 func (d *dynamodbBackend) writeReqsBatch(ctx context.Context, tableName string, requests []types.WriteRequest) BatchResult {
+	return writeReqsBatch(ctx, d.client, d.permitPool, tableName, requests)
+}
+
+// writeReqsBatch writes the requests in batches of 25 items retrying the unprocessed ones
+func writeReqsBatch(ctx context.Context, client *dynamodb.Client, permitPool *PermitPool, tableName string, requests []types.WriteRequest) BatchResult {
 	for len(requests) > 0 {
 		var err error
 		var output *dynamodb.BatchWriteItemOutput
@@ -207,13 +262,13 @@ func (d *dynamodbBackend) writeReqsBatch(ctx context.Context, tableName string,
 		batch := map[string][]types.WriteRequest{tableName: requests[:batchSize]}
 		requests = requests[batchSize:]
 
-		d.permitPool.Acquire()
+		permitPool.Acquire()
 		boff := backoff.NewExponentialBackOff()
 		boff.MaxElapsedTime = 600 * time.Second
 
 		for len(batch) > 0 {
 
-			output, err = d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			output, err = client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
 				RequestItems: batch,
 			})
 
@@ -236,7 +291,7 @@ func (d *dynamodbBackend) writeReqsBatch(ctx context.Context, tableName string,
 			}
 
 		}
-		d.permitPool.Release()
+		permitPool.Release()
 		if err != nil {
 			return BatchResult{Out: unprocessed, Err: err}
 		}
@@ -246,8 +301,29 @@ func (d *dynamodbBackend) writeReqsBatch(ctx context.Context, tableName string,
 
 // Retrieve Get is used to fetch an entry
 func (d *dynamodbBackend) Retrieve(ctx context.Context, key string) (*models.Entry, error) {
-	p, _ := attributevalue.Marshal(d.pathUseCase.PathWithoutKey(key))
-	k, _ := attributevalue.Marshal(d.pathUseCase.BaseKey(key))
+	record, err := d.record(ctx, key)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	entry := &models.Entry{
+		Key:    d.pathUseCase.Concat(record.Path, record.Key), // vaultKey(record),
+		Value:  string(record.Value),
+		Secure: record.Metadata.Secure,
+	}
+	entry.Describe(record.Metadata)
+
+	return entry, nil
+}
+
+// record stored record of the key, nil when it doesn't exist
+func (d *dynamodbBackend) record(ctx context.Context, key string) (*Record, error) {
+	return d.item(ctx, d.pathUseCase.PathWithoutKey(key), d.pathUseCase.BaseKey(key))
+}
+
+func (d *dynamodbBackend) item(ctx context.Context, path string, key string) (*Record, error) {
+	p, _ := attributevalue.Marshal(path)
+	k, _ := attributevalue.Marshal(key)
 
 	resp, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
 		Key:            map[string]types.AttributeValue{"Path": p, "Key": k},
@@ -267,18 +343,36 @@ func (d *dynamodbBackend) Retrieve(ctx context.Context, key string) (*models.Ent
 		return nil, err
 	}
 
-	return &models.Entry{
-		Key:    d.pathUseCase.Concat(record.Path, record.Key), // vaultKey(record),
-		Value:  string(record.Value),
-		Secure: record.Metadata.Secure,
-	}, nil
+	return record, nil
 }
 
 // List is used to list all the keys under a given
 // prefix, up to the next prefix.
 func (d *dynamodbBackend) List(ctx context.Context, prefix string) ([]models.Entry, error) {
+	records, err := d.records(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.Entry, 0, len(records))
+	for _, record := range records {
+		entry := models.Entry{
+			Key:    record.Key,
+			Value:  string(record.Value),
+			Path:   record.Path,
+			Secure: record.Metadata.Secure,
+		}
+		entry.Describe(record.Metadata)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// records stored records under the prefix, up to the next prefix
+func (d *dynamodbBackend) records(ctx context.Context, prefix string) ([]Record, error) {
 	prefix = strings.TrimSuffix(prefix, "/")
-	entries := make([]models.Entry, 0)
+	records := make([]Record, 0)
 	prefix = d.pathUseCase.EscapeEmptyPath(prefix)
 
 	keyEx := expression.Key("Path").Equal(expression.Value(prefix))
@@ -304,53 +398,129 @@ func (d *dynamodbBackend) List(ctx context.Context, prefix string) ([]models.Ent
 			log.Printf("Err Couldn't query for records released in %v. %v\n", prefix, err)
 			return nil, err
 		}
-		var records []Record
-		err = attributevalue.UnmarshalListOfMaps(response.Items, &records)
+		var page []Record
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
 		if err != nil {
 			log.Printf("Err Couldn't unmarshal query response. %v\n", err)
 			return nil, err
 		}
 
-		for _, record := range records {
+		for _, record := range page {
 			if !strings.HasPrefix(record.Key, DynamoDBLockPrefix) {
-				entries = append(entries, models.Entry{
-					Key:    record.Key,
-					Value:  string(record.Value),
-					Path:   record.Path,
-					Secure: record.Metadata.Secure,
-				})
+				records = append(records, record)
 			}
 		}
 	}
 
-	return entries, nil
+	return records, nil
 }
 
+// Delete soft deletes the key and every key nested under it. The entries are moved
+// to the trash table, tracked with action delete, until the restore window expires
+// and the PurgeAt TTL removes them.
 func (d *dynamodbBackend) Delete(ctx context.Context, key string) error {
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	deleted := models.Metadata{UpdatedAt: now, UpdatedBy: updatedBy, Action: "delete"}
 
-	p, _ := attributevalue.Marshal(d.pathUseCase.PathWithoutKey(key))
-	k, _ := attributevalue.Marshal(d.pathUseCase.BaseKey(key))
+	records, err := d.tree(ctx, key)
+	if err != nil {
+		return err
+	}
 
-	requests := []types.WriteRequest{
-		{
-			DeleteRequest: &types.DeleteRequest{
-				Key: map[string]types.AttributeValue{"Path": p, "Key": k},
+	trash := map[string]TrashRecord{}
+	tracking := map[string]RecordTracking{}
+	for _, r := range records {
+		// folders are rebuilt by the restore of the entries under them
+		if strings.HasSuffix(r.Key, "/") {
+			continue
+		}
+
+		entryKey := d.pathUseCase.Concat(r.Path, r.Key)
+		trash[entryKey] = TrashRecord{
+			Stage: stageOf(entryKey),
+			RecordBase: &RecordBase{
+				Key:      entryKey,
+				Value:    r.Value,
+				Metadata: r.Metadata,
 			},
-		},
+			Deleted: deleted,
+			PurgeAt: now.Add(d.config.EntryRestoreWindow).Unix(),
+		}
+
+		tracked := r.Metadata
+		tracked.UpdatedAt = now
+		tracked.UpdatedBy = updatedBy
+		tracked.Action = deleted.Action
+		tracking[entryKey] = newRecordTracking(entryKey, r.Value, tracked)
 	}
 
-	entries, _ := d.List(ctx, key)
+	if result := d.writeReqsBatch(ctx, d.config.TrashTableName, prepareWriteRequest(trash)); result.Err != nil {
+		return result.Err
+	}
 
-	// children
-	for _, e := range entries {
-		pEntry, _ := attributevalue.Marshal(e.Path)
-		kEntry, _ := attributevalue.Marshal(e.Key)
+	if result := d.writeReqsBatch(ctx, d.config.TrackingEntryTableName, prepareWriteRequest(tracking)); result.Err != nil {
+		log.Printf("Err save tracking. %v \n", result.Err)
+	}
+
+	return d.remove(ctx, records)
+}
+
+// Purge removes the key and every key nested under it without keeping them in the trash
+func (d *dynamodbBackend) Purge(ctx context.Context, key string) error {
+	records, err := d.tree(ctx, key)
+	if err != nil {
+		return err
+	}
+	return d.remove(ctx, records)
+}
+
+// tree records of the key: the entry, its folder and every record nested under it
+func (d *dynamodbBackend) tree(ctx context.Context, key string) ([]Record, error) {
+	key = strings.Trim(key, "/")
+	records := make([]Record, 0)
+
+	path := d.pathUseCase.PathWithoutKey(key)
+	base := d.pathUseCase.BaseKey(key)
+	for _, k := range []string{base, base + "/"} {
+		record, err := d.item(ctx, path, k)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records = append(records, *record)
+		}
+	}
+
+	children, err := d.records(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(children); i++ {
+		child := children[i]
+		records = append(records, child)
+		if strings.HasSuffix(child.Key, "/") {
+			nested, err := d.records(ctx, d.pathUseCase.Concat(child.Path, strings.TrimSuffix(child.Key, "/")))
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, nested...)
+		}
+	}
+
+	return records, nil
+}
+
+// remove deletes the records from the entries table
+func (d *dynamodbBackend) remove(ctx context.Context, records []Record) error {
+	requests := make([]types.WriteRequest, 0, len(records))
+	for _, r := range records {
+		p, _ := attributevalue.Marshal(r.Path)
+		k, _ := attributevalue.Marshal(r.Key)
 
 		requests = append(requests, types.WriteRequest{
 			DeleteRequest: &types.DeleteRequest{
-				Key: map[string]types.AttributeValue{
-					"Path": pEntry, "Key": kEntry,
-				},
+				Key: map[string]types.AttributeValue{"Path": p, "Key": k},
 			},
 		})
 	}
@@ -359,8 +529,384 @@ func (d *dynamodbBackend) Delete(ctx context.Context, key string) error {
 	return result.Err
 }
 
+// Trash soft deleted entries under the prefix still within the restore window,
+// every allowed stage when the prefix is empty
+func (d *dynamodbBackend) Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error) {
+	records, err := d.trash(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Unix()
+	entries := make([]models.TrashEntry, 0, len(records))
+	for _, record := range records {
+		if record.PurgeAt <= now {
+			continue
+		}
+		entry := models.Entry{
+			Path:   d.pathUseCase.PathWithoutKey(record.Key),
+			Key:    d.pathUseCase.BaseKey(record.Key),
+			Value:  string(record.Value),
+			Secure: record.Metadata.Secure,
+		}
+		entry.Describe(record.Metadata)
+		entries = append(entries, models.TrashEntry{
+			Entry:     entry,
+			DeletedAt: record.Deleted.UpdatedAt,
+			DeletedBy: record.Deleted.UpdatedBy,
+			PurgeAt:   time.Unix(record.PurgeAt, 0).UTC(),
+		})
+	}
+
+	return entries, nil
+}
+
+// Restore restores the soft deleted key and the keys under it with their values,
+// metadata and secure references, tracked with action restore. The keys past the restore
+// window are skipped and reported with ErrRestoreWindowExpired next to the restored ones.
+func (d *dynamodbBackend) Restore(ctx context.Context, key string) ([]string, error) {
+	key = strings.Trim(strings.TrimSpace(key), "/")
+	if key == "" {
+		return nil, errors.New("key is required")
+	}
+
+	trashed, err := d.trash(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	records := map[string]Record{}
+	tracking := map[string]RecordTracking{}
+	deletes := make([]types.WriteRequest, 0, len(trashed))
+	restored := make([]string, 0, len(trashed))
+	expired := make([]string, 0)
+
+	for _, record := range trashed {
+		if now.Unix() > record.PurgeAt {
+			expired = append(expired, record.Key)
+			continue
+		}
+
+		metadata := record.Metadata
+		metadata.UpdatedAt = now
+		metadata.UpdatedBy = updatedBy
+		metadata.Action = ""
+
+		records[record.Key] = Record{
+			Path: d.pathUseCase.PathWithoutKey(record.Key),
+			RecordBase: &RecordBase{
+				Key:      d.pathUseCase.BaseKey(record.Key),
+				Value:    record.Value,
+				Metadata: metadata,
+			},
+		}
+		d.folders(records, record.Key, now, updatedBy)
+
+		tracked := metadata
+		tracked.Action = "restore"
+		tracking[record.Key] = newRecordTracking(record.Key, record.Value, tracked)
+
+		s, _ := attributevalue.Marshal(record.Stage)
+		k, _ := attributevalue.Marshal(record.Key)
+		deletes = append(deletes, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{"Stage": s, "Key": k}},
+		})
+		restored = append(restored, record.Key)
+	}
+	if len(restored) == 0 && len(expired) > 0 {
+		return nil, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, strings.Join(expired, ", "))
+	}
+
+	if result := d.writeReqsBatch(ctx, d.config.EntryTableName, prepareWriteRequest(records)); result.Err != nil {
+		return nil, result.Err
+	}
+
+	if result := d.writeReqsBatch(ctx, d.config.TrackingEntryTableName, prepareWriteRequest(tracking)); result.Err != nil {
+		log.Printf("Err save tracking. %v \n", result.Err)
+	}
+
+	if result := d.writeReqsBatch(ctx, d.config.TrashTableName, deletes); result.Err != nil {
+		log.Printf("Err delete trash records. %v \n", result.Err)
+	}
+
+	if len(expired) > 0 {
+		return restored, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, strings.Join(expired, ", "))
+	}
+	return restored, nil
+}
+
+// trash records of the key and the keys under it
+func (d *dynamodbBackend) trash(ctx context.Context, prefix string) ([]TrashRecord, error) {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+
+	stages := []string{stageOf(prefix)}
+	if prefix == "" {
+		stages = make([]string, 0, len(d.config.AllowedPrefixes))
+		for _, allowed := range d.config.AllowedPrefixes {
+			stages = append(stages, strings.Trim(allowed, "/"))
+		}
+	}
+
+	records := make([]TrashRecord, 0)
+	for _, stage := range stages {
+		keyEx := expression.Key("Stage").Equal(expression.Value(stage))
+		if prefix != "" {
+			keyEx = keyEx.And(expression.Key("Key").BeginsWith(prefix))
+		}
+
+		expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+		if err != nil {
+			return nil, err
+		}
+
+		queryPaginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+			TableName:                 aws.String(d.config.TrashTableName),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			KeyConditionExpression:    expr.KeyCondition(),
+		})
+		for queryPaginator.HasMorePages() {
+			response, err := queryPaginator.NextPage(ctx)
+			if err != nil {
+				log.Printf("Err Couldn't query trash records in %v. %v\n", prefix, err)
+				return nil, err
+			}
+			var page []TrashRecord
+			if err = attributevalue.UnmarshalListOfMaps(response.Items, &page); err != nil {
+				return nil, err
+			}
+			for _, record := range page {
+				// begins_with also matches siblings like production/api2
+				if prefix == "" || record.Key == prefix || strings.HasPrefix(record.Key, prefix+"/") {
+					records = append(records, record)
+				}
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// stageOf first segment of the key, hash key of the trash records
+func stageOf(key string) string {
+	stage, _, _ := strings.Cut(strings.Trim(key, "/"), "/")
+	return stage
+}
+
 func (d *dynamodbBackend) Tracking(ctx context.Context, key string) ([]models.Tracking, error) {
-	entries := make([]models.Tracking, 0)
+	records, err := d.tracking(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.Tracking, 0, len(records))
+	for _, record := range records {
+		if !strings.HasPrefix(record.Key, DynamoDBLockPrefix) {
+			entries = append(entries, record.tracking())
+		}
+	}
+
+	return entries, nil
+}
+
+// Activity tracking records of every key, newest first, filtered by user, key prefix,
+// action and time range. The user and the stage of the prefix are keys of the indexes,
+// the Kind index holds the whole history by time. A deeper prefix and the action are
+// filtered, the queries go on until the page is full or the history ends.
+func (d *dynamodbBackend) Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error) {
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = TrackingListDefaultLimit
+	}
+	if limit > TrackingListMaximumLimit {
+		limit = TrackingListMaximumLimit
+	}
+
+	to := filter.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	between := expression.Key("UpdatedAt").Between(expression.Value(filter.From.Unix()), expression.Value(to.Unix()))
+
+	prefix := strings.Trim(filter.Prefix, "/")
+	stage := stageOf(prefix)
+
+	var indexName string
+	var keyEx expression.KeyConditionBuilder
+	switch {
+	case filter.User != "" && stage != "":
+		indexName = TrackingUpdatedByStageIndexName
+		keyEx = expression.Key("UpdatedByStage").Equal(expression.Value(filter.User + "#" + stage)).And(between)
+	case filter.User != "":
+		indexName = TrackingUpdatedByIndexName
+		keyEx = expression.Key("UpdatedBy").Equal(expression.Value(filter.User)).And(between)
+	case stage != "":
+		indexName = TrackingStageIndexName
+		keyEx = expression.Key("Stage").Equal(expression.Value(stage)).And(between)
+	default:
+		indexName = TrackingKindIndexName
+		keyEx = expression.Key("Kind").Equal(expression.Value(TrackingRecordKind)).And(between)
+	}
+
+	builder := expression.NewBuilder().WithKeyCondition(keyEx)
+
+	conditions := make([]expression.ConditionBuilder, 0, 2)
+	if prefix != stage {
+		conditions = append(conditions, expression.Name("Key").BeginsWith(prefix))
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, expression.Name("Metadata.Action").Equal(expression.Value(filter.Action)))
+	}
+	switch len(conditions) {
+	case 1:
+		builder = builder.WithFilter(conditions[0])
+	case 2:
+		builder = builder.WithFilter(expression.And(conditions[0], conditions[1]))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.TrackingPage{Tracking: make([]models.Tracking, 0, limit)}
+	for {
+		// the limit is evaluated before the filter, each query reads up to what the page misses
+		response, err := d.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(d.config.TrackingEntryTableName),
+			IndexName:                 aws.String(indexName),
+			KeyConditionExpression:    expr.KeyCondition(),
+			FilterExpression:          expr.Filter(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ExclusiveStartKey:         startKey,
+			Limit:                     aws.Int32(int32(limit - len(page.Tracking))),
+			ScanIndexForward:          aws.Bool(false),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var records []RecordTracking
+		if err = attributevalue.UnmarshalListOfMaps(response.Items, &records); err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			page.Tracking = append(page.Tracking, record.tracking())
+		}
+
+		startKey = response.LastEvaluatedKey
+		if len(startKey) == 0 || len(page.Tracking) >= limit {
+			break
+		}
+	}
+
+	page.Cursor, err = encodeCursor(startKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Backfill writes the attributes of the activity indexes on the tracking records stored
+// before them, from the metadata of each record
+func (d *dynamodbBackend) Backfill(ctx context.Context) (int, error) {
+	updated := 0
+	scanPaginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(d.config.TrackingEntryTableName),
+	})
+	for scanPaginator.HasMorePages() {
+		response, err := scanPaginator.NextPage(ctx)
+		if err != nil {
+			return updated, err
+		}
+		var page []RecordTracking
+		if err = attributevalue.UnmarshalListOfMaps(response.Items, &page); err != nil {
+			return updated, err
+		}
+
+		records := map[string]RecordTracking{}
+		for _, record := range page {
+			if record.RecordBase == nil || record.indexed() {
+				continue
+			}
+			record.index()
+			records[fmt.Sprintf("%s#%s", record.Key, record.Timestamp)] = record
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		if result := d.writeReqsBatch(ctx, d.config.TrackingEntryTableName, prepareWriteRequest(records)); result.Err != nil {
+			return updated, result.Err
+		}
+		updated += len(records)
+	}
+	return updated, nil
+}
+
+// ImportTracking writes the history records as they are, keeping their timestamps
+func (d *dynamodbBackend) ImportTracking(ctx context.Context, tracking []models.Tracking) error {
+	records := map[string]RecordTracking{}
+	for _, t := range tracking {
+		record := newRecordTracking(t.Key, []byte(t.Value), models.Metadata{
+			Secure:    t.Secure,
+			UpdatedAt: t.UpdatedAt,
+			UpdatedBy: t.UpdatedBy,
+			Action:    t.Action,
+
+			SecretVersion: t.SecretVersion,
+			SecretUser:    t.SecretUser,
+		})
+		record.MovedFrom = t.MovedFrom
+		record.MovedTo = t.MovedTo
+		records[fmt.Sprintf("%s#%s", record.Key, record.Timestamp)] = record
+	}
+
+	return d.writeReqsBatch(ctx, d.config.TrackingEntryTableName, prepareWriteRequest(records)).Err
+}
+
+// MoveTracking copies the history of from under to, each copy linked to the
+// original key by MovedFrom, and records the move in the history of from
+func (d *dynamodbBackend) MoveTracking(ctx context.Context, from string, to string) error {
+	records, err := d.tracking(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	tracking := map[string]RecordTracking{}
+
+	for _, record := range records {
+		movedFrom := record.MovedFrom
+		if movedFrom == "" {
+			movedFrom = from
+		}
+		copied := newRecordTracking(to, record.Value, record.Metadata)
+		copied.Timestamp = record.Timestamp
+		copied.MovedFrom = movedFrom
+		tracking[record.Timestamp] = copied
+	}
+
+	moved := newRecordTracking(from, nil, models.Metadata{UpdatedAt: now, UpdatedBy: updatedBy, Action: "move"})
+	moved.MovedTo = to
+
+	requests := append(prepareWriteRequest(tracking), prepareWriteRequest(map[string]RecordTracking{from: moved})...)
+	return d.writeReqsBatch(ctx, d.config.TrackingEntryTableName, requests).Err
+}
+
+// tracking records of the key, newest first
+func (d *dynamodbBackend) tracking(ctx context.Context, key string) ([]RecordTracking, error) {
+	records := make([]RecordTracking, 0)
 	keyEx := expression.Key("Key").Equal(expression.Value(key))
 	expr, err := expression.NewBuilder().
 		WithKeyCondition(keyEx).
@@ -387,27 +933,16 @@ func (d *dynamodbBackend) Tracking(ctx context.Context, key string) ([]models.Tr
 			log.Printf("Err Couldn't query for records released in %v. %v\n", key, err)
 			return nil, err
 		}
-		var records []Record
-		err = attributevalue.UnmarshalListOfMaps(response.Items, &records)
+		var page []RecordTracking
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
 		if err != nil {
 			log.Printf("Err Couldn't unmarshal query response. %v\n", err)
 			return nil, err
 		}
-
-		for _, record := range records {
-			if !strings.HasPrefix(record.Key, DynamoDBLockPrefix) {
-				entries = append(entries, models.Tracking{
-					Key:       record.Key,
-					Value:     string(record.Value),
-					Secure:    record.Metadata.Secure,
-					UpdatedAt: record.Metadata.UpdatedAt,
-					UpdatedBy: record.Metadata.UpdatedBy,
-				})
-			}
-		}
+		records = append(records, page...)
 	}
 
-	return entries, nil
+	return records, nil
 }
 
 func prepareWriteRequest[T any](items map[string]T) []types.WriteRequest {
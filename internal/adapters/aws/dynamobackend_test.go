@@ -0,0 +1,71 @@
+package aws
+
+import (
+	"nbox/internal/domain/models"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestNewRecordTracking(t *testing.T) {
+	now := time.Unix(1760000000, 0).UTC()
+
+	item, err := attributevalue.MarshalMap(newRecordTracking("production/api/db_host", []byte("db.internal"), models.Metadata{
+		UpdatedAt: now, UpdatedBy: "alice", Action: "upsert",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]types.AttributeValue{
+		"Timestamp":      &types.AttributeValueMemberS{Value: "1760000000"},
+		"Kind":           &types.AttributeValueMemberS{Value: TrackingRecordKind},
+		"Stage":          &types.AttributeValueMemberS{Value: "production"},
+		"UpdatedBy":      &types.AttributeValueMemberS{Value: "alice"},
+		"UpdatedByStage": &types.AttributeValueMemberS{Value: "alice#production"},
+		"UpdatedAt":      &types.AttributeValueMemberN{Value: "1760000000"},
+	}
+	for name, value := range expected {
+		switch v := value.(type) {
+		case *types.AttributeValueMemberS:
+			if got, ok := item[name].(*types.AttributeValueMemberS); !ok || got.Value != v.Value {
+				t.Errorf("%s = %v, want %s", name, item[name], v.Value)
+			}
+		case *types.AttributeValueMemberN:
+			if got, ok := item[name].(*types.AttributeValueMemberN); !ok || got.Value != v.Value {
+				t.Errorf("%s = %v, want %s", name, item[name], v.Value)
+			}
+		}
+	}
+
+	// index keys can't be empty strings, records without user aren't indexed by user
+	item, err = attributevalue.MarshalMap(newRecordTracking("box:payments/production/app.json", nil, models.Metadata{UpdatedAt: now}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"UpdatedBy", "UpdatedByStage"} {
+		if _, ok := item[name]; ok {
+			t.Errorf("%s = %v, want it omitted", name, item[name])
+		}
+	}
+}
+
+func TestRecordTracking_Index(t *testing.T) {
+	now := time.Unix(1760000000, 0).UTC()
+
+	// records stored before the activity indexes only have the metadata
+	legacy := RecordTracking{Timestamp: "1760000000", RecordBase: &RecordBase{
+		Key: "development/app/url", Metadata: models.Metadata{UpdatedAt: now, UpdatedBy: "bob"},
+	}}
+	if legacy.indexed() {
+		t.Fatalf("Expected the legacy record without index attributes")
+	}
+
+	legacy.index()
+	if !legacy.indexed() || legacy.Kind != TrackingRecordKind || legacy.Stage != "development" ||
+		legacy.UpdatedByStage != "bob#development" || !legacy.UpdatedAt.Equal(now) {
+		t.Errorf("Expected the index attributes from the metadata got: %+v", legacy)
+	}
+}
@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	pkgPath "path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const SnapshotsPrefix = "_snapshots" // SnapshotsPrefix bucket folder for the stage snapshots, one json per snapshot
+
+type s3SnapshotStore struct {
+	s3     *s3.Client
+	config *application.Config
+}
+
+func NewS3SnapshotStore(s3 *s3.Client, config *application.Config) domain.SnapshotAdapter {
+	return &s3SnapshotStore{s3: s3, config: config}
+}
+
+func snapshotPath(stage string, name string) string {
+	return fmt.Sprintf("%s/%s/%s.json", SnapshotsPrefix, stage, name)
+}
+
+func (s *s3SnapshotStore) Save(ctx context.Context, snapshot *models.Snapshot) error {
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.config.BucketName),
+		Key:         aws.String(snapshotPath(snapshot.Stage, snapshot.Name)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Retrieve the snapshot, nil when it doesn't exist
+func (s *s3SnapshotStore) Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	object, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.BucketName),
+		Key:    aws.String(snapshotPath(stage, name)),
+	})
+
+	var notFound *s3types.NoSuchKey
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(object.Body)
+
+	snapshot := &models.Snapshot{}
+	if err = json.NewDecoder(object.Body).Decode(snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// List snapshots of the stage
+func (s *s3SnapshotStore) List(ctx context.Context, stage string) ([]models.SnapshotSummary, error) {
+	snapshots := make([]models.SnapshotSummary, 0)
+
+	paginator := s3.NewListObjectsV2Paginator(s.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.BucketName),
+		Prefix: aws.String(fmt.Sprintf("%s/%s/", SnapshotsPrefix, stage)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			snapshots = append(snapshots, models.SnapshotSummary{
+				Name:      strings.TrimSuffix(pkgPath.Base(aws.ToString(object.Key)), ".json"),
+				Stage:     stage,
+				CreatedAt: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+
+	return snapshots, nil
+}
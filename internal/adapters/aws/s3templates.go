@@ -5,29 +5,97 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"nbox/internal/application"
 	"nbox/internal/domain"
 	"nbox/internal/domain/models"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+const (
+	PartialsPrefix = "_partials" // PartialsPrefix bucket folder for shared partials and overlay bases
+	TrashPrefix    = "_trash"    // TrashPrefix bucket folder for soft deleted templates
+
+	BoxRecordKind            = "box"                          // BoxRecordKind constant hash key of the Kind index, lists every box
+	BoxKindIndexName         = "Kind-UpdatedAt-index"         // BoxKindIndexName GSI hash: Kind, range: UpdatedAt
+	BoxServiceIndexName      = "Service-UpdatedAt-index"      // BoxServiceIndexName GSI hash: Service, range: UpdatedAt
+	BoxStageIndexName        = "StageName-UpdatedAt-index"    // BoxStageIndexName GSI hash: StageName, range: UpdatedAt
+	BoxServiceStageIndexName = "ServiceStage-UpdatedAt-index" // BoxServiceStageIndexName GSI hash: ServiceStage, range: UpdatedAt
+	BoxListDefaultLimit      = 50
+	BoxListMaximumLimit      = 500
+)
+
 type s3TemplateStore struct {
 	s3             *s3.Client
 	dynamodbClient *dynamodb.Client
 	config         *application.Config
 }
 
+// BoxRecord one item per template, the Stage range key is "<stage>/<template>".
+// Records written before stages had many templates use "<stage>" and no StageName.
+// Soft deleted records have no UpdatedAt, so the sparse UpdatedAt indexes only list
+// the live templates.
 type BoxRecord struct {
-	Service  string          `dynamodbav:"Service"`
-	Stage    string          `dynamodbav:"Stage"`
-	Template models.Template `dynamodbav:"Template"`
+	Service      string           `dynamodbav:"Service"`
+	Stage        string           `dynamodbav:"Stage"`
+	StageName    string           `dynamodbav:"StageName,omitempty"`
+	ServiceStage string           `dynamodbav:"ServiceStage,omitempty"` // ServiceStage "<service>#<stage>"
+	Template     models.Template  `dynamodbav:"Template"`
+	Resolution   []string         `dynamodbav:"Resolution,omitempty"`
+	Deleted      *models.Metadata `dynamodbav:"Deleted,omitempty"`
+	PurgeAt      int64            `dynamodbav:"PurgeAt,omitempty"` // TTL of soft deleted records
+	Kind         string           `dynamodbav:"Kind,omitempty"`
+	UpdatedAt    *time.Time       `dynamodbav:"UpdatedAt,unixtime,omitempty"`
+}
+
+// names stage and template name of the record
+func (r *BoxRecord) names() (string, string) {
+	if r.StageName != "" {
+		return r.StageName, r.Template.Value
+	}
+	return r.Stage, r.Template.Value
+}
+
+// index sets the attributes of the listing indexes, updated at the time given, and
+// removes them from soft deleted records
+func (r *BoxRecord) index(updatedAt time.Time) {
+	stageName, _ := r.names()
+	r.StageName = stageName
+
+	if r.Deleted != nil {
+		r.Kind = ""
+		r.ServiceStage = ""
+		r.UpdatedAt = nil
+		return
+	}
+	r.Kind = BoxRecordKind
+	r.ServiceStage = serviceStage(r.Service, stageName)
+	r.UpdatedAt = &updatedAt
+}
+
+// indexed the record has the attributes of the listing indexes
+func (r *BoxRecord) indexed() bool {
+	if r.Deleted != nil {
+		return r.UpdatedAt == nil && r.Kind == "" && r.ServiceStage == ""
+	}
+	stageName, _ := r.names()
+	return r.UpdatedAt != nil && r.Kind == BoxRecordKind && r.StageName == stageName && r.ServiceStage == serviceStage(r.Service, stageName)
+}
+
+func serviceStage(service string, stage string) string {
+	return service + "#" + stage
 }
 
 func NewS3TemplateStore(s3 *s3.Client, config *application.Config, dynamodb *dynamodb.Client) domain.TemplateAdapter {
@@ -38,17 +106,22 @@ func NewS3TemplateStore(s3 *s3.Client, config *application.Config, dynamodb *dyn
 	}
 }
 
-func (b *s3TemplateStore) store(ctx context.Context, path string, stage models.Stage) (*s3.PutObjectOutput, error) {
+func (b *s3TemplateStore) store(ctx context.Context, path string, template models.Template) (*s3.PutObjectOutput, error) {
 	var out bytes.Buffer
 
-	decoded, err := base64.StdEncoding.DecodeString(stage.Template.Value)
+	decoded, err := base64.StdEncoding.DecodeString(template.Value)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Indent(&out, decoded, "", "  ")
-	if err != nil {
-		return nil, err
+	// templates with {{> partial}} includes are only valid JSON once composed
+	if json.Valid(decoded) {
+		err = json.Indent(&out, decoded, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		out.Write(decoded)
 	}
 
 	return b.s3.PutObject(ctx, &s3.PutObjectInput{
@@ -70,7 +143,48 @@ func (b *s3TemplateStore) BoxExists(ctx context.Context, service string, stage s
 }
 
 func (b *s3TemplateStore) RetrieveBox(ctx context.Context, service string, stage string, template string) ([]byte, error) {
-	path := fmt.Sprintf("%s/%s/%s", service, stage, template)
+	return b.retrieve(ctx, fmt.Sprintf("%s/%s/%s", service, stage, template))
+}
+
+// RetrieveStage box records of the stage, without the templates content
+func (b *s3TemplateStore) RetrieveStage(ctx context.Context, service string, stage string) (*models.Stage, error) {
+	records, err := b.records(ctx, service, stage, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var result *models.Stage
+	for _, record := range records {
+		if record.Deleted != nil {
+			continue
+		}
+		if result == nil {
+			result = &models.Stage{Resolution: record.Resolution}
+		}
+		result.Templates = append(result.Templates, record.Template)
+	}
+
+	return result, nil
+}
+
+func (b *s3TemplateStore) UpsertPartial(ctx context.Context, name string, value []byte) error {
+	_, err := b.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.config.BucketName),
+		Key:    aws.String(partialPath(name)),
+		Body:   bytes.NewReader(value),
+	})
+	return err
+}
+
+func (b *s3TemplateStore) RetrievePartial(ctx context.Context, name string) ([]byte, error) {
+	return b.retrieve(ctx, partialPath(name))
+}
+
+func partialPath(name string) string {
+	return fmt.Sprintf("%s/%s", PartialsPrefix, strings.Trim(name, "/"))
+}
+
+func (b *s3TemplateStore) retrieve(ctx context.Context, path string) ([]byte, error) {
 	object, err := b.s3.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(b.config.BucketName),
 		Key:    aws.String(path),
@@ -95,68 +209,414 @@ func (b *s3TemplateStore) RetrieveBox(ctx context.Context, service string, stage
 
 func (b *s3TemplateStore) UpsertBox(ctx context.Context, box *models.Box) []string {
 	result := make([]string, 0)
-	var item map[string]types.AttributeValue
 
 	for stageName, stage := range box.Stage {
-		name := stage.Template.Name
-		path := fmt.Sprintf("%s/%s/%s", box.Service, stageName, stage.Template.Name)
-
-		stage.Template.Name = path
-		box.Stage[stageName] = stage
-		_, err := b.store(ctx, path, stage)
-		fmt.Printf("ErrStore. %s", err)
-		if err == nil {
-			item, _ = attributevalue.MarshalMap(BoxRecord{
-				Service: box.Service,
-				Stage:   stageName,
+		resolution := stage.Resolution
+		if len(resolution) == 0 {
+			resolution = box.Resolution
+		}
+
+		for _, template := range stage.GetTemplates() {
+			path := fmt.Sprintf("%s/%s/%s", box.Service, stageName, template.Name)
+
+			if _, err := b.store(ctx, path, template); err != nil {
+				log.Printf("Err store template %s. %v\n", path, err)
+				continue
+			}
+
+			err := b.put(ctx, BoxRecord{
+				Service:   box.Service,
+				Stage:     fmt.Sprintf("%s/%s", stageName, template.Name),
+				StageName: stageName,
 				Template: models.Template{
-					Name:  path,
-					Value: name,
+					Name:       path,
+					Value:      template.Name,
+					Parameters: template.Parameters,
 				},
+				Resolution: resolution,
 			})
-			_, err = b.dynamodbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
-				TableName: aws.String(b.config.BoxTableName), Item: item,
-			})
-			fmt.Printf("ErrDbStore. %s", err)
-		}
+			if err != nil {
+				log.Printf("Err store box record %s. %v\n", path, err)
+				continue
+			}
 
-		if err == nil {
+			b.deleteLegacyRecord(ctx, box.Service, stageName, template.Name)
 			result = append(result, path)
 		}
 	}
 	return result
 }
 
-func (b *s3TemplateStore) List(ctx context.Context) ([]models.Box, error) {
-	boxes := map[string]models.Box{}
-	results := make([]models.Box, 0)
+// deleteLegacyRecord removes the single template record of the stage once the
+// template is stored with its own record
+func (b *s3TemplateStore) deleteLegacyRecord(ctx context.Context, service string, stage string, template string) {
+	s, _ := attributevalue.Marshal(service)
+	st, _ := attributevalue.Marshal(stage)
+
+	condition := expression.Name("Template.value").Equal(expression.Value(template))
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return
+	}
 
-	scan, err := b.dynamodbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName:              aws.String(b.config.BoxTableName),
-		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+	_, err = b.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(b.config.BoxTableName),
+		Key:                       map[string]types.AttributeValue{"Service": s, "Stage": st},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
 	})
 
+	var conditionalErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionalErr) {
+		log.Printf("Err delete legacy box record %s/%s. %v\n", service, stage, err)
+	}
+}
+
+// List box templates sorted by last update, filtered by service and stage.
+// Records are queried from the UpdatedAt indexes, one page at a time.
+func (b *s3TemplateStore) List(ctx context.Context, filter models.BoxFilter) (*models.BoxPage, error) {
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = BoxListDefaultLimit
+	}
+	if limit > BoxListMaximumLimit {
+		limit = BoxListMaximumLimit
+	}
+
+	// every filter is the key of an index, pages are never cut by a filter expression
+	var indexName string
+	var keyEx expression.KeyConditionBuilder
+
+	switch {
+	case filter.Service != "" && filter.Stage != "":
+		indexName = BoxServiceStageIndexName
+		keyEx = expression.Key("ServiceStage").Equal(expression.Value(serviceStage(filter.Service, filter.Stage)))
+	case filter.Service != "":
+		indexName = BoxServiceIndexName
+		keyEx = expression.Key("Service").Equal(expression.Value(filter.Service))
+	case filter.Stage != "":
+		indexName = BoxStageIndexName
+		keyEx = expression.Key("StageName").Equal(expression.Value(filter.Stage))
+	default:
+		indexName = BoxKindIndexName
+		keyEx = expression.Key("Kind").Equal(expression.Value(BoxRecordKind))
+	}
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, i := range scan.Items {
-		var record BoxRecord
-		err = attributevalue.UnmarshalMap(i, &record)
+	response, err := b.dynamodbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(b.config.BoxTableName),
+		IndexName:                 aws.String(indexName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		Limit:                     aws.Int32(int32(limit)),
+		ScanIndexForward:          aws.Bool(filter.Ascending),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []BoxRecord
+	if err = attributevalue.UnmarshalListOfMaps(response.Items, &records); err != nil {
+		return nil, err
+	}
+
+	page := &models.BoxPage{Boxes: make([]models.BoxSummary, 0, len(records))}
+	for _, record := range records {
+		stageName, templateName := record.names()
+		page.Boxes = append(page.Boxes, models.BoxSummary{
+			Service:    record.Service,
+			Stage:      stageName,
+			Template:   templateName,
+			Path:       record.Template.Name,
+			Parameters: record.Template.Parameters,
+			Resolution: record.Resolution,
+			UpdatedAt:  aws.ToTime(record.UpdatedAt),
+		})
+	}
+
+	page.Cursor, err = encodeCursor(response.LastEvaluatedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// DeleteBox soft deletes the templates of the service, optionally of a stage and template.
+// The objects are moved to the trash folder and the records marked as deleted until
+// the restore window expires, then the PurgeAt TTL removes them. The record is marked
+// first, only while it's live, and put back when the object can't be moved.
+func (b *s3TemplateStore) DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	records, err := b.records(ctx, service, stage, template)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	result := make([]string, 0)
+
+	for _, record := range records {
+		if record.Deleted != nil {
+			continue
+		}
+
+		path := record.Template.Name
+		previous := record
+
+		record.Deleted = &models.Metadata{UpdatedAt: now, UpdatedBy: updatedBy, Action: "delete"}
+		record.PurgeAt = now.Add(b.config.BoxRestoreWindow).Unix()
+		written, err := b.putIf(ctx, record, expression.AttributeNotExists(expression.Name("Deleted")))
 		if err != nil {
+			return result, err
+		}
+		if !written {
+			continue // deleted by a concurrent request
+		}
+
+		if err = b.move(ctx, path, fmt.Sprintf("%s/%s", TrashPrefix, path)); err != nil {
+			log.Printf("Err delete template %s. %v\n", path, err)
+			b.rollback(ctx, previous)
+			return result, err
+		}
+
+		b.track(ctx, path, "delete", now, updatedBy)
+		result = append(result, path)
+	}
+
+	return result, nil
+}
+
+// RestoreBox restores soft deleted templates within the restore window, like DeleteBox the
+// record is restored first and put back when the object can't be moved
+func (b *s3TemplateStore) RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	records, err := b.records(ctx, service, stage, template)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	result := make([]string, 0)
+
+	for _, record := range records {
+		if record.Deleted == nil {
 			continue
 		}
 
-		_, ok := boxes[record.Service]
-		if !ok {
-			boxes[record.Service] = models.Box{Service: record.Service, Stage: map[string]models.Stage{}}
+		path := record.Template.Name
+		if record.PurgeAt > 0 && now.Unix() > record.PurgeAt {
+			return result, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, path)
+		}
+
+		previous := record
+
+		record.Deleted = nil
+		record.PurgeAt = 0
+		written, err := b.putIf(ctx, record, expression.AttributeExists(expression.Name("Deleted")))
+		if err != nil {
+			return result, err
+		}
+		if !written {
+			continue // restored by a concurrent request
+		}
+
+		if err = b.move(ctx, fmt.Sprintf("%s/%s", TrashPrefix, path), path); err != nil {
+			log.Printf("Err restore template %s. %v\n", path, err)
+			b.rollback(ctx, previous)
+			return result, err
+		}
+
+		b.track(ctx, path, "restore", now, updatedBy)
+		result = append(result, path)
+	}
+
+	return result, nil
+}
+
+// records box records of the service, filtered by stage and template name when given
+func (b *s3TemplateStore) records(ctx context.Context, service string, stage string, template string) ([]BoxRecord, error) {
+	keyEx := expression.Key("Service").Equal(expression.Value(service))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]BoxRecord, 0)
+	queryPaginator := dynamodb.NewQueryPaginator(b.dynamodbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(b.config.BoxTableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for queryPaginator.HasMorePages() {
+		response, err := queryPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []BoxRecord
+		if err = attributevalue.UnmarshalListOfMaps(response.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, record := range page {
+			stageName, templateName := record.names()
+			if (stage == "" || stageName == stage) && (template == "" || templateName == template) {
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// Backfill writes the attributes of the listing indexes on the records stored before
+// them. Live templates keep the last modification of their object as update time.
+func (b *s3TemplateStore) Backfill(ctx context.Context) (int, error) {
+	updated := 0
+	scanPaginator := dynamodb.NewScanPaginator(b.dynamodbClient, &dynamodb.ScanInput{
+		TableName: aws.String(b.config.BoxTableName),
+	})
+	for scanPaginator.HasMorePages() {
+		response, err := scanPaginator.NextPage(ctx)
+		if err != nil {
+			return updated, err
+		}
+		var page []BoxRecord
+		if err = attributevalue.UnmarshalListOfMaps(response.Items, &page); err != nil {
+			return updated, err
+		}
+
+		for _, record := range page {
+			if record.indexed() {
+				continue
+			}
+
+			updatedAt := time.Now().UTC()
+			if record.UpdatedAt != nil {
+				updatedAt = *record.UpdatedAt
+			} else if record.Deleted == nil {
+				head, err := b.s3.HeadObject(ctx, &s3.HeadObjectInput{
+					Bucket: aws.String(b.config.BucketName),
+					Key:    aws.String(record.Template.Name),
+				})
+				if err == nil && head.LastModified != nil {
+					updatedAt = head.LastModified.UTC()
+				}
+			}
+
+			record.index(updatedAt)
+			if err = b.write(ctx, record); err != nil {
+				return updated, fmt.Errorf("%s: %w", record.Template.Name, err)
+			}
+			updated++
 		}
-		boxes[record.Service].Stage[record.Stage] = models.Stage{Template: record.Template}
 	}
+	return updated, nil
+}
+
+// put writes the record as updated now, so it's listed first by the UpdatedAt indexes
+func (b *s3TemplateStore) put(ctx context.Context, record BoxRecord) error {
+	record.index(time.Now().UTC())
+	return b.write(ctx, record)
+}
+
+func (b *s3TemplateStore) write(ctx context.Context, record BoxRecord) error {
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = b.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.config.BoxTableName), Item: item,
+	})
+	return err
+}
 
-	for _, box := range boxes {
-		results = append(results, box)
+// putIf writes the record when the condition holds, false when it doesn't
+func (b *s3TemplateStore) putIf(ctx context.Context, record BoxRecord, condition expression.ConditionBuilder) (bool, error) {
+	record.index(time.Now().UTC())
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return false, err
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return false, err
 	}
 
-	return results, nil
+	_, err = b.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(b.config.BoxTableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+
+	var conditionalErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// rollback writes the record back as it was before a failed move
+func (b *s3TemplateStore) rollback(ctx context.Context, record BoxRecord) {
+	if err := b.write(ctx, record); err != nil {
+		log.Printf("Err rollback box record %s. %v\n", record.Template.Name, err)
+	}
+}
+
+// move copies the object and deletes the source, a failed move leaves only the source
+func (b *s3TemplateStore) move(ctx context.Context, from string, to string) error {
+	_, err := b.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(b.config.BucketName),
+		CopySource: aws.String(url.PathEscape(fmt.Sprintf("%s/%s", b.config.BucketName, from))),
+		Key:        aws.String(to),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.config.BucketName),
+		Key:    aws.String(from),
+	})
+	if err != nil {
+		_, copyErr := b.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(b.config.BucketName),
+			Key:    aws.String(to),
+		})
+		if copyErr != nil {
+			log.Printf("Err remove copy %s. %v\n", to, copyErr)
+		}
+	}
+	return err
+}
+
+// track writes the box operation in the tracking table under the box:<path> key
+func (b *s3TemplateStore) track(ctx context.Context, path string, action string, now time.Time, updatedBy string) {
+	item, _ := attributevalue.MarshalMap(newRecordTracking(fmt.Sprintf("box:%s", path), nil, models.Metadata{
+		UpdatedAt: now,
+		UpdatedBy: updatedBy,
+		Action:    action,
+	}))
+
+	_, err := b.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.config.TrackingEntryTableName), Item: item,
+	})
+	if err != nil {
+		log.Printf("Err save tracking. %s %s. %v\n", action, path, err)
+	}
 }
@@ -0,0 +1,54 @@
+package aws
+
+import (
+	"nbox/internal/domain/models"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestBoxRecord_Index(t *testing.T) {
+	now := time.Unix(1760000000, 0).UTC()
+
+	legacy := BoxRecord{Service: "payments", Stage: "production", Template: models.Template{Name: "payments/production/task.json", Value: "task.json"}}
+	if legacy.indexed() {
+		t.Errorf(`Expected the legacy record without index attributes`)
+	}
+
+	legacy.index(now)
+	if !legacy.indexed() {
+		t.Errorf(`Expected the record indexed got: %+v`, legacy)
+	}
+
+	item, err := attributevalue.MarshalMap(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := item["UpdatedAt"].(*types.AttributeValueMemberN); !ok || v.Value != "1760000000" {
+		t.Errorf(`Expected UpdatedAt as unix time got: %v`, item["UpdatedAt"])
+	}
+	if v, ok := item["ServiceStage"].(*types.AttributeValueMemberS); !ok || v.Value != "payments#production" {
+		t.Errorf(`Expected the service and stage key got: %v`, item["ServiceStage"])
+	}
+	if v, ok := item["StageName"].(*types.AttributeValueMemberS); !ok || v.Value != "production" {
+		t.Errorf(`Expected the stage name of the legacy record got: %v`, item["StageName"])
+	}
+
+	legacy.Deleted = &models.Metadata{UpdatedAt: now, Action: "delete"}
+	legacy.index(now)
+	item, err = attributevalue.MarshalMap(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"UpdatedAt", "Kind", "ServiceStage"} {
+		if _, ok := item[name]; ok {
+			t.Errorf(`Expected the deleted record out of the indexes, has %s`, name)
+		}
+	}
+	var decoded BoxRecord
+	if err = attributevalue.UnmarshalMap(item, &decoded); err != nil || !decoded.indexed() {
+		t.Errorf(`Expected the deleted record indexed got: %+v %v`, decoded, err)
+	}
+}
@@ -0,0 +1,136 @@
+package aws
+
+import (
+	"context"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SearchKeyIndexName GSI of the search table by Key
+const SearchKeyIndexName = "Key-index"
+
+type SearchRecord struct {
+	Term      string    `dynamodbav:"Term"`
+	Key       string    `dynamodbav:"Key"`
+	UpdatedAt time.Time `dynamodbav:"UpdatedAt,unixtime"`
+}
+
+// dynamodbSearchIndex inverted index of the entries, one item per (term, key) pair.
+// Term is the hash key, Key the range key so searches are narrowed by prefix with
+// begins_with, and the Key-index GSI allows replacing all the terms of an entry.
+type dynamodbSearchIndex struct {
+	client     *dynamodb.Client
+	config     *application.Config
+	permitPool *PermitPool
+}
+
+func NewDynamodbSearchIndex(dynamodb *dynamodb.Client, config *application.Config) domain.SearchAdapter {
+	return &dynamodbSearchIndex{
+		client:     dynamodb,
+		config:     config,
+		permitPool: NewPermitPool(0),
+	}
+}
+
+// Replace sets the terms of the entry key, removing the ones it no longer has
+func (s *dynamodbSearchIndex) Replace(ctx context.Context, key string, terms []string) error {
+	keyEx := expression.Key("Key").Equal(expression.Value(key))
+	current, err := s.query(ctx, SearchKeyIndexName, keyEx)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	var requests []types.WriteRequest
+	for _, record := range current {
+		if wanted[record.Term] {
+			continue
+		}
+		t, _ := attributevalue.Marshal(record.Term)
+		k, _ := attributevalue.Marshal(record.Key)
+		requests = append(requests, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{"Term": t, "Key": k}},
+		})
+	}
+
+	now := time.Now().UTC()
+	records := map[string]SearchRecord{}
+	for term := range wanted {
+		records[term] = SearchRecord{Term: term, Key: key, UpdatedAt: now}
+	}
+	requests = append(requests, prepareWriteRequest(records)...)
+
+	result := writeReqsBatch(ctx, s.client, s.permitPool, s.config.SearchTableName, requests)
+	return result.Err
+}
+
+// Search keys indexed with the term, under the prefix when given
+func (s *dynamodbSearchIndex) Search(ctx context.Context, term string, prefix string) ([]string, error) {
+	keyEx := expression.Key("Term").Equal(expression.Value(term))
+	if prefix != "" {
+		keyEx = keyEx.And(expression.Key("Key").BeginsWith(prefix))
+	}
+
+	records, err := s.query(ctx, "", keyEx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *dynamodbSearchIndex) query(ctx context.Context, indexName string, keyEx expression.KeyConditionBuilder) ([]SearchRecord, error) {
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Err expression Builder %v \n", err)
+		return nil, err
+	}
+
+	queryInput := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.config.SearchTableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	}
+	if indexName != "" {
+		queryInput.IndexName = aws.String(indexName)
+	}
+
+	records := make([]SearchRecord, 0)
+	queryPaginator := dynamodb.NewQueryPaginator(s.client, queryInput)
+	for queryPaginator.HasMorePages() {
+		response, err := queryPaginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Err Couldn't query search index. %v\n", err)
+			return nil, err
+		}
+		var page []SearchRecord
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Err Couldn't unmarshal query response. %v\n", err)
+			return nil, err
+		}
+		records = append(records, page...)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,374 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	SecretBackendSsm            = "ssm"
+	SecretBackendSecretsManager = "secretsmanager"
+	SecretsManagerVersionStage  = "AWSCURRENT" // SecretsManagerVersionStage stage of the references, always the current value
+)
+
+// SecretsManagerClient operations of the secrets manager client used by the store
+type SecretsManagerClient interface {
+	CreateSecret(ctx context.Context, in *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	PutSecretValue(ctx context.Context, in *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	DescribeSecret(ctx context.Context, in *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+	DeleteSecret(ctx context.Context, in *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+	RestoreSecret(ctx context.Context, in *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error)
+	TagResource(ctx context.Context, in *secretsmanager.TagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.TagResourceOutput, error)
+	UntagResource(ctx context.Context, in *secretsmanager.UntagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UntagResourceOutput, error)
+}
+
+func NewSecretsManagerClient(cfg *aws.Config) *secretsmanager.Client {
+	return secretsmanager.NewFromConfig(*cfg)
+}
+
+// secretsManagerStore secure entries as secrets manager secrets named as the key. The entry
+// references the secret in the ECS valueFrom format arn:...:secret:<name>-<suffix>::AWSCURRENT:
+type secretsManagerStore struct {
+	client SecretsManagerClient
+	config *application.Config
+}
+
+func NewSecretsManagerStore(client SecretsManagerClient, config *application.Config) domain.SecretAdapter {
+	return &secretsManagerStore{client: client, config: config}
+}
+
+func (s *secretsManagerStore) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	summary := make(map[string]error)
+	for _, entry := range entries {
+		err := s.send(ctx, entry)
+		if err != nil {
+			log.Printf("Err upsert secret[%s]. %v\n", entry.Key, err)
+		}
+		summary[entry.Key] = err
+	}
+	return summary
+}
+
+// send writes a new version of the secret, the secret is created on the first write. A
+// secret scheduled for deletion keeps its name during the recovery window, it's restored
+// and written again.
+func (s *secretsManagerStore) send(ctx context.Context, entry models.Entry) error {
+	name := secretName(entry.Key)
+	tags := secretsManagerTags(entry)
+
+	in := &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(entry.Value),
+	}
+	_, err := s.client.PutSecretValue(ctx, in)
+
+	var invalidRequest *smtypes.InvalidRequestException
+	if errors.As(err, &invalidRequest) && s.scheduledForDeletion(ctx, name) {
+		if _, err = s.client.RestoreSecret(ctx, &secretsmanager.RestoreSecretInput{SecretId: aws.String(name)}); err != nil {
+			return err
+		}
+		_, err = s.client.PutSecretValue(ctx, in)
+	}
+
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		in := &secretsmanager.CreateSecretInput{
+			Name:         aws.String(name),
+			SecretString: aws.String(entry.Value),
+			Tags:         append(tags, smtypes.Tag{Key: aws.String("project"), Value: aws.String("nbox")}),
+		}
+		if entry.Description != "" {
+			in.Description = aws.String(entry.Description)
+		}
+		if s.config.SecretsManagerKeyId != "" {
+			in.KmsKeyId = aws.String(s.config.SecretsManagerKeyId)
+		}
+		_, err = s.client.CreateSecret(ctx, in)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	s.removeStaleTags(ctx, name, tags)
+	if len(tags) > 0 {
+		_, err = s.client.TagResource(ctx, &secretsmanager.TagResourceInput{SecretId: aws.String(name), Tags: tags})
+		if err != nil {
+			log.Printf("Err add tags [secret:%s]. %v \n", name, err)
+		}
+	}
+	return nil
+}
+
+// removeStaleTags removes the metadata tags of the secret the entry no longer has
+func (s *secretsManagerStore) removeStaleTags(ctx context.Context, name string, tags []smtypes.Tag) {
+	out, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	if err != nil {
+		log.Printf("Err list tags [secret:%s]. %v \n", name, err)
+		return
+	}
+
+	current := make([]string, 0, len(out.Tags))
+	for _, tag := range out.Tags {
+		current = append(current, aws.ToString(tag.Key))
+	}
+	wanted := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		wanted = append(wanted, aws.ToString(tag.Key))
+	}
+
+	stale := staleTagKeys(current, wanted)
+	if len(stale) == 0 {
+		return
+	}
+	if _, err = s.client.UntagResource(ctx, &secretsmanager.UntagResourceInput{SecretId: aws.String(name), TagKeys: stale}); err != nil {
+		log.Printf("Err remove tags [secret:%s]. %v \n", name, err)
+	}
+}
+
+// scheduledForDeletion the secret was deleted and is in its recovery window
+func (s *secretsManagerStore) scheduledForDeletion(ctx context.Context, name string) bool {
+	out, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	return err == nil && out.DeletedDate != nil
+}
+
+// Reference ARN of the secret of the key with the current version stage
+func (s *secretsManagerStore) Reference(ctx context.Context, key string) (string, error) {
+	out, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(secretName(key))})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s::%s:", aws.ToString(out.ARN), SecretsManagerVersionStage), nil
+}
+
+// Retrieve value of the secret version of the reference, a json key of the reference is read from the json value
+func (s *secretsManagerStore) Retrieve(ctx context.Context, reference string) (string, error) {
+	secret := parseSecretReference(reference)
+
+	in := &secretsmanager.GetSecretValueInput{SecretId: aws.String(secret.id)}
+	if secret.versionStage != "" {
+		in.VersionStage = aws.String(secret.versionStage)
+	}
+	if secret.versionId != "" {
+		in.VersionId = aws.String(secret.versionId)
+	}
+
+	out, err := s.client.GetSecretValue(ctx, in)
+	if err != nil {
+		return "", err
+	}
+
+	value := aws.ToString(out.SecretString)
+	if secret.jsonKey == "" {
+		return value, nil
+	}
+
+	values := map[string]interface{}{}
+	if err = json.Unmarshal([]byte(value), &values); err != nil {
+		return "", fmt.Errorf("secret %s isn't json: %w", secret.id, err)
+	}
+	field, ok := values[secret.jsonKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", secret.id, secret.jsonKey)
+	}
+	if text, ok := field.(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(field), nil
+}
+
+// Version VersionId of the version stage of the reference, AWSCURRENT by default. A
+// version is read back with the version id selector of the ARN, <arn>:<json-key>::<id>
+func (s *secretsManagerStore) Version(ctx context.Context, reference string) (string, error) {
+	secret := parseSecretReference(reference)
+	if secret.versionId != "" {
+		return secret.versionId, nil
+	}
+	stage := secret.versionStage
+	if stage == "" {
+		stage = SecretsManagerVersionStage
+	}
+
+	out, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(secret.id)})
+	if err != nil {
+		return "", err
+	}
+	for id, stages := range out.VersionIdsToStages {
+		for _, versionStage := range stages {
+			if versionStage == stage {
+				return id, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("secret %s has no version %s", secret.id, stage)
+}
+
+// Describe name, current version and last change of the secret, nil when it doesn't exist.
+// Secrets Manager doesn't report the user of the change.
+func (s *secretsManagerStore) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	out, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(parseSecretReference(reference).id),
+	})
+
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &models.SecretMetadata{Name: aws.ToString(out.Name), LastModifiedAt: aws.ToTime(out.LastChangedDate)}
+	for id, stages := range out.VersionIdsToStages {
+		if slices.Contains(stages, SecretsManagerVersionStage) {
+			metadata.VersionId = id
+		}
+	}
+	return metadata, nil
+}
+
+// Delete schedules the deletion of the secret with the default recovery window, writing
+// the key again restores it
+func (s *secretsManagerStore) Delete(ctx context.Context, reference string) error {
+	_, err := s.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId: aws.String(parseSecretReference(reference).id),
+	})
+	return err
+}
+
+type secretReference struct {
+	id           string
+	jsonKey      string
+	versionStage string
+	versionId    string
+}
+
+// parseSecretReference arn:aws:secretsmanager:<region>:<account>:secret:<name>[:json-key:version-stage:version-id],
+// any other reference is a secret name
+func parseSecretReference(reference string) secretReference {
+	parts := strings.Split(reference, ":")
+	if len(parts) < 7 || parts[2] != SecretBackendSecretsManager {
+		return secretReference{id: reference}
+	}
+
+	secret := secretReference{id: strings.Join(parts[:7], ":")}
+	for i, value := range parts[7:] {
+		switch i {
+		case 0:
+			secret.jsonKey = value
+		case 1:
+			secret.versionStage = value
+		case 2:
+			secret.versionId = value
+		}
+	}
+	return secret
+}
+
+func isSecretsManagerReference(reference string) bool {
+	parts := strings.SplitN(reference, ":", 4)
+	return len(parts) == 4 && parts[0] == "arn" && parts[2] == SecretBackendSecretsManager
+}
+
+// secretName keys are stored without the leading slash of parameter names
+func secretName(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func secretsManagerTags(entry models.Entry) []smtypes.Tag {
+	tags := make([]smtypes.Tag, 0)
+	for _, tag := range secretTags(entry) {
+		tags = append(tags, smtypes.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tags
+}
+
+// secretRouter stores the secure entries in parameter store or secrets manager, globally
+// with NBOX_SECRET_BACKEND or by key prefix with NBOX_SECRETS_MANAGER_PREFIXES. Existing
+// references are read from the store of their format.
+type secretRouter struct {
+	parameters     domain.SecretAdapter
+	secretsManager domain.SecretAdapter
+	config         *application.Config
+}
+
+func NewSecretRouter(ssmClient *ssm.Client, secretsManagerClient *secretsmanager.Client, config *application.Config) domain.SecretAdapter {
+	return &secretRouter{
+		parameters:     NewSecureParameterStore(ssmClient, config),
+		secretsManager: NewSecretsManagerStore(secretsManagerClient, config),
+		config:         config,
+	}
+}
+
+// route store of the new secrets of the key
+func (r *secretRouter) route(key string) domain.SecretAdapter {
+	if r.config.SecretBackend == SecretBackendSecretsManager {
+		return r.secretsManager
+	}
+	key = secretName(key)
+	for _, prefix := range r.config.SecretsManagerPrefixes {
+		prefix = strings.Trim(prefix, "/")
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return r.secretsManager
+		}
+	}
+	return r.parameters
+}
+
+// store of the reference
+func (r *secretRouter) store(reference string) domain.SecretAdapter {
+	if isSecretsManagerReference(reference) {
+		return r.secretsManager
+	}
+	return r.parameters
+}
+
+func (r *secretRouter) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	routed := map[domain.SecretAdapter][]models.Entry{}
+	for _, entry := range entries {
+		adapter := r.route(entry.Key)
+		routed[adapter] = append(routed[adapter], entry)
+	}
+
+	summary := make(map[string]error)
+	for adapter, group := range routed {
+		for key, err := range adapter.Upsert(ctx, group) {
+			summary[key] = err
+		}
+	}
+	return summary
+}
+
+func (r *secretRouter) Reference(ctx context.Context, key string) (string, error) {
+	return r.route(key).Reference(ctx, key)
+}
+
+func (r *secretRouter) Retrieve(ctx context.Context, reference string) (string, error) {
+	return r.store(reference).Retrieve(ctx, reference)
+}
+
+func (r *secretRouter) Version(ctx context.Context, reference string) (string, error) {
+	return r.store(reference).Version(ctx, reference)
+}
+
+func (r *secretRouter) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	return r.store(reference).Describe(ctx, reference)
+}
+
+func (r *secretRouter) Delete(ctx context.Context, reference string) error {
+	return r.store(reference).Delete(ctx, reference)
+}
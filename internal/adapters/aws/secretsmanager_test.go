@@ -0,0 +1,226 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// fakeSecretsManager in memory secrets manager, only the current version of each secret
+type fakeSecretsManager struct {
+	values   map[string]string
+	tags     map[string][]smtypes.Tag
+	versions map[string]int // versions written of each secret, the current id is v<count>
+	deleted  map[string]bool
+}
+
+func (f *fakeSecretsManager) versionId(name string) string {
+	return fmt.Sprintf("v%d", f.versions[name])
+}
+
+func (f *fakeSecretsManager) arn(name string) string {
+	return fmt.Sprintf("arn:aws:secretsmanager:us-east-1:111111111111:secret:%s-AbCdEf", name)
+}
+
+func (f *fakeSecretsManager) name(id string) string {
+	for name := range f.values {
+		if id == name || id == f.arn(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func (f *fakeSecretsManager) CreateSecret(ctx context.Context, in *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	f.values[aws.ToString(in.Name)] = aws.ToString(in.SecretString)
+	f.tags[aws.ToString(in.Name)] = in.Tags
+	f.versions[aws.ToString(in.Name)]++
+	return &secretsmanager.CreateSecretOutput{ARN: aws.String(f.arn(aws.ToString(in.Name)))}, nil
+}
+
+func (f *fakeSecretsManager) PutSecretValue(ctx context.Context, in *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	name := f.name(aws.ToString(in.SecretId))
+	if name == "" {
+		return nil, &smtypes.ResourceNotFoundException{Message: in.SecretId}
+	}
+	if f.deleted[name] {
+		return nil, &smtypes.InvalidRequestException{Message: aws.String("secret marked for deletion")}
+	}
+	f.values[name] = aws.ToString(in.SecretString)
+	f.versions[name]++
+	return &secretsmanager.PutSecretValueOutput{ARN: aws.String(f.arn(name))}, nil
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	name := f.name(aws.ToString(in.SecretId))
+	if name == "" || (in.VersionStage != nil && aws.ToString(in.VersionStage) != SecretsManagerVersionStage) ||
+		(in.VersionId != nil && aws.ToString(in.VersionId) != f.versionId(name)) {
+		return nil, &smtypes.ResourceNotFoundException{Message: in.SecretId}
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: aws.String(name), SecretString: aws.String(f.values[name])}, nil
+}
+
+func (f *fakeSecretsManager) DescribeSecret(ctx context.Context, in *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	name := f.name(aws.ToString(in.SecretId))
+	if name == "" {
+		return nil, &smtypes.ResourceNotFoundException{Message: in.SecretId}
+	}
+	out := &secretsmanager.DescribeSecretOutput{
+		Name:               aws.String(name),
+		ARN:                aws.String(f.arn(name)),
+		VersionIdsToStages: map[string][]string{f.versionId(name): {SecretsManagerVersionStage}},
+		Tags:               f.tags[name],
+	}
+	if f.deleted[name] {
+		out.DeletedDate = aws.Time(time.Now())
+	}
+	return out, nil
+}
+
+// DeleteSecret keeps the name of the secret during the recovery window
+func (f *fakeSecretsManager) DeleteSecret(ctx context.Context, in *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error) {
+	f.deleted[f.name(aws.ToString(in.SecretId))] = true
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+func (f *fakeSecretsManager) RestoreSecret(ctx context.Context, in *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error) {
+	delete(f.deleted, f.name(aws.ToString(in.SecretId)))
+	return &secretsmanager.RestoreSecretOutput{}, nil
+}
+
+func (f *fakeSecretsManager) TagResource(ctx context.Context, in *secretsmanager.TagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.TagResourceOutput, error) {
+	name := f.name(aws.ToString(in.SecretId))
+	for _, tag := range in.Tags {
+		f.tags[name] = append(slices.DeleteFunc(f.tags[name], func(t smtypes.Tag) bool {
+			return aws.ToString(t.Key) == aws.ToString(tag.Key)
+		}), tag)
+	}
+	return &secretsmanager.TagResourceOutput{}, nil
+}
+
+func (f *fakeSecretsManager) UntagResource(ctx context.Context, in *secretsmanager.UntagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UntagResourceOutput, error) {
+	name := f.name(aws.ToString(in.SecretId))
+	f.tags[name] = slices.DeleteFunc(f.tags[name], func(t smtypes.Tag) bool {
+		return slices.Contains(in.TagKeys, aws.ToString(t.Key))
+	})
+	return &secretsmanager.UntagResourceOutput{}, nil
+}
+
+func TestSecretsManagerStore(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeSecretsManager{values: map[string]string{}, tags: map[string][]smtypes.Tag{}, versions: map[string]int{}, deleted: map[string]bool{}}
+	store := NewSecretsManagerStore(fake, &application.Config{})
+
+	entry := models.Entry{Key: "production/payments/certificate", Value: "-----BEGIN-----", Secure: true, Owner: "payments"}
+	if err := store.Upsert(ctx, []models.Entry{entry})[entry.Key]; err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	entry.Value = "-----BEGIN 2-----"
+	if err := store.Upsert(ctx, []models.Entry{entry})[entry.Key]; err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	reference, err := store.Reference(ctx, entry.Key)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := "arn:aws:secretsmanager:us-east-1:111111111111:secret:production/payments/certificate-AbCdEf::AWSCURRENT:"
+	if reference != expected {
+		t.Errorf(`Expected %s got: %s`, expected, reference)
+	}
+
+	value, err := store.Retrieve(ctx, reference)
+	if err != nil || value != "-----BEGIN 2-----" {
+		t.Errorf(`Expected the current value got: %s %v`, value, err)
+	}
+	version, err := store.Version(ctx, reference)
+	if err != nil || version != "v2" {
+		t.Errorf(`Expected the id of the current version got: %s %v`, version, err)
+	}
+	if value, err = store.Retrieve(ctx, reference[:strings.Index(reference, "::")]+":::"+version); err != nil || value != "-----BEGIN 2-----" {
+		t.Errorf(`Expected the value of the version id got: %s %v`, value, err)
+	}
+	tagKeys := func() []string {
+		keys := make([]string, 0)
+		for _, tag := range fake.tags[entry.Key] {
+			keys = append(keys, aws.ToString(tag.Key))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	if !slices.Equal(tagKeys(), []string{"owner", "project"}) {
+		t.Errorf(`Expected the owner and project tags got: %v`, tagKeys())
+	}
+
+	// a secret deleted and written again in its recovery window is restored, the cleared
+	// owner is untagged
+	if err = store.Delete(ctx, reference); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	entry.Value, entry.Owner = "-----BEGIN 3-----", ""
+	if err = store.Upsert(ctx, []models.Entry{entry})[entry.Key]; err != nil || fake.deleted[entry.Key] || fake.values[entry.Key] != entry.Value {
+		t.Errorf(`Expected the secret restored and written got: %v %v`, fake.values, err)
+	}
+	if !slices.Equal(tagKeys(), []string{"project"}) {
+		t.Errorf(`Expected the owner tag removed got: %v`, tagKeys())
+	}
+
+	metadata, err := store.Describe(ctx, "arn:aws:secretsmanager:us-east-1:111111111111:secret:missing-AbCdEf::AWSCURRENT:")
+	if err != nil || metadata != nil {
+		t.Errorf(`Expected a missing secret got: %v %v`, metadata, err)
+	}
+}
+
+func TestParseSecretReference(t *testing.T) {
+	secret := parseSecretReference("arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf:password:AWSPREVIOUS:")
+	expected := secretReference{id: "arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf", jsonKey: "password", versionStage: "AWSPREVIOUS"}
+	if secret != expected {
+		t.Errorf(`Expected %v got: %v`, expected, secret)
+	}
+
+	if secret = parseSecretReference("/production/app/token"); secret.id != "/production/app/token" {
+		t.Errorf(`Expected the name as id got: %v`, secret)
+	}
+}
+
+func TestSecretRouter_Route(t *testing.T) {
+	parameters := NewSecureParameterStore(nil, &application.Config{})
+	secrets := NewSecretsManagerStore(&fakeSecretsManager{}, &application.Config{})
+	router := &secretRouter{
+		parameters:     parameters,
+		secretsManager: secrets,
+		config:         &application.Config{SecretBackend: SecretBackendSsm, SecretsManagerPrefixes: []string{"production/payments/"}},
+	}
+
+	cases := map[string]interface{}{
+		"production/payments/certificate": secrets,
+		"/production/payments/token":      secrets,
+		"production/payments-api/token":   parameters,
+		"development/payments/token":      parameters,
+	}
+	for key, adapter := range cases {
+		if router.route(key) != adapter {
+			t.Errorf(`Expected %s routed to %T`, key, adapter)
+		}
+	}
+
+	if router.store("arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf::AWSCURRENT:") != secrets ||
+		router.store("arn:aws:ssm:us-east-1:111111111111:parameter/production/app") != parameters {
+		t.Errorf(`Expected references read from the store of their format`)
+	}
+
+	router.config.SecretBackend = SecretBackendSecretsManager
+	if router.route("development/payments/token") != secrets {
+		t.Errorf(`Expected every key in secrets manager with the global backend`)
+	}
+}
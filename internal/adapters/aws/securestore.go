@@ -2,12 +2,21 @@ package aws
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"nbox/internal/application"
 	"nbox/internal/domain"
 	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
@@ -15,6 +24,13 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
+const (
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+)
+
+var tagInvalidChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
 type Result models.Exchange[*ssm.PutParameterOutput, *models.Entry]
 
 type secureParameterStore struct {
@@ -26,6 +42,11 @@ func NewSecureParameterStore(client *ssm.Client, config *application.Config) dom
 	return &secureParameterStore{client: client, config: config}
 }
 
+// NewParameterSource parameter store hierarchies to import
+func NewParameterSource(client *ssm.Client, config *application.Config) domain.ParameterSource {
+	return &secureParameterStore{client: client, config: config}
+}
+
 func (s *secureParameterStore) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
 	ch := make(chan Result)
 	wg := sync.WaitGroup{}
@@ -55,8 +76,107 @@ func (s *secureParameterStore) Upsert(ctx context.Context, entries []models.Entr
 	return summary
 }
 
+// Reference name or ARN of the parameter of the key
+func (s *secureParameterStore) Reference(ctx context.Context, key string) (string, error) {
+	return usecases.ParameterReference(s.config, key), nil
+}
+
+// Retrieve decrypted value of the parameter, reference is the name or ARN stored in the entry
+func (s *secureParameterStore) Retrieve(ctx context.Context, reference string) (string, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(reference),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.Parameter.Value), nil
+}
+
+// Version current version of the parameter, reference is the name or ARN stored in the entry.
+// A version is read back with the reference:version selector.
+func (s *secureParameterStore) Version(ctx context.Context, reference string) (string, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(reference)})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(out.Parameter.Version, 10), nil
+}
+
+// Describe version, last modification and user of the parameter, nil when it doesn't exist
+func (s *secureParameterStore) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(reference)})
+
+	var notFound *types.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &models.SecretMetadata{
+		Name:           aws.ToString(out.Parameter.Name),
+		Version:        out.Parameter.Version,
+		LastModifiedAt: aws.ToTime(out.Parameter.LastModifiedDate),
+	}
+
+	// only the parameter description has the user
+	described, err := s.client.DescribeParameters(ctx, &ssm.DescribeParametersInput{
+		ParameterFilters: []types.ParameterStringFilter{
+			{Key: aws.String("Name"), Option: aws.String("Equals"), Values: []string{metadata.Name}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(described.Parameters) > 0 {
+		metadata.LastModifiedUser = aws.ToString(described.Parameters[0].LastModifiedUser)
+	}
+
+	return metadata, nil
+}
+
+// Parameters every parameter under the path, the values of SecureString parameters aren't decrypted
+func (s *secureParameterStore) Parameters(ctx context.Context, path string) ([]models.ExternalParameter, error) {
+	parameters := make([]models.ExternalParameter, 0)
+
+	paginator := ssm.NewGetParametersByPathPaginator(s.client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(false),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, parameter := range page.Parameters {
+			external := models.ExternalParameter{
+				Name:           aws.ToString(parameter.Name),
+				ARN:            aws.ToString(parameter.ARN),
+				Type:           string(parameter.Type),
+				Version:        parameter.Version,
+				LastModifiedAt: aws.ToTime(parameter.LastModifiedDate),
+			}
+			if parameter.Type != types.ParameterTypeSecureString {
+				external.Value = aws.ToString(parameter.Value)
+			}
+			parameters = append(parameters, external)
+		}
+	}
+
+	return parameters, nil
+}
+
+// Delete removes the parameter, reference is the name or ARN stored in the entry
+func (s *secureParameterStore) Delete(ctx context.Context, reference string) error {
+	_, err := s.client.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(reference)})
+	return err
+}
+
 func (s *secureParameterStore) Send(ctx context.Context, entry models.Entry) Result {
-	in := prepareSecret(entry, s.config.ParameterStoreDefaultTier, s.config.ParameterStoreKeyId)
+	in := prepareSecret(entry, s.config)
 	out, err := s.client.PutParameter(ctx, in)
 	result := Result{Out: out, In: &entry, Err: err}
 
@@ -64,25 +184,142 @@ func (s *secureParameterStore) Send(ctx context.Context, entry models.Entry) Res
 		return result
 	}
 
+	tags := secretTags(entry)
 	if out.Version == 1 {
-		s.AddTags(ctx, in.Name)
+		tags = append(tags, types.Tag{Key: aws.String("project"), Value: aws.String("nbox")})
+	} else {
+		s.removeStaleTags(ctx, in.Name, tags)
+	}
+	if len(tags) > 0 {
+		s.AddTags(ctx, in.Name, tags)
 	}
 
 	return result
 }
 
-func (s *secureParameterStore) AddTags(ctx context.Context, key *string) {
+// removeStaleTags removes the metadata tags of the parameter the entry no longer has
+func (s *secureParameterStore) removeStaleTags(ctx context.Context, key *string, tags []types.Tag) {
+	out, err := s.client.ListTagsForResource(ctx, &ssm.ListTagsForResourceInput{
+		ResourceId:   key,
+		ResourceType: types.ResourceTypeForTaggingParameter,
+	})
+	if err != nil {
+		log.Printf("Err list tags [parameter:%s]. %v \n", *key, err)
+		return
+	}
+
+	current := make([]string, 0, len(out.TagList))
+	for _, tag := range out.TagList {
+		current = append(current, aws.ToString(tag.Key))
+	}
+	wanted := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		wanted = append(wanted, aws.ToString(tag.Key))
+	}
+
+	stale := staleTagKeys(current, wanted)
+	if len(stale) == 0 {
+		return
+	}
+	_, err = s.client.RemoveTagsFromResource(ctx, &ssm.RemoveTagsFromResourceInput{
+		ResourceId:   key,
+		ResourceType: types.ResourceTypeForTaggingParameter,
+		TagKeys:      stale,
+	})
+	if err != nil {
+		log.Printf("Err remove tags [parameter:%s]. %v \n", *key, err)
+	}
+}
+
+func (s *secureParameterStore) AddTags(ctx context.Context, key *string, tags []types.Tag) {
 	_, err := s.client.AddTagsToResource(ctx, &ssm.AddTagsToResourceInput{
 		ResourceId:   key,
 		ResourceType: types.ResourceTypeForTaggingParameter,
-		Tags:         []types.Tag{{Key: aws.String("project"), Value: aws.String("nbox")}},
+		Tags:         tags,
 	})
 	if err != nil {
 		log.Printf("Err add tags [parameter:%s]. %v \n", *key, err)
 	}
 }
 
-func prepareSecret(entry models.Entry, parameterStoreDefaultTier string, parameterStoreKeyId string) *ssm.PutParameterInput {
+// secretTags entry description, owner, link, expiration and labels as parameter tags
+func secretTags(entry models.Entry) []types.Tag {
+	values := map[string]string{}
+	for k, v := range entry.Labels {
+		values[fmt.Sprintf("label:%s", k)] = v
+	}
+	expiresAt := ""
+	if entry.ExpiresAt != nil {
+		expiresAt = entry.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	for k, v := range map[string]string{"owner": entry.Owner, "description": entry.Description, "link": entry.Link, "expiresAt": expiresAt} {
+		if v != "" {
+			values[k] = v
+		}
+	}
+
+	tags := make([]types.Tag, 0, len(values))
+	for k, v := range values {
+		tags = append(tags, types.Tag{Key: aws.String(tagText(k, MaxTagKeyLength)), Value: aws.String(tagText(v, MaxTagValueLength))})
+	}
+	sort.Slice(tags, func(i, j int) bool { return *tags[i].Key < *tags[j].Key })
+
+	return tags
+}
+
+// staleTagKeys metadata tags of the current ones that aren't wanted, other tags as project
+// or the ones added outside nbox are kept
+func staleTagKeys(current []string, wanted []string) []string {
+	stale := make([]string, 0)
+	for _, key := range current {
+		metadata := key == "owner" || key == "description" || key == "link" || key == "expiresAt" || strings.HasPrefix(key, "label:")
+		if metadata && !slices.Contains(wanted, key) {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
+
+// tagText replaces the characters not allowed in tags and truncates the text
+func tagText(text string, size int) string {
+	text = tagInvalidChars.ReplaceAllString(text, "_")
+	if runes := []rune(text); len(runes) > size {
+		return string(runes[:size])
+	}
+	return text
+}
+
+// expirationPolicies SSM deletes the parameter at expiresAt and sends an
+// EventBridge notification the notice before
+func expirationPolicies(expiresAt time.Time, notice time.Duration) string {
+	policies := []map[string]interface{}{
+		{
+			"Type":       "Expiration",
+			"Version":    "1.0",
+			"Attributes": map[string]string{"Timestamp": expiresAt.UTC().Format(time.RFC3339)},
+		},
+	}
+
+	if hours := int(notice.Hours()); hours > 0 {
+		before, unit := strconv.Itoa(hours), "Hours"
+		if hours%24 == 0 {
+			before, unit = strconv.Itoa(hours/24), "Days"
+		}
+		policies = append(policies, map[string]interface{}{
+			"Type":       "ExpirationNotification",
+			"Version":    "1.0",
+			"Attributes": map[string]string{"Before": before, "Unit": unit},
+		})
+	}
+
+	out, _ := json.Marshal(policies)
+	return string(out)
+}
+
+// prepareSecret the expiration of the entry is copied as a tag, with
+// NBOX_PARAMETER_STORE_EXPIRATION_POLICIES it's also sent as parameter policies
+func prepareSecret(entry models.Entry, config *application.Config) *ssm.PutParameterInput {
+	parameterStoreDefaultTier, parameterStoreKeyId := config.ParameterStoreDefaultTier, config.ParameterStoreKeyId
 	key := entry.Key
 
 	if !strings.HasPrefix(key, "/") {
@@ -105,5 +342,11 @@ func prepareSecret(entry models.Entry, parameterStoreDefaultTier string, paramet
 		parameterInput.KeyId = aws.String(parameterStoreKeyId)
 	}
 
+	// parameter policies are only supported by the advanced tier
+	if entry.ExpiresAt != nil && config.ExpirationPolicies {
+		parameterInput.Tier = types.ParameterTierAdvanced
+		parameterInput.Policies = aws.String(expirationPolicies(*entry.ExpiresAt, config.ExpirationNotice))
+	}
+
 	return parameterInput
 }
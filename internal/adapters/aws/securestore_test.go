@@ -1,7 +1,14 @@
 package aws
 
 import (
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
 )
 
 func TestSecureParameterStore_Upsert(t *testing.T) {
@@ -15,3 +22,42 @@ func TestSecureParameterStore_Upsert(t *testing.T) {
 	//	},
 	//})
 }
+
+func TestPrepareSecret_Expiration(t *testing.T) {
+	expiresAt := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)
+	entry := models.Entry{Key: "production/api/trial_key", Value: "x", Secure: true, ExpiresAt: &expiresAt}
+	config := &application.Config{ParameterStoreDefaultTier: "Standard", ExpirationNotice: 14 * 24 * time.Hour}
+
+	// without the policies the parameter isn't deleted by SSM, nbox reports it as expired
+	in := prepareSecret(entry, config)
+	if in.Tier != types.ParameterTierStandard || in.Policies != nil {
+		t.Errorf(`Expected a standard parameter without policies got: %s %s`, in.Tier, aws.ToString(in.Policies))
+	}
+
+	tags := secretTags(entry)
+	if len(tags) != 1 || aws.ToString(tags[0].Key) != "expiresAt" || aws.ToString(tags[0].Value) != "2026-12-01T00:00:00Z" {
+		t.Errorf(`Expected the expiration tag got: %v`, tags)
+	}
+
+	config.ExpirationPolicies = true
+	in = prepareSecret(entry, config)
+	expected := `[{"Attributes":{"Timestamp":"2026-12-01T00:00:00Z"},"Type":"Expiration","Version":"1.0"},` +
+		`{"Attributes":{"Before":"14","Unit":"Days"},"Type":"ExpirationNotification","Version":"1.0"}]`
+	if in.Tier != types.ParameterTierAdvanced || aws.ToString(in.Policies) != expected {
+		t.Errorf(`Expected an advanced parameter with the expiration policies got: %s %s`, in.Tier, aws.ToString(in.Policies))
+	}
+
+	if in = prepareSecret(models.Entry{Key: "production/api/key", Value: "x", Secure: true}, config); in.Policies != nil {
+		t.Errorf(`Expected no policies without expiresAt got: %s`, aws.ToString(in.Policies))
+	}
+}
+
+func TestStaleTagKeys(t *testing.T) {
+	current := []string{"project", "owner", "description", "label:team", "label:lifecycle", "cost-center"}
+	stale := staleTagKeys(current, []string{"owner", "label:team"})
+
+	expected := []string{"description", "label:lifecycle"}
+	if !reflect.DeepEqual(stale, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, stale)
+	}
+}
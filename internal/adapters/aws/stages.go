@@ -0,0 +1,641 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// stageBackend adapters of the entries, templates, secrets, indexes and snapshots of a stage
+type stageBackend struct {
+	entries    domain.EntryAdapter
+	templates  domain.TemplateAdapter
+	secrets    domain.SecretAdapter
+	parameters domain.ParameterSource
+	usages     domain.UsageAdapter
+	search     domain.SearchAdapter
+	snapshots  domain.SnapshotAdapter
+}
+
+// Stages backends of the stages of NBOX_STAGE_CONFIG_FILE, with their own credentials,
+// region, KMS keys, tables and bucket. The other stages use the backend of the service.
+type Stages struct {
+	fallback *stageBackend
+	stages   map[string]*stageBackend
+	backends []*stageBackend // backends the service one first, then the stages by name
+	config   *application.Config
+}
+
+func NewStages(
+	cfg *aws.Config,
+	s3Client *s3.Client,
+	dynamodbClient *dynamodb.Client,
+	ssmClient *ssm.Client,
+	secretsManagerClient *secretsmanager.Client,
+	config *application.Config,
+	pathUseCase *usecases.PathUseCase,
+) (*Stages, error) {
+	configs, err := application.LoadStageConfigs(config.StageConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback := &stageBackend{
+		entries:    NewDynamodbBackend(dynamodbClient, config, pathUseCase),
+		templates:  NewS3TemplateStore(s3Client, config, dynamodbClient),
+		secrets:    NewSecretRouter(ssmClient, secretsManagerClient, config),
+		parameters: NewParameterSource(ssmClient, config),
+		usages:     NewDynamodbUsageIndex(dynamodbClient, config),
+		search:     NewDynamodbSearchIndex(dynamodbClient, config),
+		snapshots:  NewS3SnapshotStore(s3Client, config),
+	}
+	stages := &Stages{fallback: fallback, stages: map[string]*stageBackend{}, backends: []*stageBackend{fallback}, config: config}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !allowedStage(config, name) {
+			return nil, fmt.Errorf("%s: stage %s isn't an allowed prefix", config.StageConfigFile, name)
+		}
+
+		stageCfg := NewStageAwsConfig(cfg, configs[name])
+		stageConfig := config.ForStage(configs[name])
+		stageDynamodb := NewDynamodbClient(stageCfg)
+		stageS3 := NewS3Client(stageCfg)
+		stageSsm := NewSsmClient(stageCfg)
+
+		backend := &stageBackend{
+			entries:    NewDynamodbBackend(stageDynamodb, stageConfig, pathUseCase),
+			templates:  NewS3TemplateStore(stageS3, stageConfig, stageDynamodb),
+			secrets:    NewSecretRouter(stageSsm, NewSecretsManagerClient(stageCfg), stageConfig),
+			parameters: NewParameterSource(stageSsm, stageConfig),
+			usages:     NewDynamodbUsageIndex(stageDynamodb, stageConfig),
+			search:     NewDynamodbSearchIndex(stageDynamodb, stageConfig),
+			snapshots:  NewS3SnapshotStore(stageS3, stageConfig),
+		}
+		stages.stages[name] = backend
+		stages.backends = append(stages.backends, backend)
+	}
+
+	return stages, nil
+}
+
+// route backend of the stage
+func (s *Stages) route(stage string) *stageBackend {
+	if backend, ok := s.stages[stage]; ok {
+		return backend
+	}
+	return s.fallback
+}
+
+// keyStage stage of the key as the backend stores it, e.g. Production/app/url is stored
+// as production/app/url and api/timeout under the default prefix as global/api/timeout
+func (s *Stages) keyStage(key string) string {
+	if strings.HasPrefix(key, "box:") {
+		return trackingStage(key)
+	}
+	if strings.Trim(strings.TrimSpace(key), "/") == "" {
+		return ""
+	}
+	return stageOf(s.config.StoredKey(key))
+}
+
+// prefixStage stage of a listing prefix, prefixes aren't moved under the default prefix
+// because they may name part of a stage or nothing at all
+func prefixStage(prefix string) string {
+	return stageOf(strings.ToLower(strings.TrimSpace(prefix)))
+}
+
+// owns the stage is stored in the backend, listings of every backend only keep what each one owns
+func (s *Stages) owns(backend *stageBackend, stage string) bool {
+	return s.route(stage) == backend
+}
+
+// page visits the backends one after the other with a "<backend>.<cursor>" cursor, the
+// cursor of the service backend is used as it is when there are no stages
+func (s *Stages) page(cursor string, list func(backend *stageBackend, cursor string) (string, error)) (string, error) {
+	if len(s.backends) == 1 {
+		return list(s.fallback, cursor)
+	}
+
+	index := 0
+	if cursor != "" {
+		position, inner, _ := strings.Cut(cursor, ".")
+		value, err := strconv.Atoi(position)
+		if err != nil || value < 0 || value >= len(s.backends) {
+			return "", fmt.Errorf("%w: unknown stage backend", domain.ErrInvalidCursor)
+		}
+		index, cursor = value, inner
+	}
+
+	next, err := list(s.backends[index], cursor)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case next != "":
+		return fmt.Sprintf("%d.%s", index, next), nil
+	case index+1 < len(s.backends):
+		return fmt.Sprintf("%d.", index+1), nil
+	default:
+		return "", nil
+	}
+}
+
+// backfill adapters whose records predate the attributes of their indexes
+type backfill interface {
+	Backfill(ctx context.Context) (int, error)
+}
+
+// Backfill writes the attributes of the listing indexes on the records of every backend
+// stored before them, returns the count of records updated
+func (s *Stages) Backfill(ctx context.Context) (int, error) {
+	updated := 0
+	for _, backend := range s.backends {
+		for _, adapter := range []interface{}{backend.templates, backend.entries} {
+			if b, ok := adapter.(backfill); ok {
+				count, err := b.Backfill(ctx)
+				updated += count
+				if err != nil {
+					return updated, err
+				}
+			}
+		}
+	}
+	return updated, nil
+}
+
+func allowedStage(config *application.Config, stage string) bool {
+	for _, prefix := range config.AllowedPrefixes {
+		if strings.Trim(prefix, "/") == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// trackingStage stage of a tracking key, box histories are keyed box:<service>/<stage>/<template>
+func trackingStage(key string) string {
+	if path, ok := strings.CutPrefix(key, "box:"); ok {
+		_, path, _ = strings.Cut(path, "/")
+		return stageOf(path)
+	}
+	return stageOf(key)
+}
+
+// secretSuffix random suffix Secrets Manager appends to the name in the secret ARN
+var secretSuffix = regexp.MustCompile(`-[A-Za-z0-9]{6}$`)
+
+// referenceKey key of a parameter or secret name or ARN reference. The secret ARN ends
+// with the random suffix of the name and may carry the json key and version selectors,
+// e.g. secret:production/app/token-AbCdEf::AWSCURRENT:
+func referenceKey(reference string) string {
+	if strings.HasPrefix(reference, "arn:") {
+		if _, name, ok := strings.Cut(reference, ":parameter"); ok {
+			return name
+		}
+		if _, name, ok := strings.Cut(reference, ":secret:"); ok {
+			name, _, _ = strings.Cut(name, ":")
+			return secretSuffix.ReplaceAllString(name, "")
+		}
+	}
+	return reference
+}
+
+// stageEntryRouter entries of each stage in the tables of its backend
+type stageEntryRouter struct {
+	stages *Stages
+}
+
+func NewStageEntryRouter(stages *Stages) domain.EntryAdapter {
+	return &stageEntryRouter{stages: stages}
+}
+
+func (r *stageEntryRouter) adapter(key string) domain.EntryAdapter {
+	return r.stages.route(r.stages.keyStage(key)).entries
+}
+
+func (r *stageEntryRouter) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	routed := map[domain.EntryAdapter][]models.Entry{}
+	for _, entry := range entries {
+		adapter := r.adapter(entry.Key)
+		routed[adapter] = append(routed[adapter], entry)
+	}
+
+	summary := make(map[string]error)
+	for adapter, group := range routed {
+		for key, err := range adapter.Upsert(ctx, group) {
+			summary[key] = err
+		}
+	}
+	return summary
+}
+
+func (r *stageEntryRouter) Retrieve(ctx context.Context, key string) (*models.Entry, error) {
+	return r.adapter(key).Retrieve(ctx, key)
+}
+
+func (r *stageEntryRouter) List(ctx context.Context, prefix string) ([]models.Entry, error) {
+	return r.stages.route(prefixStage(prefix)).entries.List(ctx, prefix)
+}
+
+func (r *stageEntryRouter) Delete(ctx context.Context, key string) error {
+	return r.adapter(key).Delete(ctx, key)
+}
+
+func (r *stageEntryRouter) Purge(ctx context.Context, key string) error {
+	return r.adapter(key).Purge(ctx, key)
+}
+
+// Trash of the stage of the prefix, without prefix the trash of every backend
+func (r *stageEntryRouter) Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error) {
+	if stage := prefixStage(prefix); stage != "" {
+		return r.stages.route(stage).entries.Trash(ctx, prefix)
+	}
+
+	entries := make([]models.TrashEntry, 0)
+	for _, backend := range r.stages.backends {
+		trash, err := backend.entries.Trash(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range trash {
+			if r.stages.owns(backend, stageOf(entry.Path+"/"+entry.Key)) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (r *stageEntryRouter) Restore(ctx context.Context, key string) ([]string, error) {
+	return r.adapter(key).Restore(ctx, key)
+}
+
+func (r *stageEntryRouter) Tracking(ctx context.Context, key string) ([]models.Tracking, error) {
+	return r.adapter(key).Tracking(ctx, key)
+}
+
+// Activity of the stage of the prefix, without prefix the backends are paged one after
+// the other, newest first within each backend
+func (r *stageEntryRouter) Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error) {
+	if stage := prefixStage(filter.Prefix); stage != "" {
+		return r.stages.route(stage).entries.Activity(ctx, filter)
+	}
+
+	page := &models.TrackingPage{Tracking: make([]models.Tracking, 0)}
+	cursor, err := r.stages.page(filter.Cursor, func(backend *stageBackend, cursor string) (string, error) {
+		backendFilter := filter
+		backendFilter.Cursor = cursor
+		backendPage, err := backend.entries.Activity(ctx, backendFilter)
+		if err != nil {
+			return "", err
+		}
+		for _, t := range backendPage.Tracking {
+			if r.stages.owns(backend, trackingStage(t.Key)) {
+				page.Tracking = append(page.Tracking, t)
+			}
+		}
+		return backendPage.Cursor, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.Cursor = cursor
+
+	return page, nil
+}
+
+func (r *stageEntryRouter) ImportTracking(ctx context.Context, tracking []models.Tracking) error {
+	routed := map[domain.EntryAdapter][]models.Tracking{}
+	for _, t := range tracking {
+		adapter := r.adapter(t.Key)
+		routed[adapter] = append(routed[adapter], t)
+	}
+
+	for adapter, group := range routed {
+		if err := adapter.ImportTracking(ctx, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveTracking within a backend moves the history there, between backends the history is
+// copied to the new backend and the move recorded in the old one, like the backend does
+func (r *stageEntryRouter) MoveTracking(ctx context.Context, from string, to string) error {
+	source, target := r.adapter(from), r.adapter(to)
+	if source == target {
+		return source.MoveTracking(ctx, from, to)
+	}
+
+	history, err := source.Tracking(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	copied := make([]models.Tracking, 0, len(history))
+	for _, t := range history {
+		if t.MovedFrom == "" {
+			t.MovedFrom = from
+		}
+		t.Key = to
+		copied = append(copied, t)
+	}
+	if len(copied) > 0 {
+		if err = target.ImportTracking(ctx, copied); err != nil {
+			return err
+		}
+	}
+
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	return source.ImportTracking(ctx, []models.Tracking{
+		{Key: from, UpdatedAt: time.Now().UTC(), UpdatedBy: updatedBy, Action: "move", MovedTo: to},
+	})
+}
+
+// stageTemplateRouter templates of each stage in the bucket and table of its backend,
+// partials are shared by every stage and stay in the service backend
+type stageTemplateRouter struct {
+	stages *Stages
+}
+
+func NewStageTemplateRouter(stages *Stages) domain.TemplateAdapter {
+	return &stageTemplateRouter{stages: stages}
+}
+
+func (r *stageTemplateRouter) adapter(stage string) domain.TemplateAdapter {
+	return r.stages.route(stage).templates
+}
+
+// UpsertBox writes the stages of the box in their backends
+func (r *stageTemplateRouter) UpsertBox(ctx context.Context, box *models.Box) []string {
+	routed := map[domain.TemplateAdapter]map[string]models.Stage{}
+	for name, stage := range box.Stage {
+		adapter := r.adapter(name)
+		if routed[adapter] == nil {
+			routed[adapter] = map[string]models.Stage{}
+		}
+		routed[adapter][name] = stage
+	}
+
+	result := make([]string, 0)
+	for adapter, stages := range routed {
+		result = append(result, adapter.UpsertBox(ctx, &models.Box{Service: box.Service, Stage: stages, Resolution: box.Resolution})...)
+	}
+	return result
+}
+
+func (r *stageTemplateRouter) BoxExists(ctx context.Context, service string, stage string, template string) (bool, error) {
+	return r.adapter(stage).BoxExists(ctx, service, stage, template)
+}
+
+func (r *stageTemplateRouter) RetrieveBox(ctx context.Context, service string, stage string, template string) ([]byte, error) {
+	return r.adapter(stage).RetrieveBox(ctx, service, stage, template)
+}
+
+func (r *stageTemplateRouter) RetrieveStage(ctx context.Context, service string, stage string) (*models.Stage, error) {
+	return r.adapter(stage).RetrieveStage(ctx, service, stage)
+}
+
+// DeleteBox in the backend of the stage, without stage in every backend
+func (r *stageTemplateRouter) DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	if stage != "" {
+		return r.adapter(stage).DeleteBox(ctx, service, stage, template)
+	}
+
+	result := make([]string, 0)
+	for _, backend := range r.stages.backends {
+		deleted, err := backend.templates.DeleteBox(ctx, service, stage, template)
+		result = append(result, deleted...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// RestoreBox in the backend of the stage, without stage in every backend
+func (r *stageTemplateRouter) RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	if stage != "" {
+		return r.adapter(stage).RestoreBox(ctx, service, stage, template)
+	}
+
+	result := make([]string, 0)
+	for _, backend := range r.stages.backends {
+		restored, err := backend.templates.RestoreBox(ctx, service, stage, template)
+		result = append(result, restored...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// List templates of the stage, without stage the backends are paged one after the other
+func (r *stageTemplateRouter) List(ctx context.Context, filter models.BoxFilter) (*models.BoxPage, error) {
+	if filter.Stage != "" {
+		return r.adapter(filter.Stage).List(ctx, filter)
+	}
+
+	page := &models.BoxPage{Boxes: make([]models.BoxSummary, 0)}
+	cursor, err := r.stages.page(filter.Cursor, func(backend *stageBackend, cursor string) (string, error) {
+		backendFilter := filter
+		backendFilter.Cursor = cursor
+		backendPage, err := backend.templates.List(ctx, backendFilter)
+		if err != nil {
+			return "", err
+		}
+		for _, box := range backendPage.Boxes {
+			if r.stages.owns(backend, box.Stage) {
+				page.Boxes = append(page.Boxes, box)
+			}
+		}
+		return backendPage.Cursor, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.Cursor = cursor
+
+	return page, nil
+}
+
+func (r *stageTemplateRouter) UpsertPartial(ctx context.Context, name string, value []byte) error {
+	return r.stages.fallback.templates.UpsertPartial(ctx, name, value)
+}
+
+func (r *stageTemplateRouter) RetrievePartial(ctx context.Context, name string) ([]byte, error) {
+	return r.stages.fallback.templates.RetrievePartial(ctx, name)
+}
+
+// stageSecretRouter secrets of each stage in the account, region and KMS key of its
+// backend, references are routed by the key in their name
+type stageSecretRouter struct {
+	stages *Stages
+}
+
+func NewStageSecretRouter(stages *Stages) domain.SecretAdapter {
+	return &stageSecretRouter{stages: stages}
+}
+
+func (r *stageSecretRouter) adapter(reference string) domain.SecretAdapter {
+	return r.stages.route(r.stages.keyStage(referenceKey(reference))).secrets
+}
+
+func (r *stageSecretRouter) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	routed := map[domain.SecretAdapter][]models.Entry{}
+	for _, entry := range entries {
+		adapter := r.adapter(entry.Key)
+		routed[adapter] = append(routed[adapter], entry)
+	}
+
+	summary := make(map[string]error)
+	for adapter, group := range routed {
+		for key, err := range adapter.Upsert(ctx, group) {
+			summary[key] = err
+		}
+	}
+	return summary
+}
+
+func (r *stageSecretRouter) Reference(ctx context.Context, key string) (string, error) {
+	return r.adapter(key).Reference(ctx, key)
+}
+
+func (r *stageSecretRouter) Retrieve(ctx context.Context, reference string) (string, error) {
+	return r.adapter(reference).Retrieve(ctx, reference)
+}
+
+func (r *stageSecretRouter) Version(ctx context.Context, reference string) (string, error) {
+	return r.adapter(reference).Version(ctx, reference)
+}
+
+func (r *stageSecretRouter) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	return r.adapter(reference).Describe(ctx, reference)
+}
+
+func (r *stageSecretRouter) Delete(ctx context.Context, reference string) error {
+	return r.adapter(reference).Delete(ctx, reference)
+}
+
+// stageParameterSource parameters of the path in the account and region of its stage
+type stageParameterSource struct {
+	stages *Stages
+}
+
+func NewStageParameterSource(stages *Stages) domain.ParameterSource {
+	return &stageParameterSource{stages: stages}
+}
+
+func (p *stageParameterSource) Parameters(ctx context.Context, path string) ([]models.ExternalParameter, error) {
+	return p.stages.route(stageOf(path)).parameters.Parameters(ctx, path)
+}
+
+// stageUsageRouter where-used index of each key in the backend of the stage of the key, a
+// box may read keys of several stages, e.g. production/ and global/
+type stageUsageRouter struct {
+	stages *Stages
+}
+
+func NewStageUsageRouter(stages *Stages) domain.UsageAdapter {
+	return &stageUsageRouter{stages: stages}
+}
+
+// Replace replaces the keys of the box in every backend, the backends without keys of the
+// box drop the ones it no longer reads
+func (r *stageUsageRouter) Replace(ctx context.Context, box string, keys []string) error {
+	routed := map[*stageBackend][]string{}
+	for _, key := range keys {
+		backend := r.stages.route(r.stages.keyStage(key))
+		routed[backend] = append(routed[backend], key)
+	}
+
+	var err error
+	for _, backend := range r.stages.backends {
+		if e := backend.usages.Replace(ctx, box, routed[backend]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *stageUsageRouter) Usages(ctx context.Context, key string) ([]string, error) {
+	return r.stages.route(r.stages.keyStage(key)).usages.Usages(ctx, key)
+}
+
+// stageSearchRouter search index of each key in the backend of its stage
+type stageSearchRouter struct {
+	stages *Stages
+}
+
+func NewStageSearchRouter(stages *Stages) domain.SearchAdapter {
+	return &stageSearchRouter{stages: stages}
+}
+
+func (r *stageSearchRouter) Replace(ctx context.Context, key string, terms []string) error {
+	return r.stages.route(r.stages.keyStage(key)).search.Replace(ctx, key, terms)
+}
+
+// Search keys of the backend of the stage of the prefix, of every backend when the prefix
+// doesn't name a whole stage, e.g. "prod" may match production/ and prod-eu/
+func (r *stageSearchRouter) Search(ctx context.Context, term string, prefix string) ([]string, error) {
+	if strings.Contains(strings.Trim(prefix, "/"), "/") {
+		return r.stages.route(stageOf(prefix)).search.Search(ctx, term, prefix)
+	}
+
+	keys := make([]string, 0)
+	for _, backend := range r.stages.backends {
+		found, err := backend.search.Search(ctx, term, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range found {
+			if r.stages.owns(backend, stageOf(key)) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// stageSnapshotRouter snapshots of each stage in the bucket of its backend
+type stageSnapshotRouter struct {
+	stages *Stages
+}
+
+func NewStageSnapshotRouter(stages *Stages) domain.SnapshotAdapter {
+	return &stageSnapshotRouter{stages: stages}
+}
+
+func (r *stageSnapshotRouter) Save(ctx context.Context, snapshot *models.Snapshot) error {
+	return r.stages.route(snapshot.Stage).snapshots.Save(ctx, snapshot)
+}
+
+func (r *stageSnapshotRouter) Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	return r.stages.route(stage).snapshots.Retrieve(ctx, stage, name)
+}
+
+func (r *stageSnapshotRouter) List(ctx context.Context, stage string) ([]models.SnapshotSummary, error) {
+	return r.stages.route(stage).snapshots.List(ctx, stage)
+}
@@ -0,0 +1,255 @@
+package aws
+
+import (
+	"context"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"testing"
+)
+
+// fakeEntries activity pages and tracking of a backend, the other operations aren't used
+type fakeEntries struct {
+	domain.EntryAdapter
+	pages    map[string]models.TrackingPage
+	tracking []models.Tracking
+	upserted []string
+	config   *application.Config // config sanitizes the upserted keys like the backend
+}
+
+func (f *fakeEntries) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	summary := map[string]error{}
+	for _, entry := range entries {
+		f.upserted = append(f.upserted, f.config.StoredKey(entry.Key))
+		summary[entry.Key] = nil
+	}
+	return summary
+}
+
+func (f *fakeEntries) Retrieve(ctx context.Context, key string) (*models.Entry, error) {
+	for _, upserted := range f.upserted {
+		if upserted == key {
+			return &models.Entry{Key: key}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeEntries) Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error) {
+	page := f.pages[filter.Cursor]
+	return &page, nil
+}
+
+func (f *fakeEntries) Tracking(ctx context.Context, key string) ([]models.Tracking, error) {
+	history := make([]models.Tracking, 0)
+	for _, t := range f.tracking {
+		if t.Key == key {
+			history = append(history, t)
+		}
+	}
+	return history, nil
+}
+
+func (f *fakeEntries) ImportTracking(ctx context.Context, tracking []models.Tracking) error {
+	f.tracking = append(f.tracking, tracking...)
+	return nil
+}
+
+func newFakeStages() (*Stages, *fakeEntries, *fakeEntries) {
+	service, production := &fakeEntries{}, &fakeEntries{}
+	fallback := &stageBackend{entries: service}
+	stage := &stageBackend{entries: production}
+	return &Stages{
+		fallback: fallback,
+		stages:   map[string]*stageBackend{"production": stage},
+		backends: []*stageBackend{fallback, stage},
+		config: &application.Config{
+			DefaultPrefix:   "global",
+			AllowedPrefixes: []string{"global/", "development/", "staging/", "production/"},
+		},
+	}, service, production
+}
+
+func TestReferenceKey(t *testing.T) {
+	cases := map[string]string{
+		"production/app/token":  "production/app/token",
+		"/production/app/token": "/production/app/token",
+		"arn:aws:ssm:eu-west-1:222222222222:parameter/production/app/token":                             "/production/app/token",
+		"arn:aws:secretsmanager:eu-west-1:222222222222:secret:production/app/token-AbCdEf::AWSCURRENT:": "production/app/token",
+		"arn:aws:secretsmanager:eu-west-1:222222222222:secret:production-AbCdEf":                        "production",
+		"arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf::AWSCURRENT:":                  "app",
+	}
+	for reference, key := range cases {
+		if referenceKey(reference) != key {
+			t.Errorf(`Expected %s for %s got: %s`, key, reference, referenceKey(reference))
+		}
+	}
+
+	if trackingStage("box:payments/production/task.json") != "production" || trackingStage("development/app/url") != "development" {
+		t.Errorf(`Expected the stage of box and entry histories`)
+	}
+}
+
+func TestStageEntryRouter_Activity(t *testing.T) {
+	stages, service, production := newFakeStages()
+	service.pages = map[string]models.TrackingPage{
+		"":   {Tracking: []models.Tracking{{Key: "development/app/url"}, {Key: "production/app/url"}}, Cursor: "c1"},
+		"c1": {Tracking: []models.Tracking{{Key: "box:payments/development/task.json"}}},
+	}
+	production.pages = map[string]models.TrackingPage{
+		"": {Tracking: []models.Tracking{{Key: "production/app/token"}}},
+	}
+	router := NewStageEntryRouter(stages)
+
+	keys := make([]string, 0)
+	filter := models.TrackingFilter{}
+	cursors := make([]string, 0)
+	for {
+		page, err := router.Activity(context.Background(), filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tracking := range page.Tracking {
+			keys = append(keys, tracking.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursors = append(cursors, page.Cursor)
+		filter.Cursor = page.Cursor
+	}
+
+	expected := []string{"development/app/url", "box:payments/development/task.json", "production/app/token"}
+	if len(keys) != len(expected) {
+		t.Fatalf(`Expected %v got: %v`, expected, keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Errorf(`Expected %v got: %v`, expected, keys)
+		}
+	}
+	if len(cursors) != 2 || cursors[0] != "0.c1" || cursors[1] != "1." {
+		t.Errorf(`Expected a cursor per backend page got: %v`, cursors)
+	}
+
+	if _, err := router.Activity(context.Background(), models.TrackingFilter{Cursor: "7.c1"}); err == nil {
+		t.Errorf(`Expected an invalid cursor error`)
+	}
+}
+
+func TestStageEntryRouter_MoveTracking(t *testing.T) {
+	stages, service, production := newFakeStages()
+	service.tracking = []models.Tracking{{Key: "staging/app/token", Value: "v1", Action: "upsert"}}
+	router := NewStageEntryRouter(stages)
+
+	if err := router.MoveTracking(context.Background(), "staging/app/token", "production/app/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(production.tracking) != 1 || production.tracking[0].Key != "production/app/token" || production.tracking[0].MovedFrom != "staging/app/token" {
+		t.Errorf(`Expected the history copied to the stage backend got: %v`, production.tracking)
+	}
+	last := service.tracking[len(service.tracking)-1]
+	if last.Action != "move" || last.MovedTo != "production/app/token" {
+		t.Errorf(`Expected the move recorded in the service backend got: %v`, last)
+	}
+}
+
+// fakeUsages keys replaced by box
+type fakeUsages struct {
+	boxes map[string][]string
+}
+
+func (f *fakeUsages) Replace(ctx context.Context, box string, keys []string) error {
+	f.boxes[box] = keys
+	return nil
+}
+
+func (f *fakeUsages) Usages(ctx context.Context, key string) ([]string, error) {
+	return nil, nil
+}
+
+func TestStageUsageRouter_Replace(t *testing.T) {
+	stages, _, _ := newFakeStages()
+	service, production := &fakeUsages{boxes: map[string][]string{}}, &fakeUsages{boxes: map[string][]string{}}
+	stages.fallback.usages = service
+	stages.stages["production"].usages = production
+	router := NewStageUsageRouter(stages)
+
+	box := "payments/production/task.json"
+	if err := router.Replace(context.Background(), box, []string{"production/payments/db_url", "global/payments/region"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(production.boxes[box]) != 1 || production.boxes[box][0] != "production/payments/db_url" {
+		t.Errorf(`Expected the production key in the stage backend got: %v`, production.boxes)
+	}
+	if len(service.boxes[box]) != 1 || service.boxes[box][0] != "global/payments/region" {
+		t.Errorf(`Expected the global key in the service backend got: %v`, service.boxes)
+	}
+
+	// a box that no longer reads keys of a backend is replaced there too
+	if err := router.Replace(context.Background(), box, []string{"global/payments/region"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(production.boxes[box]) != 0 {
+		t.Errorf(`Expected the production keys dropped got: %v`, production.boxes[box])
+	}
+}
+
+func TestStageEntryRouter_StoredKey(t *testing.T) {
+	stages, service, production := newFakeStages()
+	global := &fakeEntries{config: stages.config}
+	production.config, service.config = stages.config, stages.config
+	stages.stages["global"] = &stageBackend{entries: global}
+	stages.backends = append(stages.backends, stages.stages["global"])
+	router := NewStageEntryRouter(stages)
+
+	router.Upsert(context.Background(), []models.Entry{{Key: "Production/app/url"}, {Key: "api/timeout"}})
+
+	if len(production.upserted) != 1 || production.upserted[0] != "production/app/url" {
+		t.Errorf(`Expected the mixed case key in the production backend got: %v`, production.upserted)
+	}
+	if len(global.upserted) != 1 || global.upserted[0] != "global/api/timeout" {
+		t.Errorf(`Expected the unprefixed key in the default prefix backend got: %v`, global.upserted)
+	}
+	if len(service.upserted) != 0 {
+		t.Errorf(`Expected nothing in the service backend got: %v`, service.upserted)
+	}
+
+	// reads of the stored keys go to the backend they were written to
+	for _, key := range []string{"production/app/url", "global/api/timeout"} {
+		if entry, _ := router.Retrieve(context.Background(), key); entry == nil {
+			t.Errorf(`Expected %s read from the backend it was written to`, key)
+		}
+	}
+}
+
+// fakeSecrets keys of the written secrets
+type fakeSecrets struct {
+	domain.SecretAdapter
+	upserted []string
+}
+
+func (f *fakeSecrets) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	for _, entry := range entries {
+		f.upserted = append(f.upserted, entry.Key)
+	}
+	return map[string]error{}
+}
+
+func TestStageSecretRouter_StoredKey(t *testing.T) {
+	stages, _, _ := newFakeStages()
+	service, production := &fakeSecrets{}, &fakeSecrets{}
+	stages.fallback.secrets = service
+	stages.stages["production"].secrets = production
+	router := NewStageSecretRouter(stages)
+
+	router.Upsert(context.Background(), []models.Entry{{Key: "Production/app/token"}, {Key: "app/token"}})
+	if len(production.upserted) != 1 || len(service.upserted) != 1 || service.upserted[0] != "app/token" {
+		t.Errorf(`Expected the mixed case key in the production backend got: %v %v`, production.upserted, service.upserted)
+	}
+
+	if r := router.(*stageSecretRouter); r.adapter("/Production/app/token") != production || r.adapter("/app/token") != service {
+		t.Errorf(`Expected the references routed to the backend of their stored key`)
+	}
+}
@@ -0,0 +1,135 @@
+package aws
+
+import (
+	"context"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// UsageBoxIndexName GSI of the usage table by Box
+const UsageBoxIndexName = "Box-index"
+
+type UsageRecord struct {
+	Key       string    `dynamodbav:"Key"`
+	Box       string    `dynamodbav:"Box"`
+	UpdatedAt time.Time `dynamodbav:"UpdatedAt,unixtime"`
+}
+
+// dynamodbUsageIndex stores one item per (variable, box) pair.
+// Key is the hash key, Box the range key and the Box-index GSI
+// allows replacing all the variables of a box on upsert.
+type dynamodbUsageIndex struct {
+	client     *dynamodb.Client
+	config     *application.Config
+	permitPool *PermitPool
+}
+
+func NewDynamodbUsageIndex(dynamodb *dynamodb.Client, config *application.Config) domain.UsageAdapter {
+	return &dynamodbUsageIndex{
+		client:     dynamodb,
+		config:     config,
+		permitPool: NewPermitPool(0),
+	}
+}
+
+// Replace sets the variables referenced by a box, removing the ones no longer used
+func (u *dynamodbUsageIndex) Replace(ctx context.Context, box string, keys []string) error {
+	current, err := u.query(ctx, UsageBoxIndexName, "Box", box)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, k := range keys {
+		wanted[strings.Trim(strings.TrimSpace(k), "/")] = true
+	}
+
+	var requests []types.WriteRequest
+	for _, record := range current {
+		if wanted[record.Key] {
+			continue
+		}
+		k, _ := attributevalue.Marshal(record.Key)
+		b, _ := attributevalue.Marshal(record.Box)
+		requests = append(requests, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{"Key": k, "Box": b}},
+		})
+	}
+
+	now := time.Now().UTC()
+	records := map[string]UsageRecord{}
+	for k := range wanted {
+		if k == "" {
+			continue
+		}
+		records[k] = UsageRecord{Key: k, Box: box, UpdatedAt: now}
+	}
+	requests = append(requests, prepareWriteRequest(records)...)
+
+	result := writeReqsBatch(ctx, u.client, u.permitPool, u.config.UsageTableName, requests)
+	return result.Err
+}
+
+// Usages boxes whose templates reference the key
+func (u *dynamodbUsageIndex) Usages(ctx context.Context, key string) ([]string, error) {
+	records, err := u.query(ctx, "", "Key", strings.Trim(strings.TrimSpace(key), "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	boxes := make([]string, 0, len(records))
+	for _, record := range records {
+		boxes = append(boxes, record.Box)
+	}
+	sort.Strings(boxes)
+
+	return boxes, nil
+}
+
+func (u *dynamodbUsageIndex) query(ctx context.Context, indexName string, attribute string, value string) ([]UsageRecord, error) {
+	keyEx := expression.Key(attribute).Equal(expression.Value(value))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Err expression Builder %v \n", err)
+		return nil, err
+	}
+
+	queryInput := &dynamodb.QueryInput{
+		TableName:                 aws.String(u.config.UsageTableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	}
+	if indexName != "" {
+		queryInput.IndexName = aws.String(indexName)
+	}
+
+	records := make([]UsageRecord, 0)
+	queryPaginator := dynamodb.NewQueryPaginator(u.client, queryInput)
+	for queryPaginator.HasMorePages() {
+		response, err := queryPaginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Err Couldn't query usages of %v. %v\n", value, err)
+			return nil, err
+		}
+		var page []UsageRecord
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Err Couldn't unmarshal query response. %v\n", err)
+			return nil, err
+		}
+		records = append(records, page...)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,431 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Record value and metadata of an entry
+type Record struct {
+	Value    string          `json:"value"`
+	Metadata models.Metadata `json:"metadata"`
+}
+
+// TrashRecord soft deleted entry, it can be restored until PurgeAt
+type TrashRecord struct {
+	Record
+	Deleted models.Metadata `json:"deleted"`
+	PurgeAt time.Time       `json:"purgeAt"`
+}
+
+type entryStore struct {
+	store       *Store
+	config      *application.Config
+	pathUseCase *usecases.PathUseCase
+}
+
+func NewEntryStore(store *Store, config *application.Config, pathUseCase *usecases.PathUseCase) domain.EntryAdapter {
+	return &entryStore{store: store, config: config, pathUseCase: pathUseCase}
+}
+
+func (e *entryStore) sanitize(key string) string {
+	return e.config.StoredKey(key)
+}
+
+func (e *entryStore) records() (map[string]Record, error) {
+	records := map[string]Record{}
+	return records, e.store.read(EntriesFile, &records)
+}
+
+func (e *entryStore) trash() (map[string]TrashRecord, error) {
+	trash := map[string]TrashRecord{}
+	return trash, e.store.read(TrashFile, &trash)
+}
+
+func (e *entryStore) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	summary := map[string]error{}
+	err := e.upsert(ctx, entries)
+	for _, entry := range entries {
+		summary[entry.Key] = err
+	}
+	return summary
+}
+
+func (e *entryStore) upsert(ctx context.Context, entries []models.Entry) error {
+	records, err := e.records()
+	if err != nil {
+		return err
+	}
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	for _, entry := range entries {
+		key := e.sanitize(entry.Key)
+
+		metadata := entry.Metadata()
+		metadata.UpdatedAt = now
+		metadata.UpdatedBy = updatedBy
+		records[key] = Record{Value: entry.Value, Metadata: metadata}
+
+		tracked := metadata
+		tracked.Action = "upsert"
+		track(tracking, newTracking(key, entry.Value, tracked))
+	}
+
+	if err = e.store.write(EntriesFile, records); err != nil {
+		return err
+	}
+	return e.store.write(TrackingFile, tracking)
+}
+
+// Retrieve the entry of the key, nil when it doesn't exist
+func (e *entryStore) Retrieve(ctx context.Context, key string) (*models.Entry, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	records, err := e.records()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := records[strings.Trim(key, "/")]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := &models.Entry{Key: strings.Trim(key, "/"), Value: record.Value, Secure: record.Metadata.Secure}
+	entry.Describe(record.Metadata)
+	return entry, nil
+}
+
+// List entries directly under the prefix and a "<name>/" folder entry of each nested
+// prefix, like the records of the entries table
+func (e *entryStore) List(ctx context.Context, prefix string) ([]models.Entry, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	records, err := e.records()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	folders := map[string]bool{}
+	entries := make([]models.Entry, 0)
+	for key, record := range records {
+		if key == prefix || !under(key, prefix) {
+			continue
+		}
+		rest := key
+		if prefix != "" {
+			rest = strings.TrimPrefix(key, prefix+"/")
+		}
+
+		if folder, _, nested := strings.Cut(rest, "/"); nested {
+			if !folders[folder] {
+				folders[folder] = true
+				entries = append(entries, models.Entry{Path: prefix, Key: folder + "/"})
+			}
+			continue
+		}
+
+		entry := models.Entry{Path: prefix, Key: rest, Value: record.Value, Secure: record.Metadata.Secure}
+		entry.Describe(record.Metadata)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries, nil
+}
+
+// Delete soft deletes the key and every key nested under it, the entries are moved to
+// the trash, tracked with action delete, until the restore window expires
+func (e *entryStore) Delete(ctx context.Context, key string) error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	records, err := e.records()
+	if err != nil {
+		return err
+	}
+	trash, err := e.trash()
+	if err != nil {
+		return err
+	}
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	deleted := models.Metadata{UpdatedAt: now, UpdatedBy: updatedBy, Action: "delete"}
+
+	key = strings.Trim(key, "/")
+	for k, record := range records {
+		if !under(k, key) {
+			continue
+		}
+		trash[k] = TrashRecord{Record: record, Deleted: deleted, PurgeAt: now.Add(e.config.EntryRestoreWindow)}
+
+		tracked := record.Metadata
+		tracked.UpdatedAt = now
+		tracked.UpdatedBy = updatedBy
+		tracked.Action = deleted.Action
+		track(tracking, newTracking(k, record.Value, tracked))
+
+		delete(records, k)
+	}
+
+	if err = e.store.write(TrashFile, trash); err != nil {
+		return err
+	}
+	if err = e.store.write(EntriesFile, records); err != nil {
+		return err
+	}
+	return e.store.write(TrackingFile, tracking)
+}
+
+// Purge removes the key and every key nested under it without keeping them in the trash
+func (e *entryStore) Purge(ctx context.Context, key string) error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	records, err := e.records()
+	if err != nil {
+		return err
+	}
+	key = strings.Trim(key, "/")
+	for k := range records {
+		if under(k, key) {
+			delete(records, k)
+		}
+	}
+	return e.store.write(EntriesFile, records)
+}
+
+// Trash soft deleted entries under the prefix still within the restore window, every
+// entry when the prefix is empty
+func (e *entryStore) Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	trash, err := e.trash()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	entries := make([]models.TrashEntry, 0)
+	for key, record := range trash {
+		if !under(key, prefix) || !record.PurgeAt.After(now) {
+			continue
+		}
+		entry := models.Entry{
+			Path:   e.pathUseCase.PathWithoutKey(key),
+			Key:    e.pathUseCase.BaseKey(key),
+			Value:  record.Value,
+			Secure: record.Metadata.Secure,
+		}
+		entry.Describe(record.Metadata)
+		entries = append(entries, models.TrashEntry{
+			Entry:     entry,
+			DeletedAt: record.Deleted.UpdatedAt,
+			DeletedBy: record.Deleted.UpdatedBy,
+			PurgeAt:   record.PurgeAt,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return e.pathUseCase.Concat(entries[i].Path, entries[i].Key) < e.pathUseCase.Concat(entries[j].Path, entries[j].Key)
+	})
+
+	return entries, nil
+}
+
+// Restore restores the soft deleted key and the keys under it with their values,
+// metadata and secure references, tracked with action restore. The keys past the restore
+// window are skipped and reported with ErrRestoreWindowExpired next to the restored ones.
+func (e *entryStore) Restore(ctx context.Context, key string) ([]string, error) {
+	key = strings.Trim(strings.TrimSpace(key), "/")
+	if key == "" {
+		return nil, errors.New("key is required")
+	}
+
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	records, err := e.records()
+	if err != nil {
+		return nil, err
+	}
+	trash, err := e.trash()
+	if err != nil {
+		return nil, err
+	}
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	restored := make([]string, 0)
+	expired := make([]string, 0)
+	for k, record := range trash {
+		if !under(k, key) {
+			continue
+		}
+		if now.After(record.PurgeAt) {
+			expired = append(expired, k)
+			continue
+		}
+
+		metadata := record.Metadata
+		metadata.UpdatedAt = now
+		metadata.UpdatedBy = updatedBy
+		metadata.Action = ""
+		records[k] = Record{Value: record.Value, Metadata: metadata}
+
+		tracked := metadata
+		tracked.Action = "restore"
+		track(tracking, newTracking(k, record.Value, tracked))
+
+		delete(trash, k)
+		restored = append(restored, k)
+	}
+	sort.Strings(restored)
+	sort.Strings(expired)
+	if len(restored) == 0 && len(expired) > 0 {
+		return nil, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, strings.Join(expired, ", "))
+	}
+
+	if err = e.store.write(EntriesFile, records); err != nil {
+		return nil, err
+	}
+	if err = e.store.write(TrashFile, trash); err != nil {
+		return nil, err
+	}
+	if err = e.store.write(TrackingFile, tracking); err != nil {
+		return nil, err
+	}
+
+	if len(expired) > 0 {
+		return restored, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, strings.Join(expired, ", "))
+	}
+	return restored, nil
+}
+
+// Tracking history of the key, newest first
+func (e *entryStore) Tracking(ctx context.Context, key string) ([]models.Tracking, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return nil, err
+	}
+	return newest(tracking[key]), nil
+}
+
+// Activity history of every key, newest first, filtered by user, key prefix, action
+// and time range
+func (e *entryStore) Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return nil, err
+	}
+
+	to := filter.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	prefix := strings.Trim(filter.Prefix, "/")
+
+	records := make([]models.Tracking, 0)
+	for key, history := range tracking {
+		if !under(key, prefix) {
+			continue
+		}
+		for _, t := range history {
+			if filter.User != "" && t.UpdatedBy != filter.User {
+				continue
+			}
+			if filter.Action != "" && t.Action != filter.Action {
+				continue
+			}
+			if t.UpdatedAt.Before(filter.From) || t.UpdatedAt.After(to) {
+				continue
+			}
+			records = append(records, t)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].UpdatedAt.Equal(records[j].UpdatedAt) {
+			return records[i].Key < records[j].Key
+		}
+		return records[i].UpdatedAt.After(records[j].UpdatedAt)
+	})
+
+	result, cursor, err := page(records, filter.Cursor, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TrackingPage{Tracking: result, Cursor: cursor}, nil
+}
+
+// ImportTracking writes the history records as they are, keeping their timestamps
+func (e *entryStore) ImportTracking(ctx context.Context, records []models.Tracking) error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return err
+	}
+	track(tracking, records...)
+	return e.store.write(TrackingFile, tracking)
+}
+
+// MoveTracking copies the history of from under to, each copy linked to the original
+// key by MovedFrom, and records the move in the history of from
+func (e *entryStore) MoveTracking(ctx context.Context, from string, to string) error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+
+	tracking, err := e.store.tracking()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range tracking[from] {
+		copied := record
+		copied.Key = to
+		if copied.MovedFrom == "" {
+			copied.MovedFrom = from
+		}
+		track(tracking, copied)
+	}
+
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	track(tracking, models.Tracking{Key: from, UpdatedAt: time.Now().UTC(), UpdatedBy: updatedBy, Action: "move", MovedTo: to})
+
+	return e.store.write(TrackingFile, tracking)
+}
@@ -0,0 +1,132 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*Store, *application.Config) {
+	config := &application.Config{
+		DefaultPrefix:      "global",
+		AllowedPrefixes:    []string{"global/", "development/", "qa/", "production/"},
+		EntryRestoreWindow: time.Hour,
+		BoxRestoreWindow:   time.Hour,
+		LocalDir:           t.TempDir(),
+	}
+	store, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, config
+}
+
+func TestEntryStore(t *testing.T) {
+	store, config := newTestStore(t)
+	entries := NewEntryStore(store, config, usecases.NewPathUseCase())
+	ctx := context.WithValue(context.Background(), application.RequestUserName, "jane")
+
+	summary := entries.Upsert(ctx, []models.Entry{
+		{Key: "production/api/db_host", Value: "db.internal"},
+		{Key: "production/api/nested/port", Value: "5432"},
+		{Key: "token", Value: "abc"},
+	})
+	for key, err := range summary {
+		if err != nil {
+			t.Fatalf("Upsert(%s) error = %v", key, err)
+		}
+	}
+
+	entry, err := entries.Retrieve(ctx, "global/token")
+	if err != nil || entry == nil || entry.Value != "abc" {
+		t.Fatalf("Retrieve(global/token) = %v, %v, want abc", entry, err)
+	}
+
+	list, err := entries.List(ctx, "production/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "db_host" || list[1].Key != "nested/" {
+		t.Errorf("List() = %v, want db_host and the nested/ folder", list)
+	}
+
+	if err = entries.Delete(ctx, "production/api"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ = entries.Retrieve(ctx, "production/api/db_host"); entry != nil {
+		t.Errorf("Retrieve() after Delete = %v, want nil", entry)
+	}
+	trash, err := entries.Trash(ctx, "production")
+	if err != nil || len(trash) != 2 || trash[0].DeletedBy != "jane" {
+		t.Fatalf("Trash() = %v, %v, want both deleted entries", trash, err)
+	}
+
+	restored, err := entries.Restore(ctx, "production/api")
+	if err != nil || len(restored) != 2 {
+		t.Fatalf("Restore() = %v, %v, want both entries", restored, err)
+	}
+	if entry, _ = entries.Retrieve(ctx, "production/api/nested/port"); entry == nil || entry.Value != "5432" {
+		t.Errorf("Retrieve() after Restore = %v, want 5432", entry)
+	}
+
+	tracking, err := entries.Tracking(ctx, "production/api/db_host")
+	if err != nil || len(tracking) == 0 || tracking[0].UpdatedBy != "jane" {
+		t.Fatalf("Tracking() = %v, %v", tracking, err)
+	}
+}
+
+func TestEntryStore_RestoreWindowExpired(t *testing.T) {
+	store, config := newTestStore(t)
+	config.EntryRestoreWindow = -time.Minute
+	entries := NewEntryStore(store, config, usecases.NewPathUseCase())
+	ctx := context.Background()
+
+	entries.Upsert(ctx, []models.Entry{{Key: "qa/api/db_host", Value: "db.qa"}})
+	if err := entries.Delete(ctx, "qa/api/db_host"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := entries.Restore(ctx, "qa/api/db_host"); !errors.Is(err, domain.ErrRestoreWindowExpired) {
+		t.Errorf("Restore() error = %v, want %v", err, domain.ErrRestoreWindowExpired)
+	}
+}
+
+func TestEntryStore_Activity(t *testing.T) {
+	store, config := newTestStore(t)
+	entries := NewEntryStore(store, config, usecases.NewPathUseCase())
+
+	records := make([]models.Tracking, 0)
+	for i := 0; i < 3; i++ {
+		records = append(records, models.Tracking{
+			Key:       "production/api/db_host",
+			UpdatedAt: time.Unix(1760000000+int64(i), 0).UTC(),
+			UpdatedBy: "jane",
+			Action:    "upsert",
+		})
+	}
+	if err := entries.ImportTracking(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := entries.Activity(context.Background(), models.TrackingFilter{Prefix: "production", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tracking) != 2 || page.Cursor == "" || !page.Tracking[0].UpdatedAt.Equal(records[2].UpdatedAt) {
+		t.Fatalf("Activity() = %v, want the two newest records and a cursor", page)
+	}
+
+	next, err := entries.Activity(context.Background(), models.TrackingFilter{Prefix: "production", Limit: 2, Cursor: page.Cursor})
+	if err != nil || len(next.Tracking) != 1 || next.Cursor != "" {
+		t.Fatalf("Activity() next page = %v, %v, want the last record", next, err)
+	}
+
+	if _, err = entries.Activity(context.Background(), models.TrackingFilter{Cursor: "not a cursor"}); !errors.Is(err, domain.ErrInvalidCursor) {
+		t.Errorf("Activity() error = %v, want %v", err, domain.ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,229 @@
+package local
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecretVersion one value of a secret, sealed with NBOX_LOCAL_KEY when it's set
+type SecretVersion struct {
+	Value     string    `json:"value"`
+	Sealed    bool      `json:"sealed,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy"`
+}
+
+// secretStore versioned secrets named like parameters, /<key>. The reference
+// /<key>:<version> reads a version, like the parameter store selector.
+type secretStore struct {
+	store  *Store
+	aead   cipher.AEAD
+	config *application.Config
+}
+
+func NewSecretStore(store *Store, config *application.Config) (domain.SecretAdapter, error) {
+	secrets := &secretStore{store: store, config: config}
+	if config.LocalKey == "" {
+		log.Println("NBOX_LOCAL_KEY is not set, the local secrets are stored in plain text")
+		return secrets, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.LocalKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("NBOX_LOCAL_KEY must be a base64 AES-256 key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if secrets.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func (s *secretStore) secrets() (map[string][]SecretVersion, error) {
+	secrets := map[string][]SecretVersion{}
+	return secrets, s.store.read(SecretsFile, &secrets)
+}
+
+// parse name and version of the reference, version 0 is the current one
+func parse(reference string) (string, int) {
+	if i := strings.LastIndex(reference, ":"); i > 0 {
+		if version, err := strconv.Atoi(reference[i+1:]); err == nil && version > 0 {
+			return reference[:i], version
+		}
+	}
+	return reference, 0
+}
+
+func (s *secretStore) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	summary := map[string]error{}
+	secrets, err := s.secrets()
+	if err != nil {
+		for _, entry := range entries {
+			summary[entry.Key] = err
+		}
+		return summary
+	}
+
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+	for _, entry := range entries {
+		version := SecretVersion{UpdatedAt: now, UpdatedBy: updatedBy}
+		if version.Value, version.Sealed, err = s.seal(entry.Value); err != nil {
+			summary[entry.Key] = err
+			continue
+		}
+		name := s.name(entry.Key)
+		secrets[name] = append(secrets[name], version)
+		summary[entry.Key] = nil
+	}
+
+	if err = s.store.write(SecretsFile, secrets); err != nil {
+		for key := range summary {
+			summary[key] = err
+		}
+	}
+	return summary
+}
+
+func (s *secretStore) name(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// Reference name of the secret of the key
+func (s *secretStore) Reference(ctx context.Context, key string) (string, error) {
+	return s.name(key), nil
+}
+
+// Retrieve value of the secret, the current version or the one of the reference
+func (s *secretStore) Retrieve(ctx context.Context, reference string) (string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	version, err := s.version(reference)
+	if err != nil {
+		return "", err
+	}
+	return s.open(version)
+}
+
+func (s *secretStore) version(reference string) (*SecretVersion, error) {
+	secrets, err := s.secrets()
+	if err != nil {
+		return nil, err
+	}
+
+	name, number := parse(reference)
+	versions := secrets[name]
+	if number == 0 {
+		number = len(versions)
+	}
+	if number == 0 || number > len(versions) {
+		return nil, fmt.Errorf("%w: secret %s", ErrNotFound, reference)
+	}
+	return &versions[number-1], nil
+}
+
+// Version number of the current version, or of the version of the reference
+func (s *secretStore) Version(ctx context.Context, reference string) (string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	secrets, err := s.secrets()
+	if err != nil {
+		return "", err
+	}
+	name, number := parse(reference)
+	if number == 0 {
+		number = len(secrets[name])
+	}
+	if number == 0 || number > len(secrets[name]) {
+		return "", fmt.Errorf("%w: secret %s", ErrNotFound, reference)
+	}
+	return strconv.Itoa(number), nil
+}
+
+// Describe current version of the secret and who wrote it, nil when it doesn't exist
+func (s *secretStore) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	secrets, err := s.secrets()
+	if err != nil {
+		return nil, err
+	}
+	name, _ := parse(reference)
+	versions := secrets[name]
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	current := versions[len(versions)-1]
+	return &models.SecretMetadata{
+		Name:             name,
+		Version:          int64(len(versions)),
+		LastModifiedAt:   current.UpdatedAt,
+		LastModifiedUser: current.UpdatedBy,
+	}, nil
+}
+
+// Delete removes the secret and its versions
+func (s *secretStore) Delete(ctx context.Context, reference string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	secrets, err := s.secrets()
+	if err != nil {
+		return err
+	}
+	name, _ := parse(reference)
+	delete(secrets, name)
+	return s.store.write(SecretsFile, secrets)
+}
+
+// seal encrypts the value when there is a key, the nonce is prepended to the sealed value
+func (s *secretStore) seal(value string) (string, bool, error) {
+	if s.aead == nil {
+		return value, false, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", false, err
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), nil)), true, nil
+}
+
+func (s *secretStore) open(version *SecretVersion) (string, error) {
+	if !version.Sealed {
+		return version.Value, nil
+	}
+	if s.aead == nil {
+		return "", errors.New("the secret is sealed, NBOX_LOCAL_KEY is required")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(version.Value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("invalid sealed secret")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	value, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("open secret: %w", err)
+	}
+	return string(value), nil
+}
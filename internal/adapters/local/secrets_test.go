@@ -0,0 +1,73 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLocalKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSecretStore(t *testing.T) {
+	store, config := newTestStore(t)
+	config.LocalKey = testLocalKey
+	secrets, err := NewSecretStore(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, value := range []string{"s3cr3t", "r0tat3d"} {
+		if err = secrets.Upsert(ctx, []models.Entry{{Key: "production/api/password", Value: value}})["production/api/password"]; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reference, _ := secrets.Reference(ctx, "production/api/password")
+	if reference != "/production/api/password" {
+		t.Errorf("Reference() = %s, want /production/api/password", reference)
+	}
+	if value, _ := secrets.Retrieve(ctx, reference); value != "r0tat3d" {
+		t.Errorf("Retrieve() = %s, want r0tat3d", value)
+	}
+	if value, _ := secrets.Retrieve(ctx, reference+":1"); value != "s3cr3t" {
+		t.Errorf("Retrieve(:1) = %s, want s3cr3t", value)
+	}
+	if version, _ := secrets.Version(ctx, reference); version != "2" {
+		t.Errorf("Version() = %s, want 2", version)
+	}
+	if metadata, _ := secrets.Describe(ctx, reference); metadata == nil || metadata.Version != 2 {
+		t.Errorf("Describe() = %v, want version 2", metadata)
+	}
+
+	content, err := os.ReadFile(filepath.Join(config.LocalDir, SecretsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "s3cr3t") {
+		t.Errorf("%s stores the secret in plain text", SecretsFile)
+	}
+
+	if err = secrets.Delete(ctx, reference); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = secrets.Retrieve(ctx, reference); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Retrieve() after Delete error = %v, want %v", err, ErrNotFound)
+	}
+	if metadata, _ := secrets.Describe(ctx, reference); metadata != nil {
+		t.Errorf("Describe() after Delete = %v, want nil", metadata)
+	}
+}
+
+func TestNewSecretStore_InvalidKey(t *testing.T) {
+	store, config := newTestStore(t)
+	config.LocalKey = "c2hvcnQ="
+
+	if _, err := NewSecretStore(store, config); err == nil {
+		t.Error("NewSecretStore() error = nil, want invalid key")
+	}
+}
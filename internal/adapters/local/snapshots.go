@@ -0,0 +1,77 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// snapshotStore snapshots as json files, snapshots/<stage>/<name>.json like the bucket folder
+type snapshotStore struct {
+	store *Store
+}
+
+func NewSnapshotStore(store *Store) domain.SnapshotAdapter {
+	return &snapshotStore{store: store}
+}
+
+func snapshotFile(stage string, name string) string {
+	return filepath.Join(SnapshotsDir, stage, name+".json")
+}
+
+func (s *snapshotStore) Save(ctx context.Context, snapshot *models.Snapshot) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return s.store.write(snapshotFile(snapshot.Stage, snapshot.Name), snapshot)
+}
+
+// Retrieve the snapshot, nil when it doesn't exist
+func (s *snapshotStore) Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var snapshot *models.Snapshot
+	if err := s.store.read(snapshotFile(stage, name), &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// List snapshots of the stage
+func (s *snapshotStore) List(ctx context.Context, stage string) ([]models.SnapshotSummary, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	snapshots := make([]models.SnapshotSummary, 0)
+	files, err := os.ReadDir(filepath.Join(s.store.dir, SnapshotsDir, stage))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, models.SnapshotSummary{
+			Name:      strings.TrimSuffix(file.Name(), ".json"),
+			Stage:     stage,
+			CreatedAt: info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+
+	return snapshots, nil
+}
@@ -0,0 +1,44 @@
+package local
+
+import (
+	"context"
+	"nbox/internal/domain/models"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	store, _ := newTestStore(t)
+	snapshots := NewSnapshotStore(store)
+	ctx := context.Background()
+
+	snapshot, err := snapshots.Retrieve(ctx, "production", "before-migration")
+	if err != nil || snapshot != nil {
+		t.Fatalf("Retrieve() = %v, %v, want nil", snapshot, err)
+	}
+
+	err = snapshots.Save(ctx, &models.Snapshot{
+		Name:      "before-migration",
+		Stage:     "production",
+		CreatedAt: time.Unix(1760000000, 0).UTC(),
+		Entries: []models.SnapshotEntry{
+			{Entry: models.Entry{Key: "production/api/password", Value: "/production/api/password", Secure: true}, Version: "3"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err = snapshots.Retrieve(ctx, "production", "before-migration")
+	if err != nil || snapshot == nil || len(snapshot.Entries) != 1 || snapshot.Entries[0].Version != "3" {
+		t.Fatalf("Retrieve() = %v, %v, want the saved snapshot", snapshot, err)
+	}
+
+	list, err := snapshots.List(ctx, "production")
+	if err != nil || len(list) != 1 || list[0].Name != "before-migration" {
+		t.Fatalf("List() = %v, %v, want before-migration", list, err)
+	}
+	if list, _ = snapshots.List(ctx, "qa"); len(list) != 0 {
+		t.Errorf("List(qa) = %v, want empty", list)
+	}
+}
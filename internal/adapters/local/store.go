@@ -0,0 +1,179 @@
+package local
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"nbox/internal/usecases"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	EntriesFile  = "entries.json"  // EntriesFile entries by full key
+	TrackingFile = "tracking.json" // TrackingFile history of the entries and boxes by key
+	TrashFile    = "trash.json"    // TrashFile soft deleted entries by full key
+	BoxesFile    = "boxes.json"    // BoxesFile box templates by service/stage/template
+	PartialsFile = "partials.json" // PartialsFile shared partials and overlay bases by name
+	SecretsFile  = "secrets.json"  // SecretsFile versions of the secure values by name
+	SnapshotsDir = "snapshots"     // SnapshotsDir one json per snapshot, snapshots/<stage>/<name>.json
+
+	ListDefaultLimit = 50
+	ListMaximumLimit = 500
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Store directory of json files holding the data of the local backend. Every operation
+// reads and writes the files it needs under the lock, files are replaced through a
+// rename so an interruption never leaves them half written.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewStore(config *application.Config) (*Store, error) {
+	if err := os.MkdirAll(config.LocalDir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: config.LocalDir}, nil
+}
+
+// NewBackend adapters of the local backend of the config, used as migration target
+func NewBackend(config *application.Config, pathUseCase *usecases.PathUseCase) (usecases.Backend, error) {
+	store, err := NewStore(config)
+	if err != nil {
+		return usecases.Backend{}, err
+	}
+	secrets, err := NewSecretStore(store, config)
+	if err != nil {
+		return usecases.Backend{}, err
+	}
+	return usecases.Backend{
+		Entries:   NewEntryStore(store, config, pathUseCase),
+		Templates: NewTemplateStore(store, config),
+		Secrets:   secrets,
+		Config:    config,
+	}, nil
+}
+
+// read decodes the file into v, v is left as it is when the file doesn't exist
+func (s *Store) read(name string, v any) error {
+	content, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *Store) write(name string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(s.dir, name)
+	if err = os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(file+".tmp", content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// tracking history of every key
+func (s *Store) tracking() (map[string][]models.Tracking, error) {
+	tracking := map[string][]models.Tracking{}
+	return tracking, s.read(TrackingFile, &tracking)
+}
+
+// track adds the records to the history, a record replaces the one of its key with the
+// same timestamp, like the Key and Timestamp keys of the tracking table
+func track(tracking map[string][]models.Tracking, records ...models.Tracking) {
+	for _, record := range records {
+		history := tracking[record.Key]
+		replaced := false
+		for i, t := range history {
+			if t.UpdatedAt.Unix() == record.UpdatedAt.Unix() {
+				history[i] = record
+				replaced = true
+			}
+		}
+		if !replaced {
+			history = append(history, record)
+		}
+		tracking[record.Key] = history
+	}
+}
+
+// newest history sorted by update time, newest first
+func newest(tracking []models.Tracking) []models.Tracking {
+	sorted := append([]models.Tracking{}, tracking...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].UpdatedAt.After(sorted[j].UpdatedAt) })
+	return sorted
+}
+
+func newTracking(key string, value string, metadata models.Metadata) models.Tracking {
+	return models.Tracking{
+		Key:       key,
+		Value:     value,
+		Secure:    metadata.Secure,
+		UpdatedAt: metadata.UpdatedAt,
+		UpdatedBy: metadata.UpdatedBy,
+		Action:    metadata.Action,
+
+		SecretVersion: metadata.SecretVersion,
+		SecretUser:    metadata.SecretUser,
+	}
+}
+
+// under the key is the prefix or is nested under it, every key is under the empty prefix
+func under(key string, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// page items of the offset cursor, the cursor of the next page is empty on the last one
+func page[T any](items []T, cursor string, limit int) ([]T, string, error) {
+	if limit <= 0 {
+		limit = ListDefaultLimit
+	}
+	if limit > ListMaximumLimit {
+		limit = ListMaximumLimit
+	}
+
+	offset := 0
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %s", domain.ErrInvalidCursor, err)
+		}
+		if offset, err = strconv.Atoi(string(decoded)); err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("%w: invalid offset", domain.ErrInvalidCursor)
+		}
+	}
+	if offset >= len(items) {
+		return []T{}, "", nil
+	}
+
+	end := min(offset+limit, len(items))
+	next := ""
+	if end < len(items) {
+		next = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(end)))
+	}
+	return items[offset:end], next, nil
+}
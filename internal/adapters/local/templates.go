@@ -0,0 +1,336 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BoxRecord one template of a box with its content, soft deleted templates keep their
+// content until PurgeAt
+type BoxRecord struct {
+	Service    string             `json:"service"`
+	Stage      string             `json:"stage"`
+	Template   string             `json:"template"`
+	Parameters []models.Parameter `json:"parameters,omitempty"`
+	Resolution []string           `json:"resolution,omitempty"`
+	Content    []byte             `json:"content"`
+	UpdatedAt  time.Time          `json:"updatedAt"`
+	Deleted    *models.Metadata   `json:"deleted,omitempty"`
+	PurgeAt    time.Time          `json:"purgeAt,omitempty"`
+}
+
+// Path service/stage/template of the box
+func (r BoxRecord) Path() string {
+	return fmt.Sprintf("%s/%s/%s", r.Service, r.Stage, r.Template)
+}
+
+type templateStore struct {
+	store  *Store
+	config *application.Config
+}
+
+func NewTemplateStore(store *Store, config *application.Config) domain.TemplateAdapter {
+	return &templateStore{store: store, config: config}
+}
+
+func (b *templateStore) records() (map[string]BoxRecord, error) {
+	records := map[string]BoxRecord{}
+	return records, b.store.read(BoxesFile, &records)
+}
+
+// live record of the template, nil when it doesn't exist or is deleted
+func (b *templateStore) live(service string, stage string, template string) (*BoxRecord, error) {
+	records, err := b.records()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := records[fmt.Sprintf("%s/%s/%s", service, stage, template)]
+	if !ok || record.Deleted != nil {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (b *templateStore) UpsertBox(ctx context.Context, box *models.Box) []string {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	result := make([]string, 0)
+	records, err := b.records()
+	if err != nil {
+		log.Printf("Err read box records. %v\n", err)
+		return result
+	}
+
+	now := time.Now().UTC()
+	for stageName, stage := range box.Stage {
+		resolution := stage.Resolution
+		if len(resolution) == 0 {
+			resolution = box.Resolution
+		}
+
+		for _, template := range stage.GetTemplates() {
+			record := BoxRecord{
+				Service:    box.Service,
+				Stage:      stageName,
+				Template:   template.Name,
+				Parameters: template.Parameters,
+				Resolution: resolution,
+				UpdatedAt:  now,
+			}
+
+			content, err := content(template)
+			if err != nil {
+				log.Printf("Err store template %s. %v\n", record.Path(), err)
+				continue
+			}
+			record.Content = content
+
+			records[record.Path()] = record
+			result = append(result, record.Path())
+		}
+	}
+
+	if err = b.store.write(BoxesFile, records); err != nil {
+		log.Printf("Err store box records. %v\n", err)
+		return make([]string, 0)
+	}
+	return result
+}
+
+// content decoded template, indented when it's valid JSON like the stored S3 objects
+func content(template models.Template) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(template.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// templates with {{> partial}} includes are only valid JSON once composed
+	if !json.Valid(decoded) {
+		return decoded, nil
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, decoded, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (b *templateStore) BoxExists(ctx context.Context, service string, stage string, template string) (bool, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	record, err := b.live(service, stage, template)
+	return record != nil, err
+}
+
+func (b *templateStore) RetrieveBox(ctx context.Context, service string, stage string, template string) ([]byte, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	record, err := b.live(service, stage, template)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w: template %s/%s/%s", ErrNotFound, service, stage, template)
+	}
+	return record.Content, nil
+}
+
+// RetrieveStage templates of the stage, without their content
+func (b *templateStore) RetrieveStage(ctx context.Context, service string, stage string) (*models.Stage, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	records, err := b.records()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for path, record := range records {
+		if record.Service == service && record.Stage == stage && record.Deleted == nil {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+
+	result := &models.Stage{Resolution: records[paths[0]].Resolution}
+	for _, path := range paths {
+		record := records[path]
+		result.Templates = append(result.Templates, models.Template{Name: path, Value: record.Template, Parameters: record.Parameters})
+	}
+	return result, nil
+}
+
+// DeleteBox soft deletes the templates of the service, optionally of a stage and template,
+// until the restore window expires
+func (b *templateStore) DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+
+	return b.change(service, stage, template, "delete", now, updatedBy, func(record *BoxRecord) (bool, error) {
+		if record.Deleted != nil {
+			return false, nil
+		}
+		record.Deleted = &models.Metadata{UpdatedAt: now, UpdatedBy: updatedBy, Action: "delete"}
+		record.PurgeAt = now.Add(b.config.BoxRestoreWindow)
+		return true, nil
+	})
+}
+
+// RestoreBox restores soft deleted templates within the restore window
+func (b *templateStore) RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	now := time.Now().UTC()
+	updatedBy, _ := ctx.Value(application.RequestUserName).(string)
+
+	return b.change(service, stage, template, "restore", now, updatedBy, func(record *BoxRecord) (bool, error) {
+		if record.Deleted == nil {
+			return false, nil
+		}
+		if now.After(record.PurgeAt) {
+			return false, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, record.Path())
+		}
+		record.Deleted = nil
+		record.PurgeAt = time.Time{}
+		record.UpdatedAt = now
+		return true, nil
+	})
+}
+
+// change applies the change to the templates of the service, optionally of a stage and
+// template, and tracks each changed template under the box:<path> key. Nothing is
+// written when a change fails.
+func (b *templateStore) change(
+	service string,
+	stage string,
+	template string,
+	action string,
+	now time.Time,
+	updatedBy string,
+	fn func(record *BoxRecord) (bool, error),
+) ([]string, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	records, err := b.records()
+	if err != nil {
+		return nil, err
+	}
+	tracking, err := b.store.tracking()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for path, record := range records {
+		if record.Service != service || (stage != "" && record.Stage != stage) || (template != "" && record.Template != template) {
+			continue
+		}
+		changed, err := fn(&record)
+		if err != nil {
+			return make([]string, 0), err
+		}
+		if !changed {
+			continue
+		}
+		records[path] = record
+		track(tracking, models.Tracking{Key: "box:" + path, UpdatedAt: now, UpdatedBy: updatedBy, Action: action})
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return paths, nil
+	}
+	sort.Strings(paths)
+
+	if err = b.store.write(BoxesFile, records); err != nil {
+		return make([]string, 0), err
+	}
+	if err = b.store.write(TrackingFile, tracking); err != nil {
+		log.Printf("Err save tracking. %s %s. %v\n", action, strings.Join(paths, ", "), err)
+	}
+	return paths, nil
+}
+
+// List box templates sorted by last update, filtered by service and stage
+func (b *templateStore) List(ctx context.Context, filter models.BoxFilter) (*models.BoxPage, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	records, err := b.records()
+	if err != nil {
+		return nil, err
+	}
+
+	boxes := make([]models.BoxSummary, 0)
+	for path, record := range records {
+		if record.Deleted != nil || (filter.Service != "" && record.Service != filter.Service) || (filter.Stage != "" && record.Stage != filter.Stage) {
+			continue
+		}
+		boxes = append(boxes, models.BoxSummary{
+			Service:    record.Service,
+			Stage:      record.Stage,
+			Template:   record.Template,
+			Path:       path,
+			Parameters: record.Parameters,
+			Resolution: record.Resolution,
+			UpdatedAt:  record.UpdatedAt,
+		})
+	}
+	sort.SliceStable(boxes, func(i, j int) bool {
+		if boxes[i].UpdatedAt.Equal(boxes[j].UpdatedAt) {
+			return boxes[i].Path < boxes[j].Path
+		}
+		if filter.Ascending {
+			return boxes[i].UpdatedAt.Before(boxes[j].UpdatedAt)
+		}
+		return boxes[i].UpdatedAt.After(boxes[j].UpdatedAt)
+	})
+
+	result, cursor, err := page(boxes, filter.Cursor, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &models.BoxPage{Boxes: result, Cursor: cursor}, nil
+}
+
+func (b *templateStore) UpsertPartial(ctx context.Context, name string, value []byte) error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	partials := map[string][]byte{}
+	if err := b.store.read(PartialsFile, &partials); err != nil {
+		return err
+	}
+	partials[strings.Trim(name, "/")] = value
+	return b.store.write(PartialsFile, partials)
+}
+
+func (b *templateStore) RetrievePartial(ctx context.Context, name string) ([]byte, error) {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	partials := map[string][]byte{}
+	if err := b.store.read(PartialsFile, &partials); err != nil {
+		return nil, err
+	}
+	value, ok := partials[strings.Trim(name, "/")]
+	if !ok {
+		return nil, fmt.Errorf("%w: partial %s", ErrNotFound, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,72 @@
+package local
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"testing"
+	"time"
+)
+
+func TestTemplateStore(t *testing.T) {
+	store, config := newTestStore(t)
+	templates := NewTemplateStore(store, config)
+	ctx := context.Background()
+
+	box := &models.Box{Service: "payments-api", Stage: map[string]models.Stage{
+		"production": {Template: &models.Template{
+			Name:  "task_definition.json",
+			Value: base64.StdEncoding.EncodeToString([]byte(`{"image":"{{ production/payments-api/image }}"}`)),
+		}},
+	}}
+	if paths := templates.UpsertBox(ctx, box); len(paths) != 1 || paths[0] != "payments-api/production/task_definition.json" {
+		t.Fatalf("UpsertBox() = %v", paths)
+	}
+
+	content, err := templates.RetrieveBox(ctx, "payments-api", "production", "task_definition.json")
+	if err != nil || string(content) != "{\n  \"image\": \"{{ production/payments-api/image }}\"\n}" {
+		t.Fatalf("RetrieveBox() = %s, %v", content, err)
+	}
+
+	deleted, err := templates.DeleteBox(ctx, "payments-api", "", "")
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("DeleteBox() = %v, %v", deleted, err)
+	}
+	if exists, _ := templates.BoxExists(ctx, "payments-api", "production", "task_definition.json"); exists {
+		t.Error("BoxExists() after DeleteBox = true, want false")
+	}
+	if deleted, _ = templates.DeleteBox(ctx, "payments-api", "", ""); len(deleted) != 0 {
+		t.Errorf("DeleteBox() twice = %v, want nothing deleted", deleted)
+	}
+
+	restored, err := templates.RestoreBox(ctx, "payments-api", "production", "")
+	if err != nil || len(restored) != 1 {
+		t.Fatalf("RestoreBox() = %v, %v", restored, err)
+	}
+	if _, err = templates.RetrieveBox(ctx, "payments-api", "production", "task_definition.json"); err != nil {
+		t.Errorf("RetrieveBox() after RestoreBox error = %v", err)
+	}
+}
+
+func TestTemplateStore_RestoreWindowExpired(t *testing.T) {
+	store, config := newTestStore(t)
+	config.BoxRestoreWindow = -time.Minute
+	templates := NewTemplateStore(store, config)
+	ctx := context.Background()
+
+	templates.UpsertBox(ctx, &models.Box{Service: "payments-api", Stage: map[string]models.Stage{
+		"qa": {Template: &models.Template{Name: "app.json", Value: base64.StdEncoding.EncodeToString([]byte(`{}`))}},
+	}})
+	if _, err := templates.DeleteBox(ctx, "payments-api", "qa", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := templates.RestoreBox(ctx, "payments-api", "qa", ""); !errors.Is(err, domain.ErrRestoreWindowExpired) {
+		t.Errorf("RestoreBox() error = %v, want %v", err, domain.ErrRestoreWindowExpired)
+	}
+	if _, err := templates.RetrieveBox(ctx, "payments-api", "qa", "app.json"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RetrieveBox() error = %v, want %v", err, ErrNotFound)
+	}
+}
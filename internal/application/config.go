@@ -1,24 +1,52 @@
 package application
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	BucketName                string   `pkl:"bucketName"`
-	EntryTableName            string   `pkl:"entryTableName"`
-	TrackingEntryTableName    string   `pkl:"trackingEntryTableName"`
-	BoxTableName              string   `pkl:"boxTableName"`
-	RegionName                string   `pkl:"regionName"`
-	AccountId                 string   `pkl:"accountId"`
-	ParameterStoreDefaultTier string   `pkl:"parameterStoreDefaultTier"`
-	ParameterStoreKeyId       string   `pkl:"parameterStoreKeyId"`
-	ParameterShortArn         bool     `pkl:"parameterShortArn"`
-	DefaultPrefix             string   `pkl:"defaultPrefix"`
-	AllowedPrefixes           []string `pkl:"allowedPrefixes"`
+	BucketName                string              `pkl:"bucketName"`
+	EntryTableName            string              `pkl:"entryTableName"`
+	TrackingEntryTableName    string              `pkl:"trackingEntryTableName"`
+	BoxTableName              string              `pkl:"boxTableName"`
+	UsageTableName            string              `pkl:"usageTableName"`
+	SearchTableName           string              `pkl:"searchTableName"`
+	TrashTableName            string              `pkl:"trashTableName"`
+	RegionName                string              `pkl:"regionName"`
+	AccountId                 string              `pkl:"accountId"`
+	AwsEndpoint               string              `pkl:"awsEndpoint"`     // AwsEndpoint of every AWS service, e.g. a LocalStack container
+	StageConfigFile           string              `pkl:"stageConfigFile"` // yaml or json file with the AWS account, region and resources of each stage
+	ParameterStoreDefaultTier string              `pkl:"parameterStoreDefaultTier"`
+	ParameterStoreKeyId       string              `pkl:"parameterStoreKeyId"`
+	ExpirationPolicies        bool                `pkl:"expirationPolicies"` // ExpirationPolicies SSM Expiration and ExpirationNotification policies of the expiring parameters
+	ParameterShortArn         bool                `pkl:"parameterShortArn"`
+	SecretBackend             string              `pkl:"secretBackend"`          // ssm | secretsmanager, store of the secure entries
+	SecretsManagerPrefixes    []string            `pkl:"secretsManagerPrefixes"` // SecretsManagerPrefixes stored in secrets manager with the ssm backend
+	SecretsManagerKeyId       string              `pkl:"secretsManagerKeyId"`
+	DefaultPrefix             string              `pkl:"defaultPrefix"`
+	AllowedPrefixes           []string            `pkl:"allowedPrefixes"`
+	ProtectedPrefixes         []string            `pkl:"protectedPrefixes"` // ProtectedPrefixes only privileged users can delete them
+	PrivilegedUsers           []string            `pkl:"privilegedUsers"`   // PrivilegedUsers legacy list, prefer PrivilegedRole
+	PrivilegedRole            string              `pkl:"privilegedRole"`    // PrivilegedRole role of UserRoles that can delete protected prefixes
+	UserRoles                 map[string][]string `pkl:"userRoles"`         // UserRoles roles of each basic auth user
+	ConfirmationKey           string              `pkl:"confirmationKey"`   // ConfirmationKey secret that signs the prefix delete tokens
+	PrefixDelete              bool                `pkl:"prefixDelete"`      // PrefixDelete enables DELETE /api/entry/prefix, it requires ConfirmationKey
+	BoxRestoreWindow          time.Duration       `pkl:"boxRestoreWindow"`
+	EntryRestoreWindow        time.Duration       `pkl:"entryRestoreWindow"`
+	EntrySchemaFile           string              `pkl:"entrySchemaFile"`  // yaml or json file with the schemas of each prefix
+	ExpiredEntries            string              `pkl:"expiredEntries"`   // allow | exclude | fail, how builds handle expired entries
+	ExpirationNotice          time.Duration       `pkl:"expirationNotice"` // ExpirationNotice default window of the expiring entries endpoint
+	BackupKey                 string              `pkl:"backupKey"`        // base64 AES-256 key of the backup archives
+	StorageBackend            string              `pkl:"storageBackend"`   // aws | local, store of a migration target
+	LocalDir                  string              `pkl:"localDir"`         // LocalDir directory of the local backend files
+	LocalKey                  string              `pkl:"localKey"`         // LocalKey base64 AES-256 key of the local secrets
+	SnapshotBackend           string              `pkl:"snapshotBackend"`  // s3 | local, store of the stage snapshots
 }
 
 //func NewConfigFromPkl()  {
@@ -58,7 +86,28 @@ type Config struct {
 //}
 
 func NewConfigFromEnv() *Config {
+	return newConfig(os.LookupEnv)
+}
+
+// NewTargetConfigFromEnv config of the migration target, NBOX_TARGET_<variable> overrides
+// each variable of the service, e.g. NBOX_TARGET_NBOX_ENTRIES_TABLE_NAME or NBOX_TARGET_AWS_REGION
+func NewTargetConfigFromEnv() *Config {
+	return newConfig(func(key string) (string, bool) {
+		if value, exists := os.LookupEnv("NBOX_TARGET_" + key); exists {
+			return value, exists
+		}
+		return os.LookupEnv(key)
+	})
+}
+
+func newConfig(lookup func(key string) (string, bool)) *Config {
 	var prefixes []string
+	env := func(key string, defaultValue string) string { return envLookup(lookup, key, defaultValue) }
+	envBool := func(key string) bool { return boolValue(env(key, "false")) }
+	envList := func(key string) []string { return listValue(env(key, "")) }
+	envDuration := func(key string, defaultValue time.Duration) time.Duration {
+		return durationValue(key, env(key, defaultValue.String()), defaultValue)
+	}
 
 	defaultPrefix := env("NBOX_DEFAULT_PREFIX", "global")
 
@@ -74,18 +123,55 @@ func NewConfigFromEnv() *Config {
 		EntryTableName:            env("NBOX_ENTRIES_TABLE_NAME", "nbox-entry-table"),
 		TrackingEntryTableName:    env("NBOX_TRACKING_ENTRIES_TABLE_NAME", "nbox-tracking-entry-table"),
 		BoxTableName:              env("NBOX_BOX_TABLE_NAME", "nbox-box-table"),
+		UsageTableName:            env("NBOX_USAGE_TABLE_NAME", "nbox-usage-table"),
+		SearchTableName:           env("NBOX_SEARCH_TABLE_NAME", "nbox-search-table"),
+		TrashTableName:            env("NBOX_TRASH_TABLE_NAME", "nbox-trash-table"),
 		AccountId:                 env("ACCOUNT_ID", ""),
 		RegionName:                env("AWS_REGION", "us-east-1"),
-		ParameterStoreDefaultTier: env("NBOX_PARAMETER_STORE_DEFAULT_TIER", "Standard"), // Standard | Advanced
+		AwsEndpoint:               env("NBOX_AWS_ENDPOINT", ""),
+		StageConfigFile:           env("NBOX_STAGE_CONFIG_FILE", ""),
+		ParameterStoreDefaultTier: env("NBOX_PARAMETER_STORE_DEFAULT_TIER", "Standard"), // Standard | Advanced | Intelligent-Tiering
 		ParameterStoreKeyId:       env("NBOX_PARAMETER_STORE_KEY_ID", ""),               // KMS KEY ID
+		ExpirationPolicies:        envBool("NBOX_PARAMETER_STORE_EXPIRATION_POLICIES"),
 		ParameterShortArn:         envBool("NBOX_PARAMETER_STORE_SHORT_ARN"),
+		SecretBackend:             env("NBOX_SECRET_BACKEND", "ssm"),
+		SecretsManagerPrefixes:    envList("NBOX_SECRETS_MANAGER_PREFIXES"),
+		SecretsManagerKeyId:       env("NBOX_SECRETS_MANAGER_KEY_ID", ""), // KMS KEY ID
 		DefaultPrefix:             defaultPrefix,
 		AllowedPrefixes:           prefixes,
+		ProtectedPrefixes:         envList("NBOX_PROTECTED_PREFIXES"),
+		PrivilegedUsers:           envList("NBOX_PRIVILEGED_USERS"),
+		PrivilegedRole:            env("NBOX_PRIVILEGED_ROLE", "admin"),
+		UserRoles:                 rolesValue(env("NBOX_USER_ROLES", "{}")),
+		ConfirmationKey:           env("NBOX_CONFIRMATION_KEY", ""),
+		PrefixDelete:              boolValue(env("NBOX_PREFIX_DELETE", "true")),
+		BoxRestoreWindow:          envDuration("NBOX_BOX_RESTORE_WINDOW", 30*24*time.Hour),
+		EntryRestoreWindow:        envDuration("NBOX_ENTRY_RESTORE_WINDOW", 30*24*time.Hour),
+		EntrySchemaFile:           env("NBOX_ENTRY_SCHEMA_FILE", ""),
+		ExpiredEntries:            env("NBOX_EXPIRED_ENTRIES", "allow"),
+		ExpirationNotice:          envDuration("NBOX_EXPIRATION_NOTICE", 14*24*time.Hour),
+		BackupKey:                 env("NBOX_BACKUP_KEY", ""),
+		StorageBackend:            env("NBOX_STORAGE_BACKEND", "aws"),
+		LocalDir:                  env("NBOX_LOCAL_DIR", "nbox-data"),
+		LocalKey:                  env("NBOX_LOCAL_KEY", ""),
+		SnapshotBackend:           env("NBOX_SNAPSHOT_BACKEND", "s3"),
 	}
 }
 
-func env(key string, defaultValue string) string {
-	value, exists := os.LookupEnv(key)
+// StoredKey key as the entries backend writes it, lowercase and under the default prefix
+// when it isn't under an allowed prefix
+func (c *Config) StoredKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(strings.ToLower(key)), "/")
+	for _, prefix := range c.AllowedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return key
+		}
+	}
+	return fmt.Sprintf("%s/%s", strings.Trim(c.DefaultPrefix, "/"), key)
+}
+
+func envLookup(lookup func(key string) (string, bool), key string, defaultValue string) string {
+	value, exists := lookup(key)
 	if !exists || strings.TrimSpace(value) == "" {
 		return defaultValue
 	}
@@ -101,8 +187,37 @@ func env(key string, defaultValue string) string {
 //	return valueInt
 //}
 
-func envBool(key string) bool {
-	s := env(key, "false")
+func listValue(value string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(value, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// rolesValue json object with the roles of each user, e.g. {"alice": ["admin"]}
+func rolesValue(value string) map[string][]string {
+	roles := map[string][]string{}
+	if err := json.Unmarshal([]byte(value), &roles); err != nil {
+		log.Printf("Err invalid user roles, no roles assigned. %v\n", err)
+		return map[string][]string{}
+	}
+	return roles
+}
+
+// durationValue go duration of the variable, e.g. 720h, the default one when it's invalid
+func durationValue(key, value string, defaultValue time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Printf("Err invalid duration %s=%q, using %s. %v\n", key, value, defaultValue, err)
+		return defaultValue
+	}
+	return duration
+}
+
+func boolValue(s string) bool {
 	v, err := strconv.ParseBool(s)
 	if err != nil {
 		return false
@@ -0,0 +1,99 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StageConfig AWS account, region and resources of the entries, templates and secrets
+// of a stage, empty fields keep the value of the service
+type StageConfig struct {
+	RoleArn                string `yaml:"roleArn"`    // RoleArn assumed with the credentials of the service
+	ExternalId             string `yaml:"externalId"` // ExternalId of the assume role, when the role requires it
+	Region                 string `yaml:"region"`
+	AccountId              string `yaml:"accountId"`
+	Endpoint               string `yaml:"endpoint"` // Endpoint of every service of the stage, e.g. a LocalStack container
+	ParameterStoreKeyId    string `yaml:"parameterStoreKeyId"`
+	SecretsManagerKeyId    string `yaml:"secretsManagerKeyId"`
+	EntryTableName         string `yaml:"entryTableName"`
+	TrackingEntryTableName string `yaml:"trackingEntryTableName"`
+	TrashTableName         string `yaml:"trashTableName"`
+	BoxTableName           string `yaml:"boxTableName"`
+	UsageTableName         string `yaml:"usageTableName"`
+	SearchTableName        string `yaml:"searchTableName"`
+	BucketName             string `yaml:"bucketName"` // BucketName of the templates and snapshots of the stage
+}
+
+// LoadStageConfigs stages of the yaml or json file by name, none without file
+func LoadStageConfigs(file string) (map[string]StageConfig, error) {
+	stages := map[string]StageConfig{}
+	if file == "" {
+		return stages, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// yaml is a superset of json, both formats are accepted
+	if err = yaml.Unmarshal(content, &stages); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	cleaned := make(map[string]StageConfig, len(stages))
+	for name, stage := range stages {
+		if stage.RoleArn != "" {
+			account, err := roleAccount(stage.RoleArn)
+			if err != nil {
+				return nil, fmt.Errorf("%s: stage %s: %w", file, name, err)
+			}
+			// the account of the stage is the account of the role, keys and resources are read there
+			if stage.AccountId == "" {
+				stage.AccountId = account
+			}
+			if stage.AccountId != account {
+				return nil, fmt.Errorf("%s: stage %s: accountId %s isn't the account of the role %s", file, name, stage.AccountId, stage.RoleArn)
+			}
+		}
+		cleaned[strings.Trim(name, "/")] = stage
+	}
+	return cleaned, nil
+}
+
+// roleAccount account of an IAM role ARN, arn:<partition>:iam::<account>:role/<name>
+func roleAccount(roleArn string) (string, error) {
+	components := strings.SplitN(roleArn, ":", 6)
+	if len(components) != 6 || components[0] != "arn" || components[2] != "iam" || components[4] == "" ||
+		!strings.HasPrefix(components[5], "role/") {
+		return "", fmt.Errorf("invalid roleArn %s", roleArn)
+	}
+	return components[4], nil
+}
+
+// ForStage copy of the config with the region, account, keys and resources of the stage
+func (c *Config) ForStage(stage StageConfig) *Config {
+	config := *c
+	override := func(value *string, stageValue string) {
+		if stageValue != "" {
+			*value = stageValue
+		}
+	}
+
+	override(&config.RegionName, stage.Region)
+	override(&config.AccountId, stage.AccountId)
+	override(&config.AwsEndpoint, stage.Endpoint)
+	override(&config.ParameterStoreKeyId, stage.ParameterStoreKeyId)
+	override(&config.SecretsManagerKeyId, stage.SecretsManagerKeyId)
+	override(&config.EntryTableName, stage.EntryTableName)
+	override(&config.TrackingEntryTableName, stage.TrackingEntryTableName)
+	override(&config.TrashTableName, stage.TrashTableName)
+	override(&config.BoxTableName, stage.BoxTableName)
+	override(&config.UsageTableName, stage.UsageTableName)
+	override(&config.SearchTableName, stage.SearchTableName)
+	override(&config.BucketName, stage.BucketName)
+
+	return &config
+}
@@ -10,7 +10,12 @@ type TemplateAdapter interface {
 	UpsertBox(ctx context.Context, box *models.Box) []string
 	BoxExists(ctx context.Context, service string, stage string, template string) (bool, error)
 	RetrieveBox(ctx context.Context, service string, stage string, template string) ([]byte, error)
-	List(ctx context.Context) ([]models.Box, error)
+	RetrieveStage(ctx context.Context, service string, stage string) (*models.Stage, error)
+	DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error)
+	RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error)
+	List(ctx context.Context, filter models.BoxFilter) (*models.BoxPage, error)
+	UpsertPartial(ctx context.Context, name string, value []byte) error
+	RetrievePartial(ctx context.Context, name string) ([]byte, error)
 }
 
 // EntryAdapter vars backend operations
@@ -19,10 +24,45 @@ type EntryAdapter interface {
 	Retrieve(ctx context.Context, key string) (*models.Entry, error)
 	List(ctx context.Context, prefix string) ([]models.Entry, error)
 	Delete(ctx context.Context, key string) error
+	Purge(ctx context.Context, key string) error
+	Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error)
+	Restore(ctx context.Context, key string) ([]string, error) // Restore restored keys, with ErrRestoreWindowExpired when some expired
 	Tracking(ctx context.Context, key string) ([]models.Tracking, error)
+	Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error)
+	ImportTracking(ctx context.Context, tracking []models.Tracking) error
+	MoveTracking(ctx context.Context, from string, to string) error
 }
 
 // SecretAdapter vars encrypt
 type SecretAdapter interface {
 	Upsert(ctx context.Context, entries []models.Entry) map[string]error
+	Reference(ctx context.Context, key string) (string, error) // Reference stored in the secure entry of the key
+	Retrieve(ctx context.Context, reference string) (string, error)
+	Version(ctx context.Context, reference string) (string, error) // Version of the current value, parameter version number or secret VersionId
+	Describe(ctx context.Context, reference string) (*models.SecretMetadata, error)
+	Delete(ctx context.Context, reference string) error
+}
+
+// ParameterSource parameters of the secret store under a path, recursively
+type ParameterSource interface {
+	Parameters(ctx context.Context, path string) ([]models.ExternalParameter, error)
+}
+
+// UsageAdapter where-used index from template variables to boxes
+type UsageAdapter interface {
+	Replace(ctx context.Context, box string, keys []string) error
+	Usages(ctx context.Context, key string) ([]string, error)
+}
+
+// SearchAdapter inverted index of entry keys, values and labels
+type SearchAdapter interface {
+	Replace(ctx context.Context, key string, terms []string) error
+	Search(ctx context.Context, term string, prefix string) ([]string, error)
+}
+
+// SnapshotAdapter named snapshots of a stage
+type SnapshotAdapter interface {
+	Save(ctx context.Context, snapshot *models.Snapshot) error
+	Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error)
+	List(ctx context.Context, stage string) ([]models.SnapshotSummary, error)
 }
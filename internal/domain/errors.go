@@ -0,0 +1,8 @@
+package domain
+
+import "errors"
+
+var (
+	ErrRestoreWindowExpired = errors.New("restore window expired")
+	ErrInvalidCursor        = errors.New("invalid cursor")
+)
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Backup content of the archive of an installation. Entries keep their full key and
+// secure entries their reference, the decrypted secrets are only included on request.
+type Backup struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"createdAt"`
+	CreatedBy string            `json:"createdBy"`
+	Entries   []Entry           `json:"entries"`
+	Secrets   map[string]string `json:"secrets,omitempty"` // Secrets decrypted value by key
+	Tracking  []Tracking        `json:"tracking"`
+	Templates []BackupTemplate  `json:"templates"`
+}
+
+type BackupTemplate struct {
+	Stage string `json:"stage"`
+	SnapshotTemplate
+}
+
+// RestoreReport keys and boxes written and skipped by a restore
+type RestoreReport struct {
+	Mode      string   `json:"mode"`
+	Entries   int      `json:"entries"`
+	Templates int      `json:"templates"`
+	Tracking  int      `json:"tracking"`
+	Skipped   []string `json:"skipped"`
+	Warnings  []string `json:"warnings"`
+}
@@ -1,15 +1,116 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Box struct {
-	Service string           `json:"service"`
-	Stage   map[string]Stage `json:"stage"`
+	Service    string           `json:"service"`
+	Stage      map[string]Stage `json:"stage"`
+	Resolution []string         `json:"resolution,omitempty"` // default resolution chain of the stages
 }
 
 type Stage struct {
-	Template Template `json:"template"`
+	Template   *Template           `json:"template,omitempty"` // single template, same as one item of Templates
+	Templates  []Template          `json:"templates,omitempty"`
+	Variables  map[string]Variable `json:"variables,omitempty"`  // entries stored under stage/service/
+	Resolution []string            `json:"resolution,omitempty"` // prefixes looked up when a variable is missing
+}
+
+// GetTemplates templates of the stage, Template is included when it's set
+func (s *Stage) GetTemplates() []Template {
+	templates := make([]Template, 0, len(s.Templates)+1)
+	if s.Template != nil {
+		templates = append(templates, *s.Template)
+	}
+	return append(templates, s.Templates...)
+}
+
+// Variable box-scoped variable, value may be any JSON scalar
+type Variable struct {
+	Value  interface{} `json:"value"`
+	Secure bool        `json:"secure,omitempty"`
+}
+
+func (v Variable) String() string {
+	switch value := v.Value.(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	default:
+		out, _ := json.Marshal(value)
+		return string(out)
+	}
 }
 
 type Template struct {
-	Name  string `json:"name" dynamodbav:"path"` // s3 path
-	Value string `json:"value" dynamodbav:"value"`
+	Name       string      `json:"name" dynamodbav:"path"` // s3 path
+	Value      string      `json:"value" dynamodbav:"value"`
+	Parameters []Parameter `json:"parameters,omitempty" dynamodbav:"parameters,omitempty"`
+}
+
+// Parameter :arg declared by a template, validated against the build querystring
+type Parameter struct {
+	Name     string   `json:"name" dynamodbav:"name"`
+	Type     string   `json:"type,omitempty" dynamodbav:"type,omitempty"` // string | int | float | bool
+	Default  string   `json:"default,omitempty" dynamodbav:"default,omitempty"`
+	Required bool     `json:"required,omitempty" dynamodbav:"required,omitempty"`
+	Allowed  []string `json:"allowed,omitempty" dynamodbav:"allowed,omitempty"`
+	Pattern  string   `json:"pattern,omitempty" dynamodbav:"pattern,omitempty"`
+}
+
+// BuildResult built template and the key each placeholder was resolved from
+type BuildResult struct {
+	Template string            `json:"template"`
+	Sources  map[string]string `json:"sources"`
+}
+
+type BoxResult struct {
+	Boxes     []string `json:"boxes"`
+	Variables []string `json:"variables,omitempty"`
+	Warnings  []string `json:"warnings"`
+}
+
+// TemplateVariable placeholder found in a template and how it resolves
+type TemplateVariable struct {
+	Placeholder string   `json:"placeholder"`
+	Path        string   `json:"path"`
+	Exists      bool     `json:"exists"`
+	Secure      bool     `json:"secure"`
+	Source      string   `json:"source,omitempty"`
+	References  []string `json:"references,omitempty"` // References keys read through ${ref:...} of the value
+}
+
+type TemplateInspection struct {
+	Template   string             `json:"template"`
+	Variables  []TemplateVariable `json:"variables"`
+	UnusedArgs []string           `json:"unusedArgs"`
+	Warnings   []string           `json:"warnings"`
+}
+
+// BoxFilter filters of the box listing, an empty Service and Stage lists every box
+type BoxFilter struct {
+	Service   string
+	Stage     string
+	Cursor    string // Cursor returned by the previous page
+	Limit     int
+	Ascending bool // oldest updated first, newest first by default
+}
+
+// BoxSummary one template of the box listing
+type BoxSummary struct {
+	Service    string      `json:"service"`
+	Stage      string      `json:"stage"`
+	Template   string      `json:"template"`
+	Path       string      `json:"path"`
+	Parameters []Parameter `json:"parameters,omitempty"`
+	Resolution []string    `json:"resolution,omitempty"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+}
+
+type BoxPage struct {
+	Boxes  []BoxSummary `json:"boxes"`
+	Cursor string       `json:"cursor,omitempty"` // empty on the last page
 }
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// SecretMetadata current state of the parameter behind a secure entry
+type SecretMetadata struct {
+	Name             string    `json:"name"`
+	Version          int64     `json:"version"`
+	VersionId        string    `json:"versionId,omitempty"` // VersionId current version of a Secrets Manager secret
+	LastModifiedAt   time.Time `json:"lastModifiedAt"`
+	LastModifiedUser string    `json:"lastModifiedUser,omitempty"`
+}
+
+// CurrentVersion version of the parameter or secret, as recorded in the history
+func (m *SecretMetadata) CurrentVersion() string {
+	if m.VersionId != "" {
+		return m.VersionId
+	}
+	return strconv.FormatInt(m.Version, 10)
+}
+
+// DriftReport secure entries of the prefix whose reference and parameter don't agree.
+// Dangling references a missing parameter, Changed parameters were modified after the
+// last write through nbox and Format references aren't in the configured format.
+type DriftReport struct {
+	Prefix   string      `json:"prefix"`
+	Checked  int         `json:"checked"`
+	Dangling []DriftItem `json:"dangling"`
+	Changed  []DriftItem `json:"changed"`
+	Format   []DriftItem `json:"format"`
+	Repaired []string    `json:"repaired"`
+	Warnings []string    `json:"warnings"`
+}
+
+type DriftItem struct {
+	Key       string          `json:"key"`
+	Reference string          `json:"reference"`
+	Expected  string          `json:"expected,omitempty"`  // Expected reference of the key with the current config
+	UpdatedAt *time.Time      `json:"updatedAt,omitempty"` // UpdatedAt last write through nbox
+	Version   string          `json:"version,omitempty"`   // Version of the secret recorded by the last write through nbox
+	User      string          `json:"user,omitempty"`      // User AWS principal recorded by the last write through nbox
+	Parameter *SecretMetadata `json:"parameter,omitempty"`
+}
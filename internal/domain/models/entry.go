@@ -6,24 +6,173 @@ import (
 )
 
 type Entry struct {
-	Path   string `json:"path"`
-	Key    string `json:"key"`
-	Value  string `json:"value"`
-	Secure bool   `json:"secure"`
+	Path     string `json:"path"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Secure   bool   `json:"secure"`
+	Resolved string `json:"resolved,omitempty"` // value with its ${ref:...} expressions resolved
+
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Link        string            `json:"link,omitempty"`
+	Schema      *ValueSchema      `json:"schema,omitempty"` // Schema declared type of the value
+	ExpiresAt   *time.Time        `json:"expiresAt,omitempty"`
+	Expired     bool              `json:"expired,omitempty"` // Expired read only, ExpiresAt is in the past
+	Clear       []string          `json:"clear,omitempty"`   // Clear write only, metadata fields the upsert removes
+
+	SecretVersion string `json:"-"` // SecretVersion version of the secret written with the entry, kept in the history
+	SecretUser    string `json:"-"` // SecretUser AWS principal that wrote that version
 }
 
 func (e *Entry) String() string {
 	return fmt.Sprintf("Key: %s. Value: %s", e.Key, e.Value)
 }
 
+// Describe copies the description, owner, labels and link of the metadata
+func (e *Entry) Describe(metadata Metadata) {
+	e.Description = metadata.Description
+	e.Owner = metadata.Owner
+	e.Labels = metadata.Labels
+	e.Link = metadata.Link
+	e.Schema = metadata.Schema
+	e.ExpiresAt = metadata.ExpiresAt
+	e.Expired = metadata.ExpiresAt != nil && !metadata.ExpiresAt.After(time.Now())
+}
+
+// Metadata entry description, owner, labels and link
+func (e *Entry) Metadata() Metadata {
+	return Metadata{
+		Secure:      e.Secure,
+		Description: e.Description,
+		Owner:       e.Owner,
+		Labels:      e.Labels,
+		Link:        e.Link,
+		Schema:      e.Schema,
+		ExpiresAt:   e.ExpiresAt,
+
+		SecretVersion: e.SecretVersion,
+		SecretUser:    e.SecretUser,
+	}
+}
+
+// EntryFilter filters of the entry listing, every label must match.
+// A label with an empty value only requires the label to be set.
+type EntryFilter struct {
+	Owner  string
+	Labels map[string]string
+}
+
+func (f EntryFilter) Match(entry Entry) bool {
+	if f.Owner != "" && f.Owner != entry.Owner {
+		return false
+	}
+	for k, v := range f.Labels {
+		label, ok := entry.Labels[k]
+		if !ok || (v != "" && v != label) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrefixDelete keys removed by a prefix delete. The dry run returns the token that
+// must be sent back to confirm the delete.
+type PrefixDelete struct {
+	Prefix    string   `json:"prefix"`
+	Keys      []string `json:"keys"`
+	Token     string   `json:"token"`
+	DryRun    bool     `json:"dryRun"`
+	Protected bool     `json:"protected"` // Protected only privileged users can confirm it
+	Warnings  []string `json:"warnings"`
+}
+
+// TrashEntry soft deleted entry, it can be restored until PurgeAt
+type TrashEntry struct {
+	Entry
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+// TrashRestore keys restored from the trash, the keys past the restore window are
+// skipped and reported as warnings
+type TrashRestore struct {
+	Restored []string `json:"restored"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
 type Tracking struct {
 	Key       string    `json:"key"`
 	Value     string    `json:"value"`
 	Secure    bool      `json:"secure"`
 	UpdatedAt time.Time `json:"updatedAt"`
 	UpdatedBy string    `json:"updatedBy"`
+	Action    string    `json:"action,omitempty"`
+	MovedFrom string    `json:"movedFrom,omitempty"` // MovedFrom key the record was copied from by a move
+	MovedTo   string    `json:"movedTo,omitempty"`   // MovedTo key the entry was moved to
+
+	SecretVersion string `json:"secretVersion,omitempty"` // SecretVersion version of the secret written by this record
+	SecretUser    string `json:"secretUser,omitempty"`    // SecretUser AWS principal that wrote that version
+}
+
+// TrackingFilter activity of every key, the zero To is now
+type TrackingFilter struct {
+	User   string
+	Prefix string
+	Action string
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
+}
+
+// TrackingPage page of the activity, Cursor is empty on the last page
+type TrackingPage struct {
+	Tracking []Tracking `json:"tracking"`
+	Cursor   string     `json:"cursor,omitempty"`
 }
 
 func (e *Tracking) String() string {
 	return fmt.Sprintf("Key: %s. Value: %s", e.Key, e.Value)
 }
+
+// ValueSchema type of an entry value, checked on upsert
+type ValueSchema struct {
+	Type    string   `json:"type,omitempty" dynamodbav:"Type,omitempty"` // string | int | float | bool | duration | url | email | json | enum
+	Allowed []string `json:"allowed,omitempty" dynamodbav:"Allowed,omitempty"`
+	Pattern string   `json:"pattern,omitempty" dynamodbav:"Pattern,omitempty"`
+}
+
+// PrefixSchema keys required under a prefix and the schema of its values
+type PrefixSchema struct {
+	Required []string               `json:"required,omitempty"`
+	Keys     map[string]ValueSchema `json:"keys,omitempty"`
+}
+
+// MoveCommand moves a key or every key under a prefix
+type MoveCommand struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Rewrite bool   `json:"rewrite,omitempty"` // Rewrite the placeholders of the templates using the keys
+	DryRun  bool   `json:"dryRun,omitempty"`
+}
+
+type KeyMove struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Secure bool   `json:"secure"`
+}
+
+// TemplateRewrite placeholders of a box template replaced by a move
+type TemplateRewrite struct {
+	Box          string            `json:"box"`
+	Placeholders map[string]string `json:"placeholders"` // Placeholders old -> new
+}
+
+type MoveResult struct {
+	DryRun    bool              `json:"dryRun"`
+	Moves     []KeyMove         `json:"moves"`
+	Templates []TemplateRewrite `json:"templates"`
+	Warnings  []string          `json:"warnings"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// ExternalParameter parameter found in the secret store outside nbox, the value of
+// secure parameters isn't read
+type ExternalParameter struct {
+	Name           string    `json:"name"`
+	ARN            string    `json:"arn"`
+	Type           string    `json:"type"` // String | StringList | SecureString
+	Value          string    `json:"value,omitempty"`
+	Version        int64     `json:"version"`
+	LastModifiedAt time.Time `json:"lastModifiedAt"`
+}
+
+// ImportReport entries created from the parameters of a path. Parameters already imported
+// with the same value are unchanged, the ones whose key exists with another value are conflicts.
+type ImportReport struct {
+	Path      string           `json:"path"`
+	DryRun    bool             `json:"dryRun"`
+	Imported  []string         `json:"imported"`
+	Unchanged int              `json:"unchanged"`
+	Conflicts []ImportConflict `json:"conflicts"`
+}
+
+type ImportConflict struct {
+	Key       string `json:"key"`
+	Parameter string `json:"parameter"`
+	Reason    string `json:"reason"`
+}
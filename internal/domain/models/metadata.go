@@ -10,4 +10,14 @@ type Metadata struct {
 	Action    string    `json:"action" dynamodbav:"Action,omitempty"`
 	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"UpdatedAt,unixtime"`
 	UpdatedBy string    `json:"updatedBy" dynamodbav:"UpdatedBy,omitempty"`
+
+	Description string            `json:"description,omitempty" dynamodbav:"Description,omitempty"`
+	Owner       string            `json:"owner,omitempty" dynamodbav:"Owner,omitempty"` // Owner team
+	Labels      map[string]string `json:"labels,omitempty" dynamodbav:"Labels,omitempty"`
+	Link        string            `json:"link,omitempty" dynamodbav:"Link,omitempty"` // Link documentation
+	Schema      *ValueSchema      `json:"schema,omitempty" dynamodbav:"Schema,omitempty"`
+	ExpiresAt   *time.Time        `json:"expiresAt,omitempty" dynamodbav:"ExpiresAt,omitempty,unixtime"`
+
+	SecretVersion string `json:"secretVersion,omitempty" dynamodbav:"SecretVersion,omitempty"` // SecretVersion version of the secret written by nbox
+	SecretUser    string `json:"secretUser,omitempty" dynamodbav:"SecretUser,omitempty"`       // SecretUser AWS principal that wrote the secret
 }
@@ -0,0 +1,34 @@
+package models
+
+// MigrationCheckpoint progress of a migration, a resumed migration skips what is done
+type MigrationCheckpoint struct {
+	Done map[string]bool `json:"done"` // Done entry keys and box:<path> of the templates already copied
+}
+
+// MigrationReport items copied by the run and the verification of both backends
+type MigrationReport struct {
+	Entries      int             `json:"entries"`
+	Secrets      int             `json:"secrets"`
+	Templates    int             `json:"templates"`
+	Tracking     int             `json:"tracking"`
+	Resumed      int             `json:"resumed"` // Resumed items skipped because the checkpoint has them
+	Verification MigrationVerify `json:"verification"`
+	Warnings     []string        `json:"warnings"`
+}
+
+// MigrationVerify counts and hashes of the entries and templates of each backend,
+// secure entries are compared by their secret value
+type MigrationVerify struct {
+	SourceEntries   int      `json:"sourceEntries"`
+	TargetEntries   int      `json:"targetEntries"`
+	SourceTemplates int      `json:"sourceTemplates"`
+	TargetTemplates int      `json:"targetTemplates"`
+	SourceHash      string   `json:"sourceHash"`
+	TargetHash      string   `json:"targetHash"`
+	Mismatches      []string `json:"mismatches"`
+}
+
+// Verified both backends hold the same entries and templates
+func (v MigrationVerify) Verified() bool {
+	return v.SourceHash == v.TargetHash && len(v.Mismatches) == 0
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Snapshot frozen state of a stage: its entries, the secure references with the
+// version of their parameter or secret, and the box templates of the stage
+type Snapshot struct {
+	Name      string             `json:"name"`
+	Stage     string             `json:"stage"`
+	CreatedAt time.Time          `json:"createdAt"`
+	CreatedBy string             `json:"createdBy"`
+	Entries   []SnapshotEntry    `json:"entries"`
+	Templates []SnapshotTemplate `json:"templates"`
+}
+
+// SnapshotEntry entry with its full key, secure entries keep the reference
+type SnapshotEntry struct {
+	Entry
+	Version SecretVersion `json:"version,omitempty"` // Version of the secure parameter or secret
+}
+
+// SecretVersion parameter store version number or secrets manager VersionId of a secure
+// value, snapshots taken before secrets manager stored the number as json number
+type SecretVersion string
+
+func (v *SecretVersion) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	switch version := value.(type) {
+	case string:
+		*v = SecretVersion(version)
+	case json.Number:
+		*v = SecretVersion(version.String())
+	case nil:
+		*v = ""
+	default:
+		return fmt.Errorf("invalid secret version %s", data)
+	}
+	return nil
+}
+
+type SnapshotTemplate struct {
+	Service    string      `json:"service"`
+	Template   string      `json:"template"`
+	Value      string      `json:"value"` // Value base64 content of the template
+	Parameters []Parameter `json:"parameters,omitempty"`
+	Resolution []string    `json:"resolution,omitempty"`
+}
+
+// Path service/stage/template of the box
+func (t SnapshotTemplate) Path(stage string) string {
+	return t.Service + "/" + stage + "/" + t.Template
+}
+
+type SnapshotSummary struct {
+	Name      string    `json:"name"`
+	Stage     string    `json:"stage"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SnapshotDiff changes of the current state against the snapshot, Added exists
+// only in the current state and Removed only in the snapshot
+type SnapshotDiff struct {
+	Name      string   `json:"name"`
+	Stage     string   `json:"stage"`
+	Entries   DiffSet  `json:"entries"`
+	Templates DiffSet  `json:"templates"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+type DiffSet struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
@@ -19,7 +19,13 @@ type Api struct {
 	Engine http.Handler
 }
 
-func NewApi(box *handlers.BoxHandler, entry *handlers.EntryHandler, healthCheck *health.Health) *Api {
+func NewApi(
+	box *handlers.BoxHandler,
+	entry *handlers.EntryHandler,
+	snapshot *handlers.SnapshotHandler,
+	backup *handlers.BackupHandler,
+	healthCheck *health.Health,
+) *Api {
 
 	corsConfig := cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -44,15 +50,47 @@ func NewApi(box *handlers.BoxHandler, entry *handlers.EntryHandler, healthCheck
 		r.Use(auth.NewBasicAuthFromEnv("api", PrefixBasicAuthCredentials))
 		r.Post("/api/box", box.UpsertBox)
 		r.Get("/api/box", box.List)
+		r.Post("/api/box/partial", box.UpsertPartial)
+		r.Get("/api/box/partial", box.RetrievePartial)
 		r.Head("/api/box/{service}/{stage}/{template}", box.Exist)
 		r.Get("/api/box/{service}/{stage}/{template}", box.Retrieve)
 		r.Get("/api/box/{service}/{stage}/{template}/build", box.Build)
+		r.Get("/api/box/{service}/{stage}/{template}/variables", box.Variables)
+		r.Delete("/api/box/{service}", box.Delete)
+		r.Delete("/api/box/{service}/{stage}", box.Delete)
+		r.Delete("/api/box/{service}/{stage}/{template}", box.Delete)
+		r.Post("/api/box/{service}/restore", box.Restore)
+		r.Post("/api/box/{service}/{stage}/restore", box.Restore)
+		r.Post("/api/box/{service}/{stage}/{template}/restore", box.Restore)
 
 		r.Post("/api/entry", entry.Upsert)
 		r.Get("/api/entry/key", entry.GetByKey)
 		r.Get("/api/entry/prefix", entry.ListByPrefix)
 		r.Delete("/api/entry/key", entry.DeleteKey)
+		r.Delete("/api/entry/prefix", entry.DeletePrefix)
+		r.Get("/api/entry/usages", entry.Usages)
+		r.Get("/api/entry/orphans", entry.Orphans)
+		r.Get("/api/entry/validate", entry.Validate)
+		r.Get("/api/entry/expiring", entry.Expiring)
+		r.Get("/api/entry/drift", entry.Drift)
+		r.Post("/api/entry/drift/repair", entry.RepairDrift)
+		r.Post("/api/entry/import", entry.Import)
+		r.Get("/api/entry/search", entry.Search)
+		r.Post("/api/entry/search/reindex", entry.Reindex)
+		r.Post("/api/entry/move", entry.Move)
+		r.Get("/api/track", entry.Activity)
 		r.Get("/api/track/key", entry.Tracking)
+		r.Get("/api/trash", entry.Trash)
+		r.Post("/api/trash/restore", entry.Restore)
+
+		r.Get("/api/snapshot/{stage}", snapshot.List)
+		r.Post("/api/snapshot/{stage}/{name}", snapshot.Create)
+		r.Get("/api/snapshot/{stage}/{name}", snapshot.Retrieve)
+		r.Get("/api/snapshot/{stage}/{name}/diff", snapshot.Diff)
+		r.Post("/api/snapshot/{stage}/{name}/restore", snapshot.Restore)
+
+		r.Post("/api/backup", backup.Backup)
+		r.Post("/api/restore", backup.Restore)
 	})
 
 	return &Api{
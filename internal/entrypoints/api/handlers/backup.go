@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"nbox/internal/entrypoints/api/response"
+	"nbox/internal/usecases"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type BackupHandler struct {
+	backupUseCase *usecases.BackupUseCase
+}
+
+func NewBackupHandler(backupUseCase *usecases.BackupUseCase) *BackupHandler {
+	return &BackupHandler{backupUseCase: backupUseCase}
+}
+
+// Backup encrypted archive of the installation, with secrets=true the secure values are included
+func (h *BackupHandler) Backup(w http.ResponseWriter, r *http.Request) {
+	secrets, _ := strconv.ParseBool(r.URL.Query().Get("secrets"))
+
+	archive, err := h.backupUseCase.Backup(r.Context(), secrets)
+	if err != nil {
+		backupError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="nbox-%s.bak"`, time.Now().UTC().Format("20060102150405")))
+	_, _ = w.Write(archive)
+}
+
+// Restore writes the archive of the body, mode overwrite, skip or fail (default)
+func (h *BackupHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	archive, err := io.ReadAll(r.Body)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.backupUseCase.Restore(r.Context(), archive, r.URL.Query().Get("mode"))
+	if err != nil {
+		backupError(w, r, err)
+		return
+	}
+	response.Success(w, r, report)
+}
+
+func backupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, usecases.ErrBackupConflict):
+		response.Error(w, r, err, http.StatusConflict)
+	case errors.Is(err, usecases.ErrInvalidBackup):
+		response.Error(w, r, err, http.StatusBadRequest)
+	default:
+		response.Error(w, r, err, http.StatusInternalServerError)
+	}
+}
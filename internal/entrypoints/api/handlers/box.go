@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"nbox/internal/domain"
 	"nbox/internal/domain/models"
 	"nbox/internal/entrypoints/api/response"
 	"nbox/internal/usecases"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -29,7 +32,7 @@ func (b *BoxHandler) UpsertBox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := b.store.UpsertBox(ctx, &command.Payload)
+	result := b.boxUseCase.UpsertBox(ctx, &command.Payload)
 	response.Success(w, r, result)
 }
 
@@ -72,28 +75,175 @@ func (b *BoxHandler) Build(w http.ResponseWriter, r *http.Request) {
 	service := chi.URLParam(r, "service")
 	stage := chi.URLParam(r, "stage")
 	template := chi.URLParam(r, "template")
+	args := queryArgs(r)
+
+	data, err := b.boxUseCase.BuildBoxReport(ctx, service, stage, template, args, r.URL.Query().Get("expired"))
+	if errors.Is(err, usecases.ErrInvalidParameters) || errors.Is(err, usecases.ErrInvalidExpiredMode) {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, usecases.ErrInvalidOutput) || errors.Is(err, usecases.ErrEntryExpired) || errors.Is(err, usecases.ErrInvalidOverlay) ||
+		errors.Is(err, usecases.ErrInvalidPartial) || errors.Is(err, usecases.ErrReferenceCycle) || errors.Is(err, usecases.ErrReferenceNotFound) || errors.Is(err, usecases.ErrReferenceSecure) {
+		response.Error(w, r, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		response.Error(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	if explain, _ := strconv.ParseBool(r.URL.Query().Get("explain")); explain {
+		response.Success(w, r, data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(data.Template))
+}
+
+// Delete soft deletes the box templates of the service, stage or template in the path
+func (b *BoxHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	service := chi.URLParam(r, "service")
+	stage := chi.URLParam(r, "stage")
+	template := chi.URLParam(r, "template")
+
+	paths, err := b.boxUseCase.DeleteBox(ctx, service, stage, template)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(paths) == 0 {
+		response.Error(w, r, errors.New("box not found"), http.StatusNotFound)
+		return
+	}
+
+	response.Success(w, r, paths)
+}
+
+// Restore restores the soft deleted templates within the restore window
+func (b *BoxHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	service := chi.URLParam(r, "service")
+	stage := chi.URLParam(r, "stage")
+	template := chi.URLParam(r, "template")
+
+	paths, err := b.boxUseCase.RestoreBox(ctx, service, stage, template)
+	if errors.Is(err, domain.ErrRestoreWindowExpired) {
+		response.Error(w, r, err, http.StatusGone)
+		return
+	}
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(paths) == 0 {
+		response.Error(w, r, errors.New("deleted box not found"), http.StatusNotFound)
+		return
+	}
+
+	response.Success(w, r, paths)
+}
+
+func (b *BoxHandler) Variables(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	service := chi.URLParam(r, "service")
+	stage := chi.URLParam(r, "stage")
+	template := chi.URLParam(r, "template")
+
+	inspection, err := b.boxUseCase.Inspect(ctx, service, stage, template, queryArgs(r))
+	if err != nil {
+		response.Error(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	response.Success(w, r, inspection)
+}
+
+// queryArgs template :args from the querystring, path params and build options can't be overridden
+func queryArgs(r *http.Request) map[string]string {
 	args := make(map[string]string)
 
 	for key := range r.URL.Query() {
-		if key == "service" || key == "stage" || key == "template" {
+		if key == "service" || key == "stage" || key == "template" || key == "explain" || key == "expired" {
 			continue
 		}
 		args[key] = r.URL.Query().Get(key)
 	}
 
-	data, err := b.boxUseCase.BuildBox(ctx, service, stage, template, args)
+	return args
+}
+
+func (b *BoxHandler) UpsertPartial(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	command := &models.Command[models.Template]{}
+	if err := json.NewDecoder(r.Body).Decode(command); err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := usecases.ValidatePartialName(command.Payload.Name); err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(command.Payload.Value)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = b.store.UpsertPartial(ctx, command.Payload.Name, decoded); err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, map[string]string{"message": "ok"})
+}
+
+func (b *BoxHandler) RetrievePartial(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.URL.Query().Get("v")
+
+	data, err := b.store.RetrievePartial(ctx, name)
 	if err != nil {
 		response.Error(w, r, err, http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	_, _ = w.Write([]byte(data))
+	_, _ = w.Write(data)
 }
 
+// List box templates, newest updated first: ?service=&stage=&cursor=&limit=&order=asc
 func (b *BoxHandler) List(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	data, err := b.store.List(ctx)
+	query := r.URL.Query()
+
+	filter := models.BoxFilter{
+		Service:   query.Get("service"),
+		Stage:     query.Get("stage"),
+		Cursor:    query.Get("cursor"),
+		Ascending: query.Get("order") == "asc",
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 {
+			response.Error(w, r, errors.New("limit must be a positive integer"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := b.store.List(ctx, filter)
+	if errors.Is(err, domain.ErrInvalidCursor) {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		response.Error(w, r, err, http.StatusNotFound)
 		return
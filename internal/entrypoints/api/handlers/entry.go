@@ -2,20 +2,45 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
 	"nbox/internal/domain"
 	"nbox/internal/domain/models"
 	"nbox/internal/entrypoints/api/response"
 	"nbox/internal/usecases"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type EntryHandler struct {
-	entryAdapter domain.EntryAdapter
-	entryUseCase *usecases.EntryUseCase
+	entryAdapter  domain.EntryAdapter
+	entryUseCase  *usecases.EntryUseCase
+	moveUseCase   *usecases.MoveUseCase
+	importUseCase *usecases.ImportUseCase
+	config        *application.Config
 }
 
-func NewEntryHandler(entryAdapter domain.EntryAdapter, entryUseCase *usecases.EntryUseCase) *EntryHandler {
-	return &EntryHandler{entryAdapter: entryAdapter, entryUseCase: entryUseCase}
+func NewEntryHandler(
+	entryAdapter domain.EntryAdapter,
+	entryUseCase *usecases.EntryUseCase,
+	moveUseCase *usecases.MoveUseCase,
+	importUseCase *usecases.ImportUseCase,
+	config *application.Config,
+) (*EntryHandler, error) {
+	// the tokens of the prefix delete dry run must be valid in every instance and after a restart
+	if config.PrefixDelete && config.ConfirmationKey == "" {
+		return nil, errors.New("NBOX_CONFIRMATION_KEY is required by DELETE /api/entry/prefix, set it or disable the endpoint with NBOX_PREFIX_DELETE=false")
+	}
+	return &EntryHandler{
+		entryAdapter:  entryAdapter,
+		entryUseCase:  entryUseCase,
+		moveUseCase:   moveUseCase,
+		importUseCase: importUseCase,
+		config:        config,
+	}, nil
 }
 
 func (h *EntryHandler) Upsert(w http.ResponseWriter, r *http.Request) {
@@ -33,14 +58,33 @@ func (h *EntryHandler) Upsert(w http.ResponseWriter, r *http.Request) {
 	//	response.Error(w, r, err, http.StatusBadRequest)
 	//	return
 	//}
-	response.Success(w, r, h.entryUseCase.Upsert(ctx, entries))
+	// errors are reported by key, null when the entry was stored
+	results := map[string]interface{}{}
+	for key, err := range h.entryUseCase.Upsert(ctx, entries) {
+		results[key] = nil
+		if err != nil {
+			results[key] = err.Error()
+		}
+	}
+
+	response.Success(w, r, results)
 }
 
 func (h *EntryHandler) ListByPrefix(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	prefix := r.URL.Query().Get("v")
+	query := r.URL.Query()
+	filter := models.EntryFilter{Owner: query.Get("owner")}
+
+	// ?label=team:payments&label=deprecated
+	for _, label := range query["label"] {
+		if filter.Labels == nil {
+			filter.Labels = map[string]string{}
+		}
+		k, v, _ := strings.Cut(label, ":")
+		filter.Labels[k] = v
+	}
 
-	entries, err := h.entryAdapter.List(ctx, prefix)
+	entries, err := h.entryUseCase.List(ctx, query.Get("v"), filter)
 	if err != nil {
 		response.Error(w, r, err, http.StatusBadRequest)
 		return
@@ -52,7 +96,10 @@ func (h *EntryHandler) ListByPrefix(w http.ResponseWriter, r *http.Request) {
 func (h *EntryHandler) GetByKey(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	key := r.URL.Query().Get("v")
-	entry, err := h.entryAdapter.Retrieve(ctx, key)
+	resolve, _ := strconv.ParseBool(r.URL.Query().Get("resolve"))
+	reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal"))
+
+	entry, err := h.entryUseCase.Retrieve(ctx, key, resolve, reveal)
 	if err != nil {
 		response.Error(w, r, err, http.StatusBadRequest)
 		return
@@ -64,13 +111,295 @@ func (h *EntryHandler) GetByKey(w http.ResponseWriter, r *http.Request) {
 func (h *EntryHandler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	key := r.URL.Query().Get("v")
-	err := h.entryAdapter.Delete(ctx, key)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	warnings, err := h.entryUseCase.Delete(ctx, key, force)
+	if errors.Is(err, usecases.ErrEntryInUse) {
+		response.Error(w, r, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, map[string]interface{}{"message": "ok", "warnings": warnings})
+}
+
+// DeletePrefix removes the prefix and its nested keys. Without token only the
+// listing and the token that confirms it are returned.
+func (h *EntryHandler) DeletePrefix(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefix := r.URL.Query().Get("v")
+	token := r.URL.Query().Get("token")
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	result, err := h.entryUseCase.DeletePrefix(ctx, prefix, token, force)
+	switch {
+	case errors.Is(err, usecases.ErrProtectedPrefix):
+		response.Error(w, r, err, http.StatusForbidden)
+		return
+	case errors.Is(err, usecases.ErrInvalidConfirmation), errors.Is(err, usecases.ErrEntryInUse):
+		response.Error(w, r, err, http.StatusConflict)
+		return
+	case err != nil:
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, result)
+}
+
+// Trash soft deleted entries under the prefix that can still be restored
+func (h *EntryHandler) Trash(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefix := r.URL.Query().Get("v")
+
+	entries, err := h.entryUseCase.Trash(ctx, prefix)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, entries)
+}
+
+// Restore restores the soft deleted key and the keys under it within the restore window
+func (h *EntryHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := r.URL.Query().Get("v")
+
+	result, err := h.entryUseCase.Restore(ctx, key)
+	switch {
+	case errors.Is(err, domain.ErrRestoreWindowExpired):
+		response.Error(w, r, err, http.StatusGone)
+		return
+	case errors.Is(err, usecases.ErrRestoreConflict):
+		response.Error(w, r, err, http.StatusConflict)
+		return
+	case err != nil:
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(result.Restored) == 0 {
+		response.Error(w, r, errors.New("deleted entry not found"), http.StatusNotFound)
+		return
+	}
+
+	response.Success(w, r, result)
+}
+
+func (h *EntryHandler) Usages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := r.URL.Query().Get("v")
+
+	boxes, err := h.entryUseCase.Usages(ctx, key)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, boxes)
+}
+
+func (h *EntryHandler) Orphans(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefix := r.URL.Query().Get("v")
+
+	keys, err := h.entryUseCase.Orphans(ctx, prefix)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, keys)
+}
+
+// Import creates entries from the parameter store hierarchy of the path, with dryRun
+// only the entries that would be created are reported
+func (h *EntryHandler) Import(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+	if strings.Trim(path, "/ ") == "" {
+		response.Error(w, r, errors.New("path is required"), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.importUseCase.Import(r.Context(), path, dryRun)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, report)
+}
+
+// Drift secure entries of the prefix whose reference and parameter don't agree
+func (h *EntryHandler) Drift(w http.ResponseWriter, r *http.Request) {
+	h.drift(w, r, false)
+}
+
+// RepairDrift fixes the references and re-imports the parameters changed outside nbox
+func (h *EntryHandler) RepairDrift(w http.ResponseWriter, r *http.Request) {
+	h.drift(w, r, true)
+}
+
+func (h *EntryHandler) drift(w http.ResponseWriter, r *http.Request, repair bool) {
+	report, err := h.entryUseCase.Drift(r.Context(), r.URL.Query().Get("v"), repair)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, report)
+}
+
+func (h *EntryHandler) Validate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefix := r.URL.Query().Get("v")
+
+	violations, err := h.entryUseCase.Validate(ctx, prefix)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, map[string]interface{}{"violations": violations})
+}
+
+// Expiring entries under the prefix ?v= expiring ?within=14d, the configured notice by default
+func (h *EntryHandler) Expiring(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	within := h.config.ExpirationNotice
+	if value := query.Get("within"); value != "" {
+		var err error
+		if within, err = usecases.ParseWithin(value); err != nil {
+			response.Error(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := h.entryUseCase.Expiring(ctx, query.Get("v"), within)
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, entries)
+}
+
+// Search entries across every stage ?q=&in=key,value,label&prefix=
+func (h *EntryHandler) Search(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	var in []string
+	for _, field := range query["in"] {
+		in = append(in, strings.Split(field, ",")...)
+	}
+
+	entries, err := h.entryUseCase.Search(ctx, query.Get("q"), in, query.Get("prefix"))
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, entries)
+}
+
+// Reindex rebuilds the search index of the entries under the prefix ?v=
+func (h *EntryHandler) Reindex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	count, err := h.entryUseCase.Reindex(ctx, r.URL.Query().Get("v"))
+	if err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, map[string]interface{}{"indexed": count})
+}
+
+// Move renames a key or prefix, with dryRun only the preview is returned
+func (h *EntryHandler) Move(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	command := models.MoveCommand{}
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.moveUseCase.Move(ctx, command)
+	switch {
+	case errors.Is(err, usecases.ErrMoveNotFound):
+		response.Error(w, r, err, http.StatusNotFound)
+		return
+	case errors.Is(err, usecases.ErrMoveConflict):
+		response.Error(w, r, err, http.StatusConflict)
+		return
+	case err != nil:
+		response.Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	response.Success(w, r, result)
+}
+
+// Activity tracking of every key filtered by user, prefix, action and time range, newest first
+func (h *EntryHandler) Activity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	filter := models.TrackingFilter{
+		User:   query.Get("user"),
+		Prefix: query.Get("prefix"),
+		Action: query.Get("action"),
+		Cursor: query.Get("cursor"),
+	}
+
+	var err error
+	if filter.From, err = parseTime(query.Get("from")); err != nil {
+		response.Error(w, r, fmt.Errorf("from: %w", err), http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseTime(query.Get("to")); err != nil {
+		response.Error(w, r, fmt.Errorf("to: %w", err), http.StatusBadRequest)
+		return
+	}
+	if !filter.To.IsZero() && filter.To.Before(filter.From) {
+		response.Error(w, r, errors.New("to must be after from"), http.StatusBadRequest)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 {
+			response.Error(w, r, errors.New("limit must be a positive integer"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.entryAdapter.Activity(ctx, filter)
 	if err != nil {
 		response.Error(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	response.Success(w, r, map[string]string{"message": "ok"})
+	response.Success(w, r, page)
+}
+
+// parseTime RFC3339 time or date, the zero time when empty
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
 }
 
 func (h *EntryHandler) Tracking(w http.ResponseWriter, r *http.Request) {
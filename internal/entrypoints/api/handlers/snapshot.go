@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"nbox/internal/entrypoints/api/response"
+	"nbox/internal/usecases"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type SnapshotHandler struct {
+	snapshotUseCase *usecases.SnapshotUseCase
+}
+
+func NewSnapshotHandler(snapshotUseCase *usecases.SnapshotUseCase) *SnapshotHandler {
+	return &SnapshotHandler{snapshotUseCase: snapshotUseCase}
+}
+
+// Create freezes the current state of the stage under the name
+func (h *SnapshotHandler) Create(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := h.snapshotUseCase.Create(r.Context(), chi.URLParam(r, "stage"), chi.URLParam(r, "name"))
+	if err != nil {
+		snapshotError(w, r, err)
+		return
+	}
+	response.Success(w, r, snapshot)
+}
+
+func (h *SnapshotHandler) List(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.snapshotUseCase.List(r.Context(), chi.URLParam(r, "stage"))
+	if err != nil {
+		snapshotError(w, r, err)
+		return
+	}
+	response.Success(w, r, snapshots)
+}
+
+func (h *SnapshotHandler) Retrieve(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := h.snapshotUseCase.Retrieve(r.Context(), chi.URLParam(r, "stage"), chi.URLParam(r, "name"))
+	if err != nil {
+		snapshotError(w, r, err)
+		return
+	}
+	response.Success(w, r, snapshot)
+}
+
+// Diff changes of the current state since the snapshot
+func (h *SnapshotHandler) Diff(w http.ResponseWriter, r *http.Request) {
+	diff, err := h.snapshotUseCase.Diff(r.Context(), chi.URLParam(r, "stage"), chi.URLParam(r, "name"))
+	if err != nil {
+		snapshotError(w, r, err)
+		return
+	}
+	response.Success(w, r, diff)
+}
+
+// Restore reverts the stage to the snapshot
+func (h *SnapshotHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	diff, err := h.snapshotUseCase.Restore(r.Context(), chi.URLParam(r, "stage"), chi.URLParam(r, "name"))
+	if err != nil {
+		snapshotError(w, r, err)
+		return
+	}
+	response.Success(w, r, diff)
+}
+
+func snapshotError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, usecases.ErrSnapshotNotFound):
+		response.Error(w, r, err, http.StatusNotFound)
+	case errors.Is(err, usecases.ErrSnapshotExists):
+		response.Error(w, r, err, http.StatusConflict)
+	default:
+		response.Error(w, r, err, http.StatusBadRequest)
+	}
+}
@@ -1,6 +1,7 @@
 package problem
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -47,6 +48,12 @@ type Extension struct {
 	RequestId  string    `json:"requestId,omitempty"`
 	Timestamp  time.Time `json:"timestamp"`
 	StackTrace string    `json:"stackTrace,omitempty"`
+	Violations []string  `json:"violations,omitempty"`
+}
+
+// violations errors that carry a list of validation failures
+type violations interface {
+	Violations() []string
 }
 
 // Error implements the error interface
@@ -75,5 +82,10 @@ func NewProblem(opt ErrOptions) *ProblemDetail {
 	problem.Detail = opt.Err.Error()
 	problem.Title = opt.Kind
 
+	var v violations
+	if errors.As(opt.Err, &v) {
+		problem.Extension.Violations = v.Violations()
+	}
+
 	return problem
 }
@@ -0,0 +1,358 @@
+package usecases
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BackupVersion = 1
+	backupHeader  = "NBOXBK1" // backupHeader magic of the archive, authenticated with the content
+
+	RestoreOverwrite = "overwrite" // RestoreOverwrite existing keys and boxes are replaced
+	RestoreSkip      = "skip"      // RestoreSkip existing keys and boxes are kept
+	RestoreFail      = "fail"      // RestoreFail nothing is written when anything exists
+)
+
+var (
+	ErrBackupKey      = errors.New("invalid backup key")
+	ErrInvalidBackup  = errors.New("invalid backup archive")
+	ErrBackupConflict = errors.New("backup conflicts with existing data")
+)
+
+// BackupUseCase full archive of the installation: entries, their history, boxes and
+// optionally the decrypted secrets, encrypted with the backup key
+type BackupUseCase struct {
+	entries *EntryUseCase
+	boxes   *BoxUseCase
+	config  *application.Config
+}
+
+func NewBackupUseCase(entryUseCase *EntryUseCase, boxUseCase *BoxUseCase, config *application.Config) *BackupUseCase {
+	return &BackupUseCase{entries: entryUseCase, boxes: boxUseCase, config: config}
+}
+
+// Backup archive of every allowed prefix. With secrets the values of the secure
+// entries are read and stored in the archive, otherwise only their references.
+func (b *BackupUseCase) Backup(ctx context.Context, secrets bool) ([]byte, error) {
+	backup, err := b.collect(ctx, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return b.seal(backup)
+}
+
+func (b *BackupUseCase) collect(ctx context.Context, secrets bool) (*models.Backup, error) {
+	backup := &models.Backup{
+		Version:   BackupVersion,
+		CreatedAt: time.Now().UTC(),
+		Entries:   make([]models.Entry, 0),
+		Tracking:  make([]models.Tracking, 0),
+		Templates: make([]models.BackupTemplate, 0),
+	}
+	backup.CreatedBy, _ = ctx.Value(application.RequestUserName).(string)
+	if secrets {
+		backup.Secrets = map[string]string{}
+	}
+
+	seen := map[string]bool{}
+	for _, prefix := range b.config.AllowedPrefixes {
+		err := b.entries.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+
+			entry.Key = key
+			entry.Path = ""
+			entry.Expired = false
+			backup.Entries = append(backup.Entries, entry)
+
+			if entry.Secure && secrets {
+				value, err := b.entries.secretAdapter.Retrieve(ctx, entry.Value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				backup.Secrets[key] = value
+			}
+
+			return b.track(ctx, backup, key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter := models.BoxFilter{}
+	for {
+		page, err := b.boxes.templateAdapter.List(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, box := range page.Boxes {
+			content, err := b.boxes.templateAdapter.RetrieveBox(ctx, box.Service, box.Stage, box.Template)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", box.Path, err)
+			}
+			template := models.BackupTemplate{Stage: box.Stage, SnapshotTemplate: models.SnapshotTemplate{
+				Service:    box.Service,
+				Template:   box.Template,
+				Value:      base64.StdEncoding.EncodeToString(content),
+				Parameters: box.Parameters,
+				Resolution: box.Resolution,
+			}}
+			backup.Templates = append(backup.Templates, template)
+
+			if err = b.track(ctx, backup, "box:"+template.Path(box.Stage)); err != nil {
+				return nil, err
+			}
+		}
+
+		if page.Cursor == "" {
+			break
+		}
+		filter.Cursor = page.Cursor
+	}
+
+	sort.Slice(backup.Entries, func(i, j int) bool { return backup.Entries[i].Key < backup.Entries[j].Key })
+
+	return backup, nil
+}
+
+func (b *BackupUseCase) track(ctx context.Context, backup *models.Backup, key string) error {
+	tracking, err := b.entries.entryAdapter.Tracking(ctx, key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	for _, t := range tracking {
+		t.Key = key
+		backup.Tracking = append(backup.Tracking, t)
+	}
+	return nil
+}
+
+// Restore writes the archive content. Existing keys and boxes are replaced, kept or
+// make the whole restore fail depending on the mode. Secure entries archived with
+// their secret are written to the secret store again, the others keep the reference
+// to the existing parameter.
+func (b *BackupUseCase) Restore(ctx context.Context, archive []byte, mode string) (*models.RestoreReport, error) {
+	if mode == "" {
+		mode = RestoreFail
+	}
+	if mode != RestoreOverwrite && mode != RestoreSkip && mode != RestoreFail {
+		return nil, fmt.Errorf("%w: unknown mode %s", ErrInvalidBackup, mode)
+	}
+
+	backup, err := b.open(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.RestoreReport{Mode: mode, Skipped: make([]string, 0), Warnings: make([]string, 0)}
+
+	conflicts := map[string]bool{}
+	if mode != RestoreOverwrite {
+		for _, entry := range backup.Entries {
+			existing, err := b.entries.entryAdapter.Retrieve(ctx, entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				conflicts[entry.Key] = true
+			}
+		}
+		for _, template := range backup.Templates {
+			exists, err := b.boxes.templateAdapter.BoxExists(ctx, template.Service, template.Stage, template.Template)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				conflicts["box:"+template.Path(template.Stage)] = true
+			}
+		}
+	}
+
+	if mode == RestoreFail && len(conflicts) > 0 {
+		keys := make([]string, 0, len(conflicts))
+		for key := range conflicts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("%w: %s", ErrBackupConflict, strings.Join(keys, ", "))
+	}
+
+	restored := map[string]bool{}
+
+	upserts := make([]models.Entry, 0)
+	references := make([]models.Entry, 0)
+	for _, entry := range backup.Entries {
+		if conflicts[entry.Key] {
+			report.Skipped = append(report.Skipped, entry.Key)
+			continue
+		}
+		if !entry.Secure {
+			upserts = append(upserts, entry)
+			continue
+		}
+		if secret, ok := backup.Secrets[entry.Key]; ok {
+			entry.Value = secret
+			upserts = append(upserts, entry)
+			continue
+		}
+		references = append(references, entry)
+	}
+
+	if len(upserts) > 0 {
+		for key, err := range b.entries.Upsert(ctx, upserts) {
+			if err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", key, err))
+				continue
+			}
+			restored[key] = true
+		}
+	}
+
+	if len(references) > 0 {
+		result := b.entries.entryAdapter.Upsert(ctx, references)
+		for _, entry := range references {
+			if err := result[entry.Key]; err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", entry.Key, err))
+				continue
+			}
+			b.entries.index(ctx, entry)
+			restored[entry.Key] = true
+		}
+	}
+	report.Entries = len(restored)
+
+	for _, template := range backup.Templates {
+		path := "box:" + template.Path(template.Stage)
+		if conflicts[path] {
+			report.Skipped = append(report.Skipped, path)
+			continue
+		}
+
+		result := b.boxes.UpsertBox(ctx, &models.Box{
+			Service: template.Service,
+			Stage: map[string]models.Stage{template.Stage: {
+				Templates:  []models.Template{{Name: template.Template, Value: template.Value, Parameters: template.Parameters}},
+				Resolution: template.Resolution,
+			}},
+		})
+		if len(result.Boxes) == 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: template not restored", path))
+			continue
+		}
+		restored[path] = true
+		report.Templates++
+	}
+
+	tracking := make([]models.Tracking, 0)
+	for _, t := range backup.Tracking {
+		if restored[t.Key] {
+			tracking = append(tracking, t)
+		}
+	}
+	if len(tracking) > 0 {
+		if err = b.entries.entryAdapter.ImportTracking(ctx, tracking); err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("tracking: %s", err))
+		} else {
+			report.Tracking = len(tracking)
+		}
+	}
+
+	sort.Strings(report.Skipped)
+	sort.Strings(report.Warnings)
+
+	return report, nil
+}
+
+// seal json, gzip and AES-256-GCM, the archive is header + nonce + ciphertext
+func (b *BackupUseCase) seal(backup *models.Backup) ([]byte, error) {
+	aead, err := b.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	var plain bytes.Buffer
+	writer := gzip.NewWriter(&plain)
+	if err = json.NewEncoder(writer).Encode(backup); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	archive := append([]byte(backupHeader), nonce...)
+	return aead.Seal(archive, nonce, plain.Bytes(), []byte(backupHeader)), nil
+}
+
+func (b *BackupUseCase) open(archive []byte) (*models.Backup, error) {
+	aead, err := b.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(archive, []byte(backupHeader)) || len(archive) < len(backupHeader)+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidBackup)
+	}
+	archive = archive[len(backupHeader):]
+
+	plain, err := aead.Open(nil, archive[:aead.NonceSize()], archive[aead.NonceSize():], []byte(backupHeader))
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong key or corrupted archive", ErrInvalidBackup)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	backup := &models.Backup{}
+	if err = json.Unmarshal(content, backup); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+	if backup.Version != BackupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, backup.Version)
+	}
+
+	return backup, nil
+}
+
+// cipher AES-256-GCM with the base64 backup key of the config
+func (b *BackupUseCase) cipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(b.config.BackupKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%w: NBOX_BACKUP_KEY must be 32 bytes base64 encoded", ErrBackupKey)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
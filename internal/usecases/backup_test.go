@@ -0,0 +1,67 @@
+package usecases
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"nbox/internal/domain/models"
+	"testing"
+)
+
+func TestBackupUseCase_Restore(t *testing.T) {
+	config := *testConfig
+	config.AllowedPrefixes = []string{"production/"}
+	config.BackupKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production", Key: "db_host", Value: "db.internal"},
+		{Path: "production", Key: "db_password", Value: "/production/db_password", Secure: true},
+	}}
+	mockSecret := &mockSecretAdapter{secrets: map[string]string{"/production/db_password": "s3cr3t"}}
+
+	references := NewReferenceUseCase(mockEntry, mockSecret, testConfig)
+	entries := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), references, nil, &config)
+	boxes, _ := NewBox(&mockTemplateAdapter{}, mockEntry, &mockUsageAdapter{}, NewPathUseCase(), references, entries, &config)
+	useCase := NewBackupUseCase(entries, boxes, &config)
+
+	archive, err := useCase.Backup(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if bytes.Contains(archive, []byte("s3cr3t")) || bytes.Contains(archive, []byte("db.internal")) {
+		t.Errorf(`Expected the archive encrypted`)
+	}
+
+	if _, err = useCase.Restore(context.Background(), archive, RestoreFail); !errors.Is(err, ErrBackupConflict) {
+		t.Errorf(`Expected %v got: %v`, ErrBackupConflict, err)
+	}
+
+	report, err := useCase.Restore(context.Background(), archive, RestoreSkip)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Entries != 0 || len(report.Skipped) != 2 || len(mockEntry.upserted) != 0 {
+		t.Errorf(`Expected existing keys skipped got: %+v`, report)
+	}
+
+	mockEntry.entries = []models.Entry{}
+	report, err = useCase.Restore(context.Background(), archive, RestoreFail)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Entries != 2 || len(report.Warnings) != 0 {
+		t.Errorf(`Expected both keys restored got: %+v`, report)
+	}
+
+	other := config
+	other.BackupKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))
+	if _, err = NewBackupUseCase(entries, boxes, &other).Restore(context.Background(), archive, RestoreOverwrite); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf(`Expected %v got: %v`, ErrInvalidBackup, err)
+	}
+
+	other.BackupKey = ""
+	if _, err = NewBackupUseCase(entries, boxes, &other).Backup(context.Background(), false); !errors.Is(err, ErrBackupKey) {
+		t.Errorf(`Expected %v got: %v`, ErrBackupKey, err)
+	}
+}
@@ -2,61 +2,437 @@ package usecases
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
+	"nbox/internal/application"
 	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"path"
+	"sort"
 	"strings"
 )
 
+const (
+	ExpiredAllow   = "allow"   // ExpiredAllow expired entries are built as any other
+	ExpiredExclude = "exclude" // ExpiredExclude expired entries are treated as missing
+	ExpiredFail    = "fail"    // ExpiredFail builds using expired entries fail
+)
+
+var (
+	ErrEntryExpired       = errors.New("entry expired")
+	ErrInvalidExpiredMode = errors.New("invalid expired entries mode")
+)
+
 type BoxUseCase struct {
 	templateAdapter domain.TemplateAdapter
 	entryAdapter    domain.EntryAdapter
+	usageAdapter    domain.UsageAdapter
 	pathUseCase     *PathUseCase
+	references      *ReferenceUseCase
+	entryUseCase    *EntryUseCase
+	config          *application.Config
 }
 
-func NewBox(boxOperation domain.TemplateAdapter, entryOperations domain.EntryAdapter, pathUseCase *PathUseCase) *BoxUseCase {
+func NewBox(
+	boxOperation domain.TemplateAdapter,
+	entryOperations domain.EntryAdapter,
+	usageAdapter domain.UsageAdapter,
+	pathUseCase *PathUseCase,
+	references *ReferenceUseCase,
+	entryUseCase *EntryUseCase,
+	config *application.Config,
+) (*BoxUseCase, error) {
+	if _, err := expiredMode(config.ExpiredEntries, ExpiredAllow); err != nil {
+		return nil, fmt.Errorf("NBOX_EXPIRED_ENTRIES: %w", err)
+	}
 	return &BoxUseCase{
 		templateAdapter: boxOperation,
 		entryAdapter:    entryOperations,
+		usageAdapter:    usageAdapter,
 		pathUseCase:     pathUseCase,
+		references:      references,
+		entryUseCase:    entryUseCase,
+		config:          config,
+	}, nil
+}
+
+// expiredMode how a build handles expired entries, the fallback mode when empty
+func expiredMode(mode string, fallback string) (string, error) {
+	switch mode {
+	case "":
+		return fallback, nil
+	case ExpiredAllow, ExpiredExclude, ExpiredFail:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %s, expected %s, %s or %s", ErrInvalidExpiredMode, mode, ExpiredAllow, ExpiredExclude, ExpiredFail)
+	}
+}
+
+// UpsertBox stores the box variables and templates, reports the same checks as Inspect
+// as warnings and keeps the where-used index of the stored templates up to date.
+func (b *BoxUseCase) UpsertBox(ctx context.Context, box *models.Box) *models.BoxResult {
+	warnings := make([]string, 0)
+	usages := map[string][]string{}
+
+	variables, variableWarnings := b.upsertVariables(ctx, box)
+	warnings = append(warnings, variableWarnings...)
+
+	for stageName, stage := range box.Stage {
+		chain := stage.Resolution
+		if len(chain) == 0 {
+			chain = box.Resolution
+		}
+
+		for _, template := range stage.GetTemplates() {
+			name := fmt.Sprintf("%s/%s/%s", box.Service, stageName, template.Name)
+
+			decoded, err := base64.StdEncoding.DecodeString(template.Value)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", name, err))
+				continue
+			}
+
+			tmpl, err := b.ComposeTemplate(ctx, name, decoded)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", name, err))
+				continue
+			}
+
+			inspection := b.inspect(ctx, name, tmpl, box.Service, stageName, template.Name, map[string]string{}, chain)
+			for _, warning := range inspection.Warnings {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", name, warning))
+			}
+			usages[name] = usedKeys(inspection.Variables)
+		}
+	}
+
+	boxes := b.templateAdapter.UpsertBox(ctx, box)
+
+	for _, path := range boxes {
+		if err := b.usageAdapter.Replace(ctx, path, usages[path]); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: usage index not updated. %s", path, err))
+		}
+	}
+
+	sort.Strings(warnings)
+
+	return &models.BoxResult{
+		Boxes:     boxes,
+		Variables: variables,
+		Warnings:  warnings,
 	}
 }
 
+// upsertVariables writes the stage variables as entries under stage/service/
+func (b *BoxUseCase) upsertVariables(ctx context.Context, box *models.Box) ([]string, []string) {
+	entries := make([]models.Entry, 0)
+
+	for stageName, stage := range box.Stage {
+		for name, variable := range stage.Variables {
+			entries = append(entries, models.Entry{
+				Key:    fmt.Sprintf("%s/%s/%s", stageName, box.Service, name),
+				Value:  variable.String(),
+				Secure: variable.Secure,
+			})
+		}
+	}
+
+	variables := make([]string, 0)
+	warnings := make([]string, 0)
+	if len(entries) == 0 {
+		return variables, warnings
+	}
+
+	for key, err := range b.entryUseCase.Upsert(ctx, entries) {
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", key, err))
+			continue
+		}
+		variables = append(variables, key)
+	}
+	sort.Strings(variables)
+
+	return variables, warnings
+}
+
 func (b *BoxUseCase) BuildBox(ctx context.Context, service string, stage string, template string, args map[string]string) (string, error) {
-	box, err := b.templateAdapter.RetrieveBox(ctx, service, stage, template)
+	result, err := b.BuildBoxReport(ctx, service, stage, template, args, "")
 	if err != nil {
 		return "", err
 	}
+	return result.Template, nil
+}
+
+// DeleteBox soft deletes the templates and drops them from the where-used index
+func (b *BoxUseCase) DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	paths, err := b.templateAdapter.DeleteBox(ctx, service, stage, template)
 
-	tmpl := b.VarsBuilder(string(box), service, stage, template, args)
-	proc := NewProcessor(tmpl)
-	prefixes := proc.GetPrefixes()
+	for _, path := range paths {
+		if e := b.usageAdapter.Replace(ctx, path, nil); e != nil {
+			log.Printf("Err usage index not updated %s. %v\n", path, e)
+		}
+	}
+
+	return paths, err
+}
+
+// RestoreBox restores soft deleted templates and indexes their variables again
+func (b *BoxUseCase) RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	paths, err := b.templateAdapter.RestoreBox(ctx, service, stage, template)
+
+	for _, p := range paths {
+		components := strings.SplitN(p, "/", 3)
+		if len(components) != 3 {
+			continue
+		}
+		inspection, e := b.Inspect(ctx, components[0], components[1], components[2], map[string]string{})
+		if e != nil {
+			log.Printf("Err usage index not updated %s. %v\n", p, e)
+			continue
+		}
+		if e = b.usageAdapter.Replace(ctx, p, usedKeys(inspection.Variables)); e != nil {
+			log.Printf("Err usage index not updated %s. %v\n", p, e)
+		}
+	}
 
+	return paths, err
+}
+
+// BuildBoxReport builds the template and reports the key each placeholder was read
+// from, following the resolution chain of the box when a key is missing. expired is the
+// mode of the expired entries of this build, NBOX_EXPIRED_ENTRIES when empty.
+func (b *BoxUseCase) BuildBoxReport(ctx context.Context, service string, stage string, template string, args map[string]string, expired string) (*models.BuildResult, error) {
+	mode, err := expiredMode(expired, b.config.ExpiredEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	box, err := b.Compose(ctx, service, stage, template)
+	if err != nil {
+		return nil, err
+	}
+
+	record := b.stage(ctx, service, stage)
+	args, err = ValidateArgs(b.parameters(record, template), args)
+	if err != nil {
+		return nil, err
+	}
+
+	format := TemplateFormat(template)
+	tmpl := b.VarsBuilder(box, service, stage, template, args)
+	proc := NewProcessor(tmpl, WithFormat(format))
+
+	result := &models.BuildResult{Sources: map[string]string{}}
 	tree := map[string]string{}
+	chain := b.chain(record, service, stage, template, args)
+
+	unquoted := map[string]bool{}
+	expiredKeys := make([]string, 0)
+
+	for k, entry := range b.resolve(ctx, placeholderKeys(proc), chain, mode) {
+		if entry.Expired {
+			expiredKeys = append(expiredKeys, entry.Source)
+		}
+
+		typed := entry.Entry
+		typed.Key = entry.Source
+		unquoted[k] = !entry.Secure && Unquoted(b.entryUseCase.Schema(typed))
+
+		value := entry.Value
+		if !entry.Secure && HasReferences(value) {
+			value, err = b.references.Resolve(ctx, entry.Source, value, false)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Source, err)
+			}
+		}
+		tree[k] = value
+		result.Sources[k] = entry.Source
+	}
+
+	if len(expiredKeys) > 0 && mode == ExpiredFail {
+		sort.Strings(expiredKeys)
+		return nil, fmt.Errorf("%w: %s", ErrEntryExpired, strings.Join(expiredKeys, ", "))
+	}
+
+	result.Template = NewProcessor(tmpl, WithFormat(format), WithUnquoted(unquoted)).Replace(tree)
+	if err = format.Validate(result.Template); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// stage box record of the stage, nil when it can't be read
+func (b *BoxUseCase) stage(ctx context.Context, service string, stage string) *models.Stage {
+	record, err := b.templateAdapter.RetrieveStage(ctx, service, stage)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// parameters declared by the template of the stage record
+func (b *BoxUseCase) parameters(record *models.Stage, template string) []models.Parameter {
+	if record == nil {
+		return nil
+	}
+	for _, t := range record.GetTemplates() {
+		if t.Value == template || path.Base(t.Name) == template {
+			return t.Parameters
+		}
+	}
+	return nil
+}
+
+// chain resolution chain configured for the box stage, :args are replaced
+func (b *BoxUseCase) chain(record *models.Stage, service string, stage string, template string, args map[string]string) []string {
+	if record == nil {
+		return nil
+	}
+
+	chain := make([]string, 0, len(record.Resolution))
+	for _, layer := range record.Resolution {
+		chain = append(chain, b.VarsBuilder(layer, service, stage, template, args))
+	}
+	return chain
+}
+
+// Inspect reports what a template needs without rendering it: the resolved path of
+// every placeholder, whether the entry exists, if it is secure and the unused args.
+func (b *BoxUseCase) Inspect(ctx context.Context, service string, stage string, template string, args map[string]string) (*models.TemplateInspection, error) {
+	box, err := b.Compose(ctx, service, stage, template)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s/%s/%s", service, stage, template)
+	record := b.stage(ctx, service, stage)
+
+	validated, err := ValidateArgs(b.parameters(record, template), args)
+	if err != nil {
+		validated = args
+	}
+
+	inspection := b.inspect(ctx, name, box, service, stage, template, validated, b.chain(record, service, stage, template, validated))
+
+	var parameterErr *ParameterError
+	if errors.As(err, &parameterErr) {
+		inspection.Warnings = append(inspection.Warnings, parameterErr.Violations()...)
+	}
+
+	return inspection, nil
+}
+
+func (b *BoxUseCase) inspect(ctx context.Context, name string, box string, service string, stage string, template string, args map[string]string, chain []string) *models.TemplateInspection {
+	inspection := &models.TemplateInspection{
+		Template:   name,
+		Variables:  make([]models.TemplateVariable, 0),
+		UnusedArgs: make([]string, 0),
+		Warnings:   make([]string, 0),
+	}
+
+	for k := range args {
+		if replaceArgs(box, map[string]string{strings.TrimSpace(k): ""}) == box {
+			inspection.UnusedArgs = append(inspection.UnusedArgs, k)
+		}
+	}
+	sort.Strings(inspection.UnusedArgs)
+
+	proc := NewProcessor(b.VarsBuilder(box, service, stage, template, args))
+	tree := b.resolve(ctx, placeholderKeys(proc), chain, b.config.ExpiredEntries)
+	seen := map[string]bool{}
+
+	for _, v := range proc.GetVars() {
+		cleaned, _ := PlaceholderKey(v)
+		if seen[cleaned] {
+			continue
+		}
+		seen[cleaned] = true
+
+		variable := models.TemplateVariable{Placeholder: v, Path: cleaned}
+		if entry, ok := tree[cleaned]; ok {
+			variable.Exists = true
+			variable.Secure = entry.Secure
+			variable.Source = entry.Source
+			if !entry.Secure && HasReferences(entry.Value) {
+				variable.References = b.references.Targets(ctx, entry.Value)
+			}
+			if entry.Expired {
+				inspection.Warnings = append(inspection.Warnings, fmt.Sprintf("variable %s expired", entry.Source))
+			}
+		} else {
+			inspection.Warnings = append(inspection.Warnings, fmt.Sprintf("variable %s not found", cleaned))
+		}
+		inspection.Variables = append(inspection.Variables, variable)
+	}
+
+	for _, arg := range inspection.UnusedArgs {
+		inspection.Warnings = append(inspection.Warnings, fmt.Sprintf("unused arg :%s", arg))
+	}
+
+	return inspection
+}
+
+// usedKeys keys the where-used index records for the variables, the key each one was
+// resolved from through the chain, or the key of the placeholder when it's missing,
+// followed by the keys its value references
+func usedKeys(variables []models.TemplateVariable) []string {
+	keys := make([]string, 0, len(variables))
+	seen := map[string]bool{}
+	for _, variable := range variables {
+		key := variable.Source
+		if key == "" {
+			key = variable.Path
+		}
+		for _, k := range append([]string{key}, variable.References...) {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// lookup lists the entries under each prefix, keyed by their full path
+func (b *BoxUseCase) lookup(ctx context.Context, prefixes []string) map[string]models.Entry {
+	tree := map[string]models.Entry{}
 
 	for _, k := range prefixes {
 		entries, _ := b.entryAdapter.List(ctx, k)
 		for _, entry := range entries {
 			if k == strings.TrimSpace(entry.Path) {
 				p := b.pathUseCase.Concat(k, entry.Key)
-				tree[p] = entry.Value
+				tree[p] = entry
 			}
 		}
 	}
 
-	return proc.Replace(tree), nil
+	return tree
 }
 
-func (b *BoxUseCase) VarsBuilder(tmpl string, service string, stage string, template string, args map[string]string) string {
-
-	oldnew := []string{
-		":service", service,
-		":stage", stage,
-		":template", template,
+func placeholderKeys(proc *Processor) []string {
+	var keys []string
+	for _, v := range proc.GetVars() {
+		key, _ := PlaceholderKey(v)
+		keys = append(keys, key)
 	}
+	return keys
+}
+
+// VarsBuilder replaces the :service, :stage, :template and querystring :args of the template
+func (b *BoxUseCase) VarsBuilder(tmpl string, service string, stage string, template string, args map[string]string) string {
+	values := map[string]string{}
 
 	for k, v := range args {
-		oldnew = append(oldnew, fmt.Sprintf(":%s", strings.TrimSpace(k)), v)
+		values[strings.TrimSpace(k)] = v
 	}
 
-	return strings.NewReplacer(oldnew...).Replace(tmpl)
+	values["service"] = service
+	values["stage"] = stage
+	values["template"] = template
+
+	return replaceArgs(tmpl, values)
 }
@@ -2,28 +2,143 @@ package usecases
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
 	"nbox/internal/domain/models"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockTemplateAdapter struct {
+	template   string
+	partials   map[string]string
+	resolution []string
+}
+
+var testConfig = &application.Config{
+	DefaultPrefix:   "global",
+	AllowedPrefixes: []string{"global/", "development/", "production/"},
 }
 
 type mockEntryAdapter struct {
+	entries  []models.Entry
+	upserted []models.Entry
+	trash    []models.TrashEntry
+	tracking map[string][]models.Tracking
+	err      error    // err of every upserted key
+	expired  []string // expired keys skipped by the restore
+}
+
+type mockUsageAdapter struct {
+	usages   map[string][]string
+	replaced map[string][]string // replaced keys indexed by box
+}
+
+func (m *mockUsageAdapter) Replace(ctx context.Context, box string, keys []string) error {
+	if m.replaced == nil {
+		m.replaced = map[string][]string{}
+	}
+	m.replaced[box] = keys
+	return nil
+}
+
+func (m *mockUsageAdapter) Usages(ctx context.Context, key string) ([]string, error) {
+	return m.usages[key], nil
 }
 
 func (m *mockEntryAdapter) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	if m.err != nil {
+		summary := map[string]error{}
+		for _, entry := range entries {
+			summary[entry.Key] = m.err
+		}
+		return summary
+	}
+	m.upserted = append(m.upserted, entries...)
 	return nil
 }
 
 func (m *mockEntryAdapter) Retrieve(ctx context.Context, key string) (*models.Entry, error) {
+	entries, _ := m.List(ctx, key)
+	for _, entry := range entries {
+		if NewPathUseCase().Concat(strings.TrimSpace(entry.Path), entry.Key) == key {
+			entry.Key = key
+			return &entry, nil
+		}
+	}
 	return nil, nil
 }
 
+type mockSearchAdapter struct {
+	terms map[string][]string
+}
+
+func (m *mockSearchAdapter) Replace(ctx context.Context, key string, terms []string) error {
+	if m.terms == nil {
+		m.terms = map[string][]string{}
+	}
+	m.terms[key] = terms
+	return nil
+}
+
+func (m *mockSearchAdapter) Search(ctx context.Context, term string, prefix string) ([]string, error) {
+	var keys []string
+	for key, terms := range m.terms {
+		if strings.HasPrefix(key, prefix) && slices.Contains(terms, term) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+type mockSecretAdapter struct {
+	config   *application.Config
+	secrets  map[string]string
+	versions map[string]string
+	metadata map[string]*models.SecretMetadata
+}
+
+func (m *mockSecretAdapter) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
+	return nil
+}
+
+func (m *mockSecretAdapter) Reference(ctx context.Context, key string) (string, error) {
+	if m.config != nil {
+		return ParameterReference(m.config, key), nil
+	}
+	return ParameterReference(testConfig, key), nil
+}
+
+func (m *mockSecretAdapter) Retrieve(ctx context.Context, reference string) (string, error) {
+	return m.secrets[reference], nil
+}
+
+func (m *mockSecretAdapter) Version(ctx context.Context, reference string) (string, error) {
+	return m.versions[reference], nil
+}
+
+func (m *mockSecretAdapter) Describe(ctx context.Context, reference string) (*models.SecretMetadata, error) {
+	return m.metadata[reference], nil
+}
+
+func (m *mockSecretAdapter) Delete(ctx context.Context, reference string) error {
+	delete(m.secrets, reference)
+	return nil
+}
+
 func (m *mockEntryAdapter) List(ctx context.Context, prefix string) ([]models.Entry, error) {
+	if m.entries != nil {
+		return m.entries, nil
+	}
 	text := `[
 		{ "path": "widget-x/development", "key": "key", "value": "key-test", "secure": false },
 		{ "path": "widget-x/development", "key": "debug", "value": "false", "secure": false },
@@ -39,32 +154,103 @@ func (m *mockEntryAdapter) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+func (m *mockEntryAdapter) Purge(ctx context.Context, key string) error {
+	return nil
+}
+
+func (m *mockEntryAdapter) Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error) {
+	return m.trash, nil
+}
+
+func (m *mockEntryAdapter) Restore(ctx context.Context, key string) ([]string, error) {
+	restored := make([]string, 0)
+	for _, entry := range m.trash {
+		restored = append(restored, NewPathUseCase().Concat(entry.Path, entry.Key))
+	}
+	if len(m.expired) > 0 {
+		return restored, fmt.Errorf("%w: %s", domain.ErrRestoreWindowExpired, strings.Join(m.expired, ", "))
+	}
+	return restored, nil
+}
+
 func (m *mockEntryAdapter) Tracking(ctx context.Context, key string) ([]models.Tracking, error) {
-	return nil, nil
+	return m.tracking[key], nil
 }
 
-func (m *mockTemplateAdapter) UpsertBox(ctx context.Context, box *models.Box) []string {
+func (m *mockEntryAdapter) Activity(ctx context.Context, filter models.TrackingFilter) (*models.TrackingPage, error) {
+	return &models.TrackingPage{}, nil
+}
+
+func (m *mockEntryAdapter) ImportTracking(ctx context.Context, tracking []models.Tracking) error {
+	return nil
+}
+
+func (m *mockEntryAdapter) MoveTracking(ctx context.Context, from string, to string) error {
 	return nil
 }
 
+func (m *mockTemplateAdapter) UpsertBox(ctx context.Context, box *models.Box) []string {
+	var paths []string
+	for stageName, stage := range box.Stage {
+		for _, template := range stage.GetTemplates() {
+			paths = append(paths, fmt.Sprintf("%s/%s/%s", box.Service, stageName, template.Name))
+		}
+	}
+	return paths
+}
+
 func (m *mockTemplateAdapter) BoxExists(ctx context.Context, service string, stage string, template string) (bool, error) {
 	return false, nil
 }
 
 func (m *mockTemplateAdapter) RetrieveBox(ctx context.Context, service string, stage string, template string) ([]byte, error) {
+	if m.template != "" {
+		return []byte(m.template), nil
+	}
 	text := `{"service": ":service","ENV_1": "{{ widget-x/:stage/key }}", "ENV_2": "{{widget-x/development/debug}}", "GLOBAL_SERVICE": "{{widget-x/sentry}}", "domain": "{{private-domain}}", "version": "1", "missing":"{{missing}}"}`
 	return []byte(text), nil
 }
 
-func (m *mockTemplateAdapter) List(ctx context.Context) ([]models.Box, error) {
+func (m *mockTemplateAdapter) List(ctx context.Context, filter models.BoxFilter) (*models.BoxPage, error) {
+	return &models.BoxPage{}, nil
+}
+
+func (m *mockTemplateAdapter) RetrieveStage(ctx context.Context, service string, stage string) (*models.Stage, error) {
+	return &models.Stage{Resolution: m.resolution}, nil
+}
+
+func (m *mockTemplateAdapter) DeleteBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
 	return nil, nil
 }
 
+func (m *mockTemplateAdapter) RestoreBox(ctx context.Context, service string, stage string, template string) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockTemplateAdapter) UpsertPartial(ctx context.Context, name string, value []byte) error {
+	return nil
+}
+
+func (m *mockTemplateAdapter) RetrievePartial(ctx context.Context, name string) ([]byte, error) {
+	partial, ok := m.partials[name]
+	if !ok {
+		return nil, fmt.Errorf("partial %s not found", name)
+	}
+	return []byte(partial), nil
+}
+
+func newTestBox(template *mockTemplateAdapter, entry *mockEntryAdapter) *BoxUseCase {
+	references := NewReferenceUseCase(entry, &mockSecretAdapter{}, testConfig)
+	entries := NewEntryUseCase(entry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), references, nil, testConfig)
+	boxes, _ := NewBox(template, entry, &mockUsageAdapter{}, NewPathUseCase(), references, entries, testConfig)
+	return boxes
+}
+
 func TestBoxUseCase_BuildBox(t *testing.T) {
 	mockTemplate := &mockTemplateAdapter{}
 	mockEntry := &mockEntryAdapter{}
 
-	useCase := NewBox(mockTemplate, mockEntry, NewPathUseCase())
+	useCase := newTestBox(mockTemplate, mockEntry)
 	results, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
 
 	fmt.Println(results)
@@ -79,3 +265,315 @@ func TestBoxUseCase_BuildBox(t *testing.T) {
 		t.Errorf(`Expected %s got: %s`, expected, results)
 	}
 }
+
+func TestBoxUseCase_BuildBoxIncludes(t *testing.T) {
+	mockTemplate := &mockTemplateAdapter{
+		template: `{"containers": [{{> common/app}}, {{> common/sidecar }}]}`,
+		partials: map[string]string{
+			"common/app":     `{"name": ":service", "debug": "{{widget-x/development/debug}}"}`,
+			"common/sidecar": `{"name": "datadog", "key": "{{ widget-x/:stage/key }}"}`,
+		},
+	}
+
+	useCase := newTestBox(mockTemplate, &mockEntryAdapter{})
+	results, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
+
+	expected := `{"containers": [{"name": "test", "debug": "false"}, {"name": "datadog", "key": "key-test"}]}`
+
+	if err != nil {
+		t.Fatalf(`Expected %s got: err %s`, expected, err)
+	}
+
+	if results != expected {
+		t.Errorf(`Expected %s got: %s`, expected, results)
+	}
+}
+
+func TestBoxUseCase_BuildBoxIncludeCycle(t *testing.T) {
+	mockTemplate := &mockTemplateAdapter{
+		template: `{{> a}}`,
+		partials: map[string]string{
+			"a": `{{> b}}`,
+			"b": `{{> a}}`,
+		},
+	}
+
+	useCase := newTestBox(mockTemplate, &mockEntryAdapter{})
+	_, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
+
+	if !errors.Is(err, ErrIncludeCycle) {
+		t.Errorf(`Expected ErrIncludeCycle got: %v`, err)
+	}
+}
+
+func TestBoxUseCase_BuildBoxInvalidInclude(t *testing.T) {
+	mockTemplate := &mockTemplateAdapter{
+		template: `{{> ../templates/secret}}`,
+		partials: map[string]string{},
+	}
+
+	useCase := newTestBox(mockTemplate, &mockEntryAdapter{})
+	_, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
+
+	if !errors.Is(err, ErrInvalidPartial) {
+		t.Errorf(`Expected ErrInvalidPartial got: %v`, err)
+	}
+}
+
+func TestValidatePartialName(t *testing.T) {
+	for _, name := range []string{"common/sidecars", "ecs/task_definition.json", "a", "team-x/base_v2"} {
+		if err := ValidatePartialName(name); err != nil {
+			t.Errorf(`Expected %s to be valid got: %v`, name, err)
+		}
+	}
+
+	for _, name := range []string{"", "/", "/common", "common/", "common//app", "..", "common/../secret", "./app", "common app", "{{x}}"} {
+		if err := ValidatePartialName(name); !errors.Is(err, ErrInvalidPartial) {
+			t.Errorf(`Expected ErrInvalidPartial for %q got: %v`, name, err)
+		}
+	}
+}
+
+func TestBoxUseCase_BuildBoxOverlay(t *testing.T) {
+	mockTemplate := &mockTemplateAdapter{
+		template: `{"$base": "ecs/base", "cpu": 512, "environment": {"DEBUG": "{{widget-x/development/debug}}"}, "volumes": null}`,
+		partials: map[string]string{
+			"ecs/base": `{"family": ":service", "cpu": 256, "memory": 512, "environment": {"STAGE": ":stage"}, "volumes": []}`,
+		},
+	}
+
+	useCase := newTestBox(mockTemplate, &mockEntryAdapter{})
+	results, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
+	if err != nil {
+		t.Fatalf(`Expected no error got: %s`, err)
+	}
+
+	var got map[string]interface{}
+	_ = json.Unmarshal([]byte(results), &got)
+
+	expected := map[string]interface{}{
+		"family":      "test",
+		"cpu":         float64(512),
+		"memory":      float64(512),
+		"environment": map[string]interface{}{"STAGE": "development", "DEBUG": "false"},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf(`Expected %v got: %s`, expected, results)
+	}
+}
+
+func TestBoxUseCase_BuildBoxInvalidOverlay(t *testing.T) {
+	templates := map[string]string{
+		"invalid json":  `{"$base": "ecs/base", "cpu": 512,}`,
+		"trailing data": `{"$base": "ecs/base", "cpu": 512} {"memory": 1024}`,
+		"base not name": `{"$base": 1, "cpu": 512}`,
+	}
+	for name, template := range templates {
+		mockTemplate := &mockTemplateAdapter{
+			template: template,
+			partials: map[string]string{"ecs/base": `{"cpu": 256}`},
+		}
+		useCase := newTestBox(mockTemplate, &mockEntryAdapter{})
+		_, err := useCase.BuildBox(context.Background(), "test", "development", "test.json", map[string]string{})
+		if !errors.Is(err, ErrInvalidOverlay) {
+			t.Errorf(`%s: Expected ErrInvalidOverlay got: %v`, name, err)
+		}
+	}
+}
+
+func TestMergePatch_TrailingData(t *testing.T) {
+	if _, err := MergePatch([]byte(`{"cpu": 256} {"cpu": 512}`), []byte(`{"cpu": 1024}`)); err == nil {
+		t.Errorf(`Expected an error for data after the document`)
+	}
+}
+
+func TestBoxUseCase_Inspect(t *testing.T) {
+	useCase := newTestBox(&mockTemplateAdapter{}, &mockEntryAdapter{})
+	inspection, err := useCase.Inspect(context.Background(), "test", "development", "test.json", map[string]string{"unused": "x"})
+	if err != nil {
+		t.Fatalf(`Expected no error got: %s`, err)
+	}
+
+	if len(inspection.Variables) != 5 {
+		t.Fatalf(`Expected 5 variables got: %v`, inspection.Variables)
+	}
+
+	first := inspection.Variables[0]
+	if first.Path != "widget-x/development/key" || !first.Exists || first.Source != "widget-x/development/key" {
+		t.Errorf(`Expected widget-x/development/key to be resolved got: %v`, first)
+	}
+
+	missing := inspection.Variables[4]
+	if missing.Path != "missing" || missing.Exists {
+		t.Errorf(`Expected missing to be reported got: %v`, missing)
+	}
+
+	if !reflect.DeepEqual(inspection.UnusedArgs, []string{"unused"}) {
+		t.Errorf(`Expected unused args [unused] got: %v`, inspection.UnusedArgs)
+	}
+
+	expected := []string{"variable missing not found", "unused arg :unused"}
+	if !reflect.DeepEqual(inspection.Warnings, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, inspection.Warnings)
+	}
+}
+
+func TestBoxUseCase_BuildBoxFallback(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "timeout", Value: "30"},
+		{Path: "production", Key: "retries", Value: "5"},
+		{Path: "global/api", Key: "retries", Value: "3"},
+		{Path: "global/api", Key: "region", Value: "us-east-1"},
+		{Path: "global", Key: "debug", Value: "false"},
+		{Path: "shared", Key: "owner", Value: "payments"},
+	}}
+	mockTemplate := &mockTemplateAdapter{
+		template: `{"timeout": "{{:stage/api/timeout}}", "retries": "{{:stage/api/retries}}", "region": "{{:stage/api/region}}", "debug": "{{:stage/api/debug}}", "owner": "{{:stage/api/owner}}"}`,
+	}
+
+	useCase := newTestBox(mockTemplate, mockEntry)
+	result, err := useCase.BuildBoxReport(context.Background(), "api", "production", "test.json", map[string]string{}, "")
+	if err != nil {
+		t.Fatalf(`Expected no error got: %s`, err)
+	}
+
+	expected := `{"timeout": "30", "retries": "5", "region": "us-east-1", "debug": "false", "owner": ""}`
+	if result.Template != expected {
+		t.Errorf(`Expected %s got: %s`, expected, result.Template)
+	}
+
+	if result.Sources["production/api/retries"] != "production/retries" || result.Sources["production/api/region"] != "global/api/region" {
+		t.Errorf(`Expected sources by layer got: %v`, result.Sources)
+	}
+
+	mockTemplate.resolution = []string{":stage/api", "shared"}
+	result, _ = useCase.BuildBoxReport(context.Background(), "api", "production", "test.json", map[string]string{}, "")
+
+	expected = `{"timeout": "30", "retries": "", "region": "", "debug": "", "owner": "payments"}`
+	if result.Template != expected {
+		t.Errorf(`Expected %s got: %s`, expected, result.Template)
+	}
+}
+
+func TestBoxUseCase_UpsertBox(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	box := &models.Box{
+		Service: "test",
+		Stage: map[string]models.Stage{
+			"development": {
+				Template: &models.Template{Name: "task.json", Value: encode(`{"key": "{{widget-x/development/key}}"}`)},
+				Templates: []models.Template{
+					{Name: "worker.json", Value: encode(`{"missing": "{{development/test/missing}}"}`)},
+				},
+				Variables: map[string]models.Variable{
+					"AGE":  {Value: float64(100)},
+					"NAME": {Value: "n1"},
+				},
+			},
+		},
+	}
+
+	result := newTestBox(&mockTemplateAdapter{}, &mockEntryAdapter{}).UpsertBox(context.Background(), box)
+
+	sort.Strings(result.Boxes)
+	if !reflect.DeepEqual(result.Boxes, []string{"test/development/task.json", "test/development/worker.json"}) {
+		t.Errorf(`Expected both templates to be stored got: %v`, result.Boxes)
+	}
+
+	if !reflect.DeepEqual(result.Variables, []string{"development/test/AGE", "development/test/NAME"}) {
+		t.Errorf(`Expected stage variables to be stored got: %v`, result.Variables)
+	}
+
+	expected := []string{"test/development/worker.json: variable development/test/missing not found"}
+	if !reflect.DeepEqual(result.Warnings, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, result.Warnings)
+	}
+}
+
+func TestBoxUseCase_UpsertBoxUsages(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	box := &models.Box{
+		Service: "api",
+		Stage: map[string]models.Stage{
+			"production": {
+				Template: &models.Template{Name: "task.json", Value: encode(`{"timeout": "{{production/api/timeout}}", "region": "{{production/api/region}}", "missing": "{{production/api/missing}}", "dsn": "{{production/api/dsn}}"}`)},
+			},
+		},
+	}
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "timeout", Value: "30"},
+		{Path: "global/api", Key: "region", Value: "us-east-1"},
+		{Path: "production/api", Key: "dsn", Value: "postgres://${ref:production/db/user}@${ref:production/db/host}"},
+		{Path: "production/db", Key: "user", Value: "api"},
+		{Path: "production/db", Key: "host", Value: "${ref:global/db/host}"},
+		{Path: "global/db", Key: "host", Value: "db.internal"},
+	}}
+	usage := &mockUsageAdapter{}
+	references := NewReferenceUseCase(mockEntry, &mockSecretAdapter{}, testConfig)
+	entries := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, usage, &mockSearchAdapter{}, NewPathUseCase(), references, nil, testConfig)
+	useCase, _ := NewBox(&mockTemplateAdapter{}, mockEntry, usage, NewPathUseCase(), references, entries, testConfig)
+
+	useCase.UpsertBox(context.Background(), box)
+
+	// the fallback key and the references are indexed, deleting global/api/region or
+	// production/db/host reports the box
+	expected := []string{"production/api/timeout", "global/api/region", "production/api/missing",
+		"production/api/dsn", "production/db/user", "production/db/host", "global/db/host"}
+	if !reflect.DeepEqual(usage.replaced["api/production/task.json"], expected) {
+		t.Errorf(`Expected %v got: %v`, expected, usage.replaced["api/production/task.json"])
+	}
+}
+
+func TestBoxUseCase_BuildBoxExpired(t *testing.T) {
+	yesterday := time.Now().Add(-24 * time.Hour)
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "token", Value: "trial", ExpiresAt: &yesterday, Expired: true},
+		{Path: "global/api", Key: "token", Value: "default"},
+	}}
+	mockTemplate := &mockTemplateAdapter{template: `{"token": "{{:stage/api/token}}"}`}
+
+	cases := []struct {
+		mode     string
+		expected string
+		err      error
+	}{
+		{ExpiredAllow, `{"token": "trial"}`, nil},
+		{ExpiredExclude, `{"token": "default"}`, nil},
+		{ExpiredFail, "", ErrEntryExpired},
+	}
+
+	for _, c := range cases {
+		config := *testConfig
+		config.ExpiredEntries = c.mode
+		useCase := newTestBox(mockTemplate, mockEntry)
+		useCase.config = &config
+
+		result, err := useCase.BuildBoxReport(context.Background(), "api", "production", "test.json", map[string]string{}, "")
+		if !errors.Is(err, c.err) {
+			t.Errorf(`[%s] Expected error %v got: %v`, c.mode, c.err, err)
+			continue
+		}
+		if err == nil && result.Template != c.expected {
+			t.Errorf(`[%s] Expected %s got: %s`, c.mode, c.expected, result.Template)
+		}
+
+		// the mode of a build overrides the configured one
+		result, err = newTestBox(mockTemplate, mockEntry).BuildBoxReport(context.Background(), "api", "production", "test.json", map[string]string{}, c.mode)
+		if !errors.Is(err, c.err) || (err == nil && result.Template != c.expected) {
+			t.Errorf(`[%s] Expected the build mode applied got: %v %v`, c.mode, result, err)
+		}
+	}
+
+	if _, err := newTestBox(mockTemplate, mockEntry).BuildBoxReport(context.Background(), "api", "production", "test.json", map[string]string{}, "skip"); !errors.Is(err, ErrInvalidExpiredMode) {
+		t.Errorf(`Expected ErrInvalidExpiredMode got: %v`, err)
+	}
+
+	config := *testConfig
+	config.ExpiredEntries = "skip"
+	if _, err := NewBox(mockTemplate, mockEntry, &mockUsageAdapter{}, NewPathUseCase(), nil, nil, &config); !errors.Is(err, ErrInvalidExpiredMode) {
+		t.Errorf(`Expected the configured mode validated got: %v`, err)
+	}
+}
@@ -0,0 +1,170 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DriftTolerance parameters written up to this long after the entry are the same write,
+// only used with history that has no recorded version
+const DriftTolerance = time.Minute
+
+// Drift compares the secure entries under the prefix with their parameters. With repair
+// references in another format or pointing to a missing parameter are rewritten to the
+// expected reference when that parameter exists, and parameters changed outside nbox are
+// re-imported, the entry is written again with the current version so the change is in its
+// history. A parameter changed outside nbox has another version, or another modifying
+// user, than the one recorded by the last write.
+func (e *EntryUseCase) Drift(ctx context.Context, prefix string, repair bool) (*models.DriftReport, error) {
+	report := &models.DriftReport{
+		Prefix:   prefix,
+		Dangling: make([]models.DriftItem, 0),
+		Changed:  make([]models.DriftItem, 0),
+		Format:   make([]models.DriftItem, 0),
+		Repaired: make([]string, 0),
+		Warnings: make([]string, 0),
+	}
+	repairs := make([]models.Entry, 0)
+
+	err := e.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+		if !entry.Secure {
+			return nil
+		}
+		report.Checked++
+
+		entry.Key = key
+		entry.Path = ""
+		entry.Expired = false
+
+		expected, err := e.secretAdapter.Reference(ctx, key)
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", key, err))
+			expected = entry.Value
+		}
+		item := models.DriftItem{Key: key, Reference: entry.Value}
+		if entry.Value != expected {
+			item.Expected = expected
+		}
+
+		parameter, err := e.secretAdapter.Describe(ctx, entry.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		if parameter == nil {
+			if item.Expected != "" {
+				if parameter, err = e.secretAdapter.Describe(ctx, expected); err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+			}
+			item.Parameter = parameter
+			report.Dangling = append(report.Dangling, item)
+
+			switch {
+			case parameter == nil:
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: parameter %s not found", key, entry.Value))
+			case repair:
+				entry.Value = expected
+				repairs = append(repairs, entry)
+			}
+			return nil
+		}
+		item.Parameter = parameter
+
+		fix := false
+		if item.Expected != "" {
+			report.Format = append(report.Format, item)
+			if parameterName(expected) == parameter.Name {
+				entry.Value = expected
+				fix = true
+			} else {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: references %s instead of %s", key, parameter.Name, parameterName(expected)))
+			}
+		}
+
+		last, err := e.lastWrite(ctx, key)
+		if err != nil {
+			return err
+		}
+		if last != nil && changedOutside(*last, parameter) {
+			item.UpdatedAt = &last.UpdatedAt
+			item.Version = last.SecretVersion
+			item.User = last.SecretUser
+			report.Changed = append(report.Changed, item)
+			entry.SecretVersion = parameter.CurrentVersion()
+			entry.SecretUser = parameter.LastModifiedUser
+			fix = true
+		}
+
+		if fix && repair {
+			repairs = append(repairs, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(repairs) > 0 {
+		result := e.entryAdapter.Upsert(ctx, repairs)
+		for _, entry := range repairs {
+			if err = result[entry.Key]; err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", entry.Key, err))
+				continue
+			}
+			e.index(ctx, entry)
+			report.Repaired = append(report.Repaired, entry.Key)
+		}
+	}
+
+	sort.Strings(report.Repaired)
+	sort.Strings(report.Warnings)
+
+	return report, nil
+}
+
+// lastWrite last write of the key through nbox, nil without history
+func (e *EntryUseCase) lastWrite(ctx context.Context, key string) (*models.Tracking, error) {
+	tracking, err := e.entryAdapter.Tracking(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+
+	var last *models.Tracking
+	for i, t := range tracking {
+		if last == nil || t.UpdatedAt.After(last.UpdatedAt) {
+			last = &tracking[i]
+		}
+	}
+	return last, nil
+}
+
+// changedOutside the parameter isn't the version nbox wrote, or another principal wrote
+// it. History written before the versions were recorded falls back to the modification
+// time.
+func changedOutside(last models.Tracking, parameter *models.SecretMetadata) bool {
+	if last.SecretVersion == "" {
+		return parameter.LastModifiedAt.After(last.UpdatedAt.Add(DriftTolerance))
+	}
+	if parameter.CurrentVersion() != last.SecretVersion {
+		return true
+	}
+	return last.SecretUser != "" && parameter.LastModifiedUser != "" && parameter.LastModifiedUser != last.SecretUser
+}
+
+// parameterName name of the parameter of a name or ARN reference
+func parameterName(reference string) string {
+	if strings.HasPrefix(reference, "arn:") {
+		if _, name, ok := strings.Cut(reference, ":parameter"); ok {
+			reference = name
+		}
+	}
+	if !strings.HasPrefix(reference, "/") {
+		return "/" + reference
+	}
+	return reference
+}
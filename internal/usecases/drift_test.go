@@ -0,0 +1,96 @@
+package usecases
+
+import (
+	"context"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntryUseCase_Drift(t *testing.T) {
+	config := *testConfig
+	config.ParameterShortArn = true
+
+	written := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	nbox := "arn:aws:sts::111111111111:assumed-role/nbox/task"
+	mockEntry := &mockEntryAdapter{
+		entries: []models.Entry{
+			{Path: "production", Key: "a", Value: "/production/a", Secure: true},
+			{Path: "production", Key: "b", Value: "arn:aws:ssm:us-east-1:111111111111:parameter/production/b", Secure: true},
+			{Path: "production", Key: "c", Value: "/production/old_c", Secure: true},
+			{Path: "production", Key: "d", Value: "/production/d", Secure: true},
+			{Path: "production", Key: "e", Value: "/production/e", Secure: true},
+			{Path: "production", Key: "f", Value: "/production/f", Secure: true},
+			{Path: "production", Key: "g", Value: "/production/g", Secure: true},
+			{Path: "production", Key: "h", Value: "/production/h", Secure: true},
+			{Path: "production", Key: "plain", Value: "x"},
+		},
+		tracking: map[string][]models.Tracking{
+			"production/a": {{UpdatedAt: written}},
+			"production/e": {{UpdatedAt: written.Add(-time.Hour)}, {UpdatedAt: written}},
+			"production/f": {{UpdatedAt: written, SecretVersion: "3", SecretUser: nbox}},
+			"production/g": {{UpdatedAt: written, SecretVersion: "2", SecretUser: nbox}},
+			"production/h": {{UpdatedAt: written, SecretVersion: "5", SecretUser: nbox}},
+		},
+	}
+	mockSecret := &mockSecretAdapter{config: &config, metadata: map[string]*models.SecretMetadata{
+		"/production/a": {Name: "/production/a", Version: 1, LastModifiedAt: written.Add(10 * time.Second)},
+		"arn:aws:ssm:us-east-1:111111111111:parameter/production/b": {Name: "/production/b", Version: 1},
+		"/production/c": {Name: "/production/c", Version: 2},
+		"/production/e": {Name: "/production/e", Version: 4, LastModifiedAt: written.Add(time.Hour), LastModifiedUser: "arn:aws:iam::111111111111:user/ops"},
+		// f was written by nbox long after the entry, g changed within the tolerance and h by another user
+		"/production/f": {Name: "/production/f", Version: 3, LastModifiedAt: written.Add(time.Hour), LastModifiedUser: nbox},
+		"/production/g": {Name: "/production/g", Version: 3, LastModifiedAt: written.Add(10 * time.Second), LastModifiedUser: nbox},
+		"/production/h": {Name: "/production/h", Version: 5, LastModifiedAt: written, LastModifiedUser: "arn:aws:iam::111111111111:user/ops"},
+	}}
+	useCase := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, &config)
+
+	report, err := useCase.Drift(context.Background(), "production", false)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	keys := func(items []models.DriftItem) []string {
+		k := make([]string, 0)
+		for _, item := range items {
+			k = append(k, item.Key)
+		}
+		return k
+	}
+	if report.Checked != 8 {
+		t.Errorf(`Expected 8 secure entries checked got: %d`, report.Checked)
+	}
+	if k := keys(report.Dangling); !reflect.DeepEqual(k, []string{"production/c", "production/d"}) {
+		t.Errorf(`Expected dangling c and d got: %v`, k)
+	}
+	if k := keys(report.Format); !reflect.DeepEqual(k, []string{"production/b"}) {
+		t.Errorf(`Expected format b got: %v`, k)
+	}
+	if k := keys(report.Changed); !reflect.DeepEqual(k, []string{"production/e", "production/g", "production/h"}) {
+		t.Errorf(`Expected changed e, g and h got: %v`, k)
+	}
+	if len(report.Repaired) != 0 || len(mockEntry.upserted) != 0 {
+		t.Errorf(`Expected nothing written without repair got: %v`, mockEntry.upserted)
+	}
+
+	report, err = useCase.Drift(context.Background(), "production", true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expected := []string{"production/b", "production/c", "production/e", "production/g", "production/h"}; !reflect.DeepEqual(report.Repaired, expected) {
+		t.Errorf(`Expected %v repaired got: %v`, expected, report.Repaired)
+	}
+
+	references := map[string]string{}
+	for _, entry := range mockEntry.upserted {
+		references[entry.Key] = entry.Value
+		if entry.Key == "production/g" && entry.SecretVersion != "3" {
+			t.Errorf(`Expected the re-import of g to record version 3 got: %q`, entry.SecretVersion)
+		}
+	}
+	expected := map[string]string{"production/b": "/production/b", "production/c": "/production/c", "production/e": "/production/e", "production/g": "/production/g", "production/h": "/production/h"}
+	if !reflect.DeepEqual(references, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, references)
+	}
+}
@@ -2,32 +2,94 @@ package usecases
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"nbox/internal/application"
 	"nbox/internal/domain"
 	"nbox/internal/domain/models"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	ErrEntryInUse          = errors.New("entry in use")
+	ErrPrefixDelete        = errors.New("prefix delete")
+	ErrProtectedPrefix     = errors.New("protected prefix")
+	ErrInvalidConfirmation = errors.New("invalid confirmation token")
+	ErrInvalidClear        = errors.New("invalid clear field")
+)
+
+// ClearFields metadata fields an upsert removes with clear, the fields it doesn't send keep
+// the stored value
+var ClearFields = []string{"description", "owner", "labels", "link", "schema", "expiresAt"}
+
+// ConfirmationTTL time a prefix delete token is valid after the dry run
+const ConfirmationTTL = 15 * time.Minute
+
+// UsageError the entry is still referenced by box templates
+type UsageError struct {
+	Key   string
+	Boxes []string
+}
+
+func (u *UsageError) Error() string {
+	return fmt.Sprintf("%s referenced by %s", u.Key, strings.Join(u.Boxes, ", "))
+}
+
+func (u *UsageError) Unwrap() error {
+	return ErrEntryInUse
+}
+
 type EntryUseCase struct {
 	entryAdapter  domain.EntryAdapter
 	secretAdapter domain.SecretAdapter
+	usageAdapter  domain.UsageAdapter
+	searchAdapter domain.SearchAdapter
+	pathUseCase   *PathUseCase
+	references    *ReferenceUseCase
+	schemas       *SchemaUseCase
 	config        *application.Config
+	tokenKey      []byte
 }
 
 func NewEntryUseCase(
 	entryAdapter domain.EntryAdapter,
 	secretAdapter domain.SecretAdapter,
+	usageAdapter domain.UsageAdapter,
+	searchAdapter domain.SearchAdapter,
+	pathUseCase *PathUseCase,
+	references *ReferenceUseCase,
+	schemas *SchemaUseCase,
 	config *application.Config,
 ) *EntryUseCase {
-	return &EntryUseCase{entryAdapter: entryAdapter, secretAdapter: secretAdapter, config: config}
+	return &EntryUseCase{
+		entryAdapter:  entryAdapter,
+		secretAdapter: secretAdapter,
+		usageAdapter:  usageAdapter,
+		searchAdapter: searchAdapter,
+		pathUseCase:   pathUseCase,
+		references:    references,
+		schemas:       schemas,
+		config:        config,
+		tokenKey:      []byte(config.ConfirmationKey),
+	}
 }
 
 // Upsert
 // ARN arn:aws:ssm:<REGION_NAME>:<ACCOUNT_ID>:parameter/<parameter-name>
+// or arn:aws:secretsmanager:<REGION_NAME>:<ACCOUNT_ID>:secret:<secret-name>::AWSCURRENT:
 func (e *EntryUseCase) Upsert(ctx context.Context, entries []models.Entry) map[string]error {
 
 	result := make(map[string]error)
+	entries = e.preserveMetadata(ctx, entries, result)
+	entries = e.validate(entries, result)
 
 	secrets := make([]models.Entry, 0)
 	for _, entry := range entries {
@@ -36,6 +98,7 @@ func (e *EntryUseCase) Upsert(ctx context.Context, entries []models.Entry) map[s
 		}
 		result[entry.Key] = nil
 	}
+	previous := e.storedReferences(ctx, secrets)
 
 	secureResults := e.secretAdapter.Upsert(ctx, secrets)
 
@@ -49,8 +112,13 @@ func (e *EntryUseCase) Upsert(ctx context.Context, entries []models.Entry) map[s
 				continue
 			}
 
-			key := cleanedKey(entry.Key)
-			entries[i].Value = e.GetParameterArn(key)
+			reference, err := e.secretAdapter.Reference(ctx, cleanedKey(entry.Key))
+			if err != nil {
+				result[entry.Key] = err
+				continue
+			}
+			entries[i].Value = reference
+			e.recordVersion(ctx, &entries[i])
 		}
 	}
 
@@ -63,22 +131,504 @@ func (e *EntryUseCase) Upsert(ctx context.Context, entries []models.Entry) map[s
 				result[entry.Key] = err
 			}
 		}
+		if result[entry.Key] == nil {
+			e.index(ctx, entry)
+			e.dropMovedSecret(ctx, previous[entry.Key], entry)
+		}
 	}
 
 	return result
 }
 
+// recordVersion keeps the version and the AWS principal of the secret just written in the
+// entry, drift compares them with the parameter to find changes made outside nbox
+func (e *EntryUseCase) recordVersion(ctx context.Context, entry *models.Entry) {
+	metadata, err := e.secretAdapter.Describe(ctx, entry.Value)
+	if err != nil || metadata == nil {
+		log.Printf("Err version of %s not recorded. %v\n", entry.Key, err)
+		return
+	}
+	entry.SecretVersion = metadata.CurrentVersion()
+	entry.SecretUser = metadata.LastModifiedUser
+}
+
+// storedReferences references of the stored secure entries, by key
+func (e *EntryUseCase) storedReferences(ctx context.Context, entries []models.Entry) map[string]string {
+	references := map[string]string{}
+	for _, entry := range entries {
+		stored, err := e.entryAdapter.Retrieve(ctx, e.storedKey(entry.Key))
+		if err == nil && stored != nil && stored.Secure {
+			references[entry.Key] = stored.Value
+		}
+	}
+	return references
+}
+
+// dropMovedSecret deletes the previous secret of the entry when its value moved to the
+// other store, e.g. a key covered by NBOX_SECRETS_MANAGER_PREFIXES after it was written
+// to parameter store. References of the same store name the same secret.
+func (e *EntryUseCase) dropMovedSecret(ctx context.Context, previous string, entry models.Entry) {
+	if previous == "" || !entry.Secure || secretsManagerReference(previous) == secretsManagerReference(entry.Value) {
+		return
+	}
+	if err := e.secretAdapter.Delete(ctx, previous); err != nil {
+		log.Printf("Err delete secret %s of %s. %v\n", previous, entry.Key, err)
+	}
+}
+
+// secretsManagerReference the reference is a secrets manager ARN, parameter names and ARNs otherwise
+func secretsManagerReference(reference string) bool {
+	parts := strings.SplitN(reference, ":", 4)
+	return len(parts) == 4 && parts[0] == "arn" && parts[2] == "secretsmanager"
+}
+
+// preserveMetadata keeps the metadata of the stored entries the upsert doesn't send, so
+// updating a value doesn't lose it. The fields listed in clear are removed instead, the
+// entries with unknown fields are reported in the result.
+func (e *EntryUseCase) preserveMetadata(ctx context.Context, entries []models.Entry, result map[string]error) []models.Entry {
+	preserved := make([]models.Entry, 0, len(entries))
+
+	for _, entry := range entries {
+		clear := map[string]bool{}
+		for _, field := range entry.Clear {
+			if !slices.Contains(ClearFields, field) {
+				result[entry.Key] = fmt.Errorf("%w: %s, expected one of %s", ErrInvalidClear, field, strings.Join(ClearFields, ", "))
+				break
+			}
+			clear[field] = true
+		}
+		if result[entry.Key] != nil {
+			continue
+		}
+		entry.Clear = nil
+
+		stored, err := e.entryAdapter.Retrieve(ctx, e.storedKey(entry.Key))
+		if err != nil || stored == nil {
+			preserved = append(preserved, entry)
+			continue
+		}
+
+		if entry.Description == "" && !clear["description"] {
+			entry.Description = stored.Description
+		}
+		if entry.Owner == "" && !clear["owner"] {
+			entry.Owner = stored.Owner
+		}
+		if entry.Link == "" && !clear["link"] {
+			entry.Link = stored.Link
+		}
+		if entry.Labels == nil && !clear["labels"] {
+			entry.Labels = stored.Labels
+		}
+		if entry.Schema == nil && !clear["schema"] {
+			entry.Schema = stored.Schema
+		}
+		if entry.ExpiresAt == nil && !clear["expiresAt"] {
+			entry.ExpiresAt = stored.ExpiresAt
+		}
+		preserved = append(preserved, entry)
+	}
+
+	return preserved
+}
+
+// validate returns the entries whose value matches its schema, the
+// violations are reported in the result
+func (e *EntryUseCase) validate(entries []models.Entry, result map[string]error) []models.Entry {
+	valid := make([]models.Entry, 0, len(entries))
+
+	for _, entry := range entries {
+		if schema := e.Schema(entry); schema != nil {
+			if violation := ValidateValue(*schema, entry.Value); violation != "" {
+				result[entry.Key] = fmt.Errorf("%w: %s %s", ErrInvalidValue, entry.Key, violation)
+				continue
+			}
+		}
+		valid = append(valid, entry)
+	}
+
+	return valid
+}
+
+// Schema declared by the entry, or by the schema of its prefix. The entry Key is the full key.
+func (e *EntryUseCase) Schema(entry models.Entry) *models.ValueSchema {
+	if entry.Schema != nil {
+		return entry.Schema
+	}
+	return e.schemas.Schema(e.storedKey(entry.Key))
+}
+
+// Validate checks the entries under the prefix against the schemas: required keys
+// that are missing and stored values of the wrong type. Secure values aren't read.
+func (e *EntryUseCase) Validate(ctx context.Context, prefix string) ([]string, error) {
+	violations := make([]string, 0)
+	existing := map[string]bool{}
+
+	err := e.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+		existing[key] = true
+		if entry.Secure {
+			return nil
+		}
+		entry.Key = key
+		if schema := e.Schema(entry); schema != nil {
+			if violation := ValidateValue(*schema, entry.Value); violation != "" {
+				violations = append(violations, fmt.Sprintf("%s %s", key, violation))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range e.schemas.Required(prefix) {
+		if !existing[key] {
+			violations = append(violations, fmt.Sprintf("%s is required", key))
+		}
+	}
+	sort.Strings(violations)
+
+	return violations, nil
+}
+
+// storedKey key as it's written by the entries backend, keys outside the
+// allowed prefixes are stored under the default prefix
+func (e *EntryUseCase) storedKey(key string) string {
+	return e.config.StoredKey(key)
+}
+
+// List entries under the prefix matching the owner and labels of the filter
+func (e *EntryUseCase) List(ctx context.Context, prefix string, filter models.EntryFilter) ([]models.Entry, error) {
+	entries, err := e.entryAdapter.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]models.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if filter.Match(entry) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Retrieve the entry, with resolve its ${ref:...} expressions are resolved in Resolved.
+// Secure values, its own or referenced, are only read with reveal.
+func (e *EntryUseCase) Retrieve(ctx context.Context, key string, resolve bool, reveal bool) (*models.Entry, error) {
+	entry, err := e.entryAdapter.Retrieve(ctx, key)
+	if err != nil || entry == nil || !resolve {
+		return entry, err
+	}
+
+	value := entry.Value
+	if entry.Secure {
+		if !reveal {
+			return entry, nil
+		}
+		if value, err = e.secretAdapter.Retrieve(ctx, entry.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	entry.Resolved, err = e.references.Resolve(ctx, entry.Key, value, reveal)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Expiring entries under the prefix that expire within the duration, the expired
+// ones included, sorted by expiration
+func (e *EntryUseCase) Expiring(ctx context.Context, prefix string, within time.Duration) ([]models.Entry, error) {
+	limit := time.Now().Add(within)
+	expiring := make([]models.Entry, 0)
+
+	err := e.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(limit) {
+			entry.Path = e.pathUseCase.PathWithoutKey(key)
+			entry.Key = e.pathUseCase.BaseKey(key)
+			expiring = append(expiring, entry)
+		}
+		return nil
+	})
+
+	sort.SliceStable(expiring, func(i, j int) bool { return expiring[i].ExpiresAt.Before(*expiring[j].ExpiresAt) })
+
+	return expiring, err
+}
+
+// ParseWithin duration with days support, 14d or 36h
+func ParseWithin(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Usages boxes whose templates reference the key
+func (e *EntryUseCase) Usages(ctx context.Context, key string) ([]string, error) {
+	return e.usageAdapter.Usages(ctx, key)
+}
+
+// Orphans entries under the prefix that no template references
+func (e *EntryUseCase) Orphans(ctx context.Context, prefix string) ([]string, error) {
+	orphans := make([]string, 0)
+
+	err := e.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+		boxes, err := e.usageAdapter.Usages(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(boxes) == 0 {
+			orphans = append(orphans, key)
+		}
+		return nil
+	})
+
+	return orphans, err
+}
+
+// Walk visits every entry under the prefix, descending into the nested folders
+func (e *EntryUseCase) Walk(ctx context.Context, prefix string, fn func(key string, entry models.Entry) error) error {
+	return walk(ctx, e.entryAdapter, e.pathUseCase, prefix, fn)
+}
+
+func walk(ctx context.Context, adapter domain.EntryAdapter, pathUseCase *PathUseCase, prefix string, fn func(key string, entry models.Entry) error) error {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+
+	entries, err := adapter.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key := pathUseCase.Concat(prefix, entry.Key)
+		if strings.HasSuffix(entry.Key, "/") {
+			if err = walk(ctx, adapter, pathUseCase, key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = fn(key, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the entry. Keys still referenced by a template are only deleted
+// with force, the usages are returned as warnings. Keys with nested entries are
+// deleted through DeletePrefix.
+func (e *EntryUseCase) Delete(ctx context.Context, key string, force bool) ([]string, error) {
+	key = strings.Trim(strings.TrimSpace(key), "/")
+
+	nested := 0
+	err := e.Walk(ctx, key, func(string, models.Entry) error {
+		nested++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if nested > 0 {
+		return nil, fmt.Errorf("%w: %s has %d nested entries", ErrPrefixDelete, key, nested)
+	}
+
+	return e.remove(ctx, key, []string{key}, force)
+}
+
+// DeletePrefix removes the prefix and every key nested under it. Without token it's a
+// dry run, the listing of the keys is returned with the token that confirms it. The
+// token is signed for the user and the listing and expires after ConfirmationTTL, so a
+// stale or borrowed confirmation is refused. Protected prefixes are only deleted by
+// privileged users.
+func (e *EntryUseCase) DeletePrefix(ctx context.Context, prefix string, token string, force bool) (*models.PrefixDelete, error) {
+	if !e.config.PrefixDelete {
+		return nil, fmt.Errorf("%w: disabled with NBOX_PREFIX_DELETE", ErrPrefixDelete)
+	}
+	if len(e.tokenKey) == 0 {
+		return nil, fmt.Errorf("%w: NBOX_CONFIRMATION_KEY is required", ErrPrefixDelete)
+	}
+
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return nil, fmt.Errorf("%w: prefix is required", ErrPrefixDelete)
+	}
+
+	plan := &models.PrefixDelete{Prefix: prefix, Keys: make([]string, 0), Warnings: make([]string, 0)}
+
+	entry, err := e.entryAdapter.Retrieve(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		plan.Keys = append(plan.Keys, prefix)
+	}
+	err = e.Walk(ctx, prefix, func(key string, _ models.Entry) error {
+		plan.Keys = append(plan.Keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Keys) == 0 {
+		return nil, fmt.Errorf("%w: nothing under %s", ErrPrefixDelete, prefix)
+	}
+	sort.Strings(plan.Keys)
+
+	plan.Protected = e.protected(prefix)
+
+	if token == "" {
+		plan.DryRun = true
+		plan.Token = e.deleteToken(ctx, prefix, plan.Keys, time.Now().Add(ConfirmationTTL))
+		for _, key := range plan.Keys {
+			boxes, err := e.usageAdapter.Usages(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if len(boxes) > 0 {
+				plan.Warnings = append(plan.Warnings, (&UsageError{Key: key, Boxes: boxes}).Error())
+			}
+		}
+		return plan, nil
+	}
+
+	if plan.Protected && !e.privileged(ctx) {
+		return nil, fmt.Errorf("%w: %s", ErrProtectedPrefix, prefix)
+	}
+	if err = e.confirm(ctx, prefix, plan.Keys, token); err != nil {
+		return nil, err
+	}
+	plan.Token = token
+
+	plan.Warnings, err = e.remove(ctx, prefix, plan.Keys, force)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// remove deletes the key and its nested keys after checking the protected prefixes
+// and their usages
+func (e *EntryUseCase) remove(ctx context.Context, key string, keys []string, force bool) ([]string, error) {
+	if e.protected(key) && !e.privileged(ctx) {
+		return nil, fmt.Errorf("%w: %s", ErrProtectedPrefix, key)
+	}
+
+	warnings := make([]string, 0)
+
+	for _, k := range keys {
+		boxes, err := e.usageAdapter.Usages(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if len(boxes) == 0 {
+			continue
+		}
+		usage := &UsageError{Key: k, Boxes: boxes}
+		if !force {
+			return nil, usage
+		}
+		warnings = append(warnings, usage.Error())
+	}
+
+	if err := e.entryAdapter.Delete(ctx, key); err != nil {
+		return warnings, err
+	}
+
+	for _, k := range keys {
+		if err := e.searchAdapter.Replace(ctx, k, nil); err != nil {
+			log.Printf("Err search index not updated %s. %v\n", k, err)
+		}
+	}
+
+	return warnings, nil
+}
+
+// protected the prefix is, contains or is under a protected prefix
+func (e *EntryUseCase) protected(prefix string) bool {
+	for _, p := range e.config.ProtectedPrefixes {
+		p = strings.Trim(p, "/")
+		if p == "" {
+			continue
+		}
+		if prefix == p || strings.HasPrefix(prefix, p+"/") || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// privileged the user of the request has the privileged role, or is listed in the
+// legacy NBOX_PRIVILEGED_USERS, and can delete protected prefixes
+func (e *EntryUseCase) privileged(ctx context.Context) bool {
+	user, _ := ctx.Value(application.RequestUserName).(string)
+	if user == "" {
+		return false
+	}
+	if slices.Contains(e.config.PrivilegedUsers, user) {
+		return true
+	}
+	return e.config.PrivilegedRole != "" && slices.Contains(e.config.UserRoles[user], e.config.PrivilegedRole)
+}
+
+// deleteToken confirmation token of the listing of a prefix delete, <expiry unix>.<hmac>
+// signed for the user of the request
+func (e *EntryUseCase) deleteToken(ctx context.Context, prefix string, keys []string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + hex.EncodeToString(e.sign(ctx, prefix, keys, expiry))
+}
+
+// confirm the token was signed for this user and listing and hasn't expired
+func (e *EntryUseCase) confirm(ctx context.Context, prefix string, keys []string, token string) error {
+	expiry, signature, found := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if !found || err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidConfirmation)
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, e.sign(ctx, prefix, keys, expiry)) {
+		return fmt.Errorf("%w: the entries under %s changed, run the dry run again", ErrInvalidConfirmation, prefix)
+	}
+	if time.Now().After(time.Unix(unix, 0)) {
+		return fmt.Errorf("%w: the token expired, run the dry run again", ErrInvalidConfirmation)
+	}
+	return nil
+}
+
+func (e *EntryUseCase) sign(ctx context.Context, prefix string, keys []string, expiry string) []byte {
+	user, _ := ctx.Value(application.RequestUserName).(string)
+	mac := hmac.New(sha256.New, e.tokenKey)
+	mac.Write([]byte(strings.Join(append([]string{user, prefix, expiry}, keys...), "\n")))
+	return mac.Sum(nil)
+}
+
 func (e *EntryUseCase) GetParameterArn(key string) string {
-	if e.config.ParameterShortArn && !strings.HasPrefix(key, "/") {
+	return ParameterReference(e.config, key)
+}
+
+// ParameterReference name or ARN of the parameter of the key stored in secure entries,
+// depends on NBOX_PARAMETER_STORE_SHORT_ARN
+func ParameterReference(config *application.Config, key string) string {
+	if config.ParameterShortArn && !strings.HasPrefix(key, "/") {
 		return "/" + key
 	}
 
-	if e.config.ParameterShortArn {
+	if config.ParameterShortArn {
 		return key
 	}
 
 	return fmt.Sprintf(
-		"arn:aws:ssm:%s:%s:parameter/%s", e.config.RegionName, e.config.AccountId, cleanedKey(key),
+		"arn:aws:ssm:%s:%s:parameter/%s", config.RegionName, config.AccountId, cleanedKey(key),
 	)
 }
 
@@ -0,0 +1,254 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryUseCase_Delete(t *testing.T) {
+	usages := &mockUsageAdapter{usages: map[string][]string{
+		"widget-x/development/key": {"widget-x/development/task_definition.json"},
+	}}
+	useCase := NewEntryUseCase(&mockEntryAdapter{}, nil, usages, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, &application.Config{})
+
+	_, err := useCase.Delete(context.Background(), "widget-x/development", false)
+	if !errors.Is(err, ErrPrefixDelete) {
+		t.Errorf(`Expected ErrPrefixDelete got: %v`, err)
+	}
+
+	useCase = NewEntryUseCase(&mockEntryAdapter{entries: []models.Entry{}}, nil, usages, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, &application.Config{})
+
+	_, err = useCase.Delete(context.Background(), "widget-x/development/key", false)
+	if !errors.Is(err, ErrEntryInUse) {
+		t.Errorf(`Expected ErrEntryInUse got: %v`, err)
+	}
+
+	warnings, err := useCase.Delete(context.Background(), "widget-x/development/key", true)
+	if err != nil || len(warnings) != 1 {
+		t.Errorf(`Expected 1 warning got: %v, err %v`, warnings, err)
+	}
+
+	config := &application.Config{ProtectedPrefixes: []string{"widget-x/"}, PrivilegedRole: "admin", UserRoles: map[string][]string{"jane": {"admin"}}}
+	useCase = NewEntryUseCase(&mockEntryAdapter{entries: []models.Entry{}}, nil, usages, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, config)
+
+	user := context.WithValue(context.Background(), application.RequestUserName, "john")
+	if _, err = useCase.Delete(user, "widget-x/development/key", true); !errors.Is(err, ErrProtectedPrefix) {
+		t.Errorf(`Expected ErrProtectedPrefix got: %v`, err)
+	}
+
+	admin := context.WithValue(context.Background(), application.RequestUserName, "jane")
+	if _, err = useCase.Delete(admin, "widget-x/development/key", true); err != nil {
+		t.Errorf(`Expected the key deleted by the privileged role got: %v`, err)
+	}
+}
+
+func TestEntryUseCase_DeletePrefix(t *testing.T) {
+	usages := &mockUsageAdapter{usages: map[string][]string{
+		"widget-x/development/key": {"widget-x/development/task_definition.json"},
+	}}
+	config := &application.Config{ProtectedPrefixes: []string{"widget-x/"}, PrivilegedUsers: []string{"admin"}, PrefixDelete: true}
+	useCase := NewEntryUseCase(&mockEntryAdapter{}, nil, usages, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, config)
+
+	// the tokens are only signed with the configured key, shared by every instance
+	admin := context.WithValue(context.Background(), application.RequestUserName, "admin")
+	if _, err := useCase.DeletePrefix(admin, "widget-x/development", "", false); !errors.Is(err, ErrPrefixDelete) {
+		t.Errorf(`Expected ErrPrefixDelete without confirmation key got: %v`, err)
+	}
+
+	config.ConfirmationKey = "9c1f0e7a54b2d83e6f0a1b2c3d4e5f60"
+	useCase = NewEntryUseCase(&mockEntryAdapter{}, nil, usages, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, config)
+
+	plan, err := useCase.DeletePrefix(admin, "widget-x/development", "", false)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !plan.DryRun || !plan.Protected || len(plan.Keys) != 4 || len(plan.Warnings) != 1 || plan.Token == "" {
+		t.Errorf(`Expected a protected dry run of 4 keys with 1 warning got: %+v`, plan)
+	}
+
+	user := context.WithValue(context.Background(), application.RequestUserName, "john")
+	if _, err = useCase.DeletePrefix(user, "widget-x/development", plan.Token, true); !errors.Is(err, ErrProtectedPrefix) {
+		t.Errorf(`Expected ErrProtectedPrefix got: %v`, err)
+	}
+
+	if _, err = useCase.DeletePrefix(admin, "widget-x/development", "stale", true); !errors.Is(err, ErrInvalidConfirmation) {
+		t.Errorf(`Expected ErrInvalidConfirmation got: %v`, err)
+	}
+	if _, err = useCase.DeletePrefix(admin, "widget-x/development", plan.Token, false); !errors.Is(err, ErrEntryInUse) {
+		t.Errorf(`Expected ErrEntryInUse got: %v`, err)
+	}
+
+	other := context.WithValue(context.Background(), application.RequestUserName, "root")
+	config.PrivilegedUsers = append(config.PrivilegedUsers, "root")
+	if _, err = useCase.DeletePrefix(other, "widget-x/development", plan.Token, true); !errors.Is(err, ErrInvalidConfirmation) {
+		t.Errorf(`Expected ErrInvalidConfirmation for the token of another user got: %v`, err)
+	}
+	expired := useCase.deleteToken(admin, "widget-x/development", plan.Keys, time.Now().Add(-time.Minute))
+	if _, err = useCase.DeletePrefix(admin, "widget-x/development", expired, true); !errors.Is(err, ErrInvalidConfirmation) {
+		t.Errorf(`Expected ErrInvalidConfirmation for an expired token got: %v`, err)
+	}
+
+	deleted, err := useCase.DeletePrefix(admin, "widget-x/development", plan.Token, true)
+	if err != nil || deleted.DryRun || len(deleted.Warnings) != 1 {
+		t.Errorf(`Expected the prefix deleted with 1 warning got: %+v, err %v`, deleted, err)
+	}
+
+	config.PrefixDelete = false
+	if _, err = useCase.DeletePrefix(admin, "widget-x/development", "", false); !errors.Is(err, ErrPrefixDelete) {
+		t.Errorf(`Expected ErrPrefixDelete when disabled got: %v`, err)
+	}
+}
+
+func TestEntryUseCase_RetrieveReferences(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/db", Key: "host", Value: "db.internal"},
+		{Path: "production/db", Key: "port", Value: "5432"},
+		{Path: "production/db", Key: "password", Value: "/production/db/password", Secure: true},
+		{Path: "production/api", Key: "db_url", Value: "postgres://${ref:production/db/host}:${ref:production/db/port}"},
+		{Path: "production/api", Key: "dsn", Value: "${ref:production/api/db_url}?password=${ref:production/db/password}"},
+		{Path: "production/api", Key: "loop", Value: "${ref:production/api/loop2}"},
+		{Path: "production/api", Key: "loop2", Value: "${ref:production/api/loop}"},
+		{Path: "production/api", Key: "mixed", Value: "${ref:Production/db/host}/${ref:app/region}"},
+		{Path: "global/app", Key: "region", Value: "eu-west-1"},
+	}}
+	mockSecret := &mockSecretAdapter{secrets: map[string]string{"/production/db/password": "s3cr3t"}}
+	useCase := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), NewReferenceUseCase(mockEntry, mockSecret, testConfig), nil, &application.Config{})
+
+	entry, err := useCase.Retrieve(context.Background(), "production/api/db_url", true, false)
+	if err != nil || entry.Resolved != "postgres://db.internal:5432" || !strings.HasPrefix(entry.Value, "postgres://${ref:") {
+		t.Errorf(`Expected raw and resolved value got: %v, err %v`, entry, err)
+	}
+
+	_, err = useCase.Retrieve(context.Background(), "production/api/dsn", true, false)
+	if !errors.Is(err, ErrReferenceSecure) {
+		t.Errorf(`Expected ErrReferenceSecure got: %v`, err)
+	}
+
+	entry, err = useCase.Retrieve(context.Background(), "production/api/dsn", true, true)
+	if err != nil || entry.Resolved != "postgres://db.internal:5432?password=s3cr3t" {
+		t.Errorf(`Expected revealed value got: %v, err %v`, entry, err)
+	}
+
+	_, err = useCase.Retrieve(context.Background(), "production/api/loop", true, false)
+	if !errors.Is(err, ErrReferenceCycle) {
+		t.Errorf(`Expected ErrReferenceCycle got: %v`, err)
+	}
+
+	// references are read as the keys are stored, lowercase and under the default prefix
+	entry, err = useCase.Retrieve(context.Background(), "production/api/mixed", true, false)
+	if err != nil || entry.Resolved != "db.internal/eu-west-1" {
+		t.Errorf(`Expected the mixed case and unprefixed references resolved got: %v, err %v`, entry, err)
+	}
+}
+
+func TestEntryUseCase_UpsertPreservesMetadata(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "global/payments", Key: "flag_x", Value: "true", Owner: "payments", Description: "enables the new checkout", Labels: map[string]string{"team": "payments"}},
+	}}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, testConfig)
+
+	useCase.Upsert(context.Background(), []models.Entry{
+		{Key: "payments/flag_x", Value: "false", Link: "https://wiki.example.com/flag_x"},
+	})
+
+	if len(mockEntry.upserted) != 1 {
+		t.Fatalf(`Expected 1 upserted entry got: %v`, mockEntry.upserted)
+	}
+	entry := mockEntry.upserted[0]
+	if entry.Value != "false" || entry.Owner != "payments" || entry.Description != "enables the new checkout" ||
+		entry.Labels["team"] != "payments" || entry.Link != "https://wiki.example.com/flag_x" {
+		t.Errorf(`Expected stored metadata preserved got: %+v`, entry)
+	}
+
+	result := useCase.Upsert(context.Background(), []models.Entry{
+		{Key: "payments/flag_x", Value: "false", Clear: []string{"description", "owner"}},
+		{Key: "payments/flag_y", Value: "true", Clear: []string{"value"}},
+	})
+	if !errors.Is(result["payments/flag_y"], ErrInvalidClear) {
+		t.Errorf(`Expected ErrInvalidClear got: %v`, result["payments/flag_y"])
+	}
+	if len(mockEntry.upserted) != 2 {
+		t.Fatalf(`Expected only the valid entry upserted got: %v`, mockEntry.upserted)
+	}
+	entry = mockEntry.upserted[1]
+	if entry.Description != "" || entry.Owner != "" || entry.Labels["team"] != "payments" || entry.Clear != nil {
+		t.Errorf(`Expected description and owner cleared got: %+v`, entry)
+	}
+}
+
+func TestEntryUseCase_UpsertMovedSecret(t *testing.T) {
+	previous := "arn:aws:secretsmanager:us-east-1:111111111111:secret:production/payments/token-AbCdEf::AWSCURRENT:"
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/payments", Key: "token", Value: previous, Secure: true},
+		{Path: "production/payments", Key: "key", Value: "/production/payments/key", Secure: true},
+	}}
+	mockSecret := &mockSecretAdapter{secrets: map[string]string{previous: "t0k3n", "/production/payments/key": "k3y"}}
+	useCase := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, testConfig)
+
+	// the key is no longer covered by the secrets manager prefixes, its value moves to parameter store
+	useCase.Upsert(context.Background(), []models.Entry{
+		{Key: "production/payments/token", Value: "t0k3n-2", Secure: true},
+		{Key: "production/payments/key", Value: "k3y-2", Secure: true},
+	})
+
+	if _, ok := mockSecret.secrets[previous]; ok {
+		t.Errorf(`Expected the secret of the previous store deleted got: %v`, mockSecret.secrets)
+	}
+	if _, ok := mockSecret.secrets["/production/payments/key"]; !ok {
+		t.Errorf(`Expected the parameter of the same store kept got: %v`, mockSecret.secrets)
+	}
+}
+
+func TestEntryUseCase_ListFilter(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "global/payments", Key: "flag_x", Value: "true", Owner: "payments", Labels: map[string]string{"team": "payments", "deprecated": ""}},
+		{Path: "global/payments", Key: "flag_y", Value: "true", Owner: "payments", Labels: map[string]string{"team": "checkout"}},
+		{Path: "global/payments", Key: "timeout", Value: "30", Owner: "platform"},
+	}}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, testConfig)
+
+	tests := []struct {
+		filter models.EntryFilter
+		want   int
+	}{
+		{models.EntryFilter{}, 3},
+		{models.EntryFilter{Owner: "payments"}, 2},
+		{models.EntryFilter{Labels: map[string]string{"team": "payments"}}, 1},
+		{models.EntryFilter{Labels: map[string]string{"deprecated": ""}}, 1},
+		{models.EntryFilter{Owner: "platform", Labels: map[string]string{"team": ""}}, 0},
+	}
+
+	for _, tt := range tests {
+		entries, err := useCase.List(context.Background(), "global/payments", tt.filter)
+		if err != nil || len(entries) != tt.want {
+			t.Errorf(`List(%+v) expected %d entries got: %v, err %v`, tt.filter, tt.want, entries, err)
+		}
+	}
+}
+
+func TestEntryUseCase_Expiring(t *testing.T) {
+	now := time.Now()
+	expired, soon, later := now.Add(-time.Hour), now.Add(3*24*time.Hour), now.Add(60*24*time.Hour)
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "global/keys", Key: "later", Value: "x", ExpiresAt: &later},
+		{Path: "global/keys", Key: "soon", Value: "x", ExpiresAt: &soon},
+		{Path: "global/keys", Key: "expired", Value: "x", ExpiresAt: &expired, Expired: true},
+		{Path: "global/keys", Key: "forever", Value: "x"},
+	}}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, testConfig)
+
+	within, err := ParseWithin("14d")
+	if err != nil || within != 14*24*time.Hour {
+		t.Fatalf(`Expected 14 days got: %v, err %v`, within, err)
+	}
+
+	entries, err := useCase.Expiring(context.Background(), "global/keys", within)
+	if err != nil || len(entries) != 2 || entries[0].Key != "expired" || entries[1].Key != "soon" {
+		t.Errorf(`Expected expired and soon entries got: %v, err %v`, entries, err)
+	}
+}
@@ -0,0 +1,189 @@
+package usecases
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format of a template, it decides how the values are escaped when replaced
+type Format string
+
+const (
+	FormatRaw    Format = "raw"
+	FormatJson   Format = "json"
+	FormatYaml   Format = "yaml"
+	FormatDotenv Format = "dotenv"
+)
+
+var ErrInvalidOutput = errors.New("invalid template output")
+
+var (
+	dotenvLine   = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_.-]*=`)
+	shellSafe    = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+	yamlSafe     = regexp.MustCompile(`^[A-Za-z0-9_./@(][A-Za-z0-9_./@:() +=,-]*$`)
+	yamlSpecials = []string{": ", " #"}
+)
+
+// TemplateFormat format declared by the template name extension
+func TemplateFormat(name string) Format {
+	base := strings.ToLower(path.Base(name))
+
+	switch {
+	case strings.HasSuffix(base, ".json"):
+		return FormatJson
+	case strings.HasSuffix(base, ".yaml"), strings.HasSuffix(base, ".yml"):
+		return FormatYaml
+	case strings.HasSuffix(base, ".env"), strings.HasPrefix(base, ".env"):
+		return FormatDotenv
+	}
+
+	return FormatRaw
+}
+
+// Validate checks that a built template still parses in its format
+func (f Format) Validate(out string) error {
+	switch f {
+	case FormatJson:
+		if !json.Valid([]byte(out)) {
+			var v interface{}
+			return fmt.Errorf("%w: %s. %v", ErrInvalidOutput, f, json.Unmarshal([]byte(out), &v))
+		}
+	case FormatYaml:
+		decoder := yaml.NewDecoder(strings.NewReader(out))
+		for {
+			var v interface{}
+			err := decoder.Decode(&v)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %s. %v", ErrInvalidOutput, f, err)
+			}
+		}
+	case FormatDotenv:
+		for i, line := range strings.Split(out, "\n") {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if !dotenvLine.MatchString(trimmed) {
+				return fmt.Errorf("%w: %s. line %d", ErrInvalidOutput, f, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// quoteContext quote state at a position of the template
+type quoteContext int
+
+const (
+	contextNone quoteContext = iota
+	contextDouble
+	contextSingle
+)
+
+// scanContext returns the quote state at the end of s starting from state.
+// JSON only knows double quotes, YAML and dotenv are scanned per line.
+func (f Format) scanContext(state quoteContext, s string) quoteContext {
+	escaped := false
+
+	for _, c := range s {
+		if c == '\n' && f != FormatJson {
+			state = contextNone
+			escaped = false
+			continue
+		}
+
+		switch state {
+		case contextDouble:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				state = contextNone
+			}
+		case contextSingle:
+			if c == '\'' {
+				state = contextNone
+			}
+		default:
+			switch {
+			case c == '"':
+				state = contextDouble
+			case c == '\'' && f != FormatJson:
+				state = contextSingle
+			}
+		}
+	}
+
+	return state
+}
+
+// Escape the value for the quote state where the placeholder is found
+func (f Format) Escape(state quoteContext, value string) string {
+	switch f {
+	case FormatJson:
+		if state == contextDouble {
+			return jsonString(value)
+		}
+	case FormatYaml:
+		switch state {
+		case contextDouble:
+			return jsonString(value)
+		case contextSingle:
+			return strings.ReplaceAll(value, "'", "''")
+		default:
+			if !yamlPlain(value) {
+				return fmt.Sprintf(`"%s"`, jsonString(value))
+			}
+		}
+	case FormatDotenv:
+		switch state {
+		case contextDouble:
+			return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`).Replace(value)
+		case contextSingle:
+			return strings.ReplaceAll(value, "'", `'\''`)
+		default:
+			if !shellSafe.MatchString(value) {
+				return fmt.Sprintf("'%s'", strings.ReplaceAll(value, "'", `'\''`))
+			}
+		}
+	}
+	return value
+}
+
+// jsonString escapes the value as the content of a JSON string, without quotes
+func jsonString(value string) string {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+	encoded := strings.TrimSuffix(out.String(), "\n")
+	return encoded[1 : len(encoded)-1]
+}
+
+func yamlPlain(value string) bool {
+	if value == "" {
+		return true
+	}
+	if !yamlSafe.MatchString(value) || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, special := range yamlSpecials {
+		if strings.Contains(value, special) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package usecases
+
+import (
+	"context"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+)
+
+const secureStringType = "SecureString"
+
+// ImportUseCase creates entries from parameter store hierarchies written outside nbox
+type ImportUseCase struct {
+	entries    *EntryUseCase
+	parameters domain.ParameterSource
+}
+
+func NewImportUseCase(entryUseCase *EntryUseCase, parameters domain.ParameterSource) *ImportUseCase {
+	return &ImportUseCase{entries: entryUseCase, parameters: parameters}
+}
+
+// Import creates an entry for each parameter under the path, the key is the parameter
+// name. String parameters become plain entries with their value and SecureString ones
+// secure entries referencing the existing parameter, the secret isn't copied. Keys that
+// already exist with the same value or reference are unchanged, so running it again only
+// imports the new parameters, and keys with another value are reported as conflicts.
+func (i *ImportUseCase) Import(ctx context.Context, path string, dryRun bool) (*models.ImportReport, error) {
+	path = "/" + strings.Trim(strings.TrimSpace(path), "/")
+
+	report := &models.ImportReport{
+		Path:      path,
+		DryRun:    dryRun,
+		Imported:  make([]string, 0),
+		Conflicts: make([]models.ImportConflict, 0),
+	}
+
+	parameters, err := i.parameters.Parameters(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]models.Entry, 0)
+	secure := make([]models.Entry, 0)
+	for _, parameter := range parameters {
+		key := strings.TrimPrefix(parameter.Name, "/")
+		if !i.allowed(key) {
+			report.Conflicts = append(report.Conflicts, models.ImportConflict{Key: key, Parameter: parameter.Name, Reason: "prefix not allowed"})
+			continue
+		}
+
+		entry := models.Entry{Key: key, Value: parameter.Value}
+		if parameter.Type == secureStringType {
+			entry.Secure = true
+			entry.Value = parameter.ARN
+			if i.entries.config.ParameterShortArn {
+				entry.Value = parameter.Name
+			}
+		}
+
+		// the backend stores the keys in lowercase, mixed case names are compared with the stored key
+		existing, err := i.entries.entryAdapter.Retrieve(ctx, i.entries.storedKey(key))
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if existing.Secure == entry.Secure && sameImport(existing, entry) {
+				report.Unchanged++
+				continue
+			}
+			report.Conflicts = append(report.Conflicts, models.ImportConflict{Key: key, Parameter: parameter.Name, Reason: "key exists with another value"})
+			continue
+		}
+
+		if entry.Secure {
+			secure = append(secure, entry)
+		} else {
+			plain = append(plain, entry)
+		}
+	}
+
+	if dryRun {
+		for _, entry := range append(plain, secure...) {
+			report.Imported = append(report.Imported, entry.Key)
+		}
+	} else {
+		i.write(ctx, plain, secure, report)
+	}
+
+	sort.Strings(report.Imported)
+	sort.Slice(report.Conflicts, func(a, b int) bool { return report.Conflicts[a].Key < report.Conflicts[b].Key })
+
+	return report, nil
+}
+
+// write plain entries through the upsert and the secure references straight to the
+// backend, the parameters are left as they are
+func (i *ImportUseCase) write(ctx context.Context, plain []models.Entry, secure []models.Entry, report *models.ImportReport) {
+	if len(plain) > 0 {
+		for key, err := range i.entries.Upsert(ctx, plain) {
+			if err != nil {
+				report.Conflicts = append(report.Conflicts, models.ImportConflict{Key: key, Parameter: "/" + key, Reason: err.Error()})
+				continue
+			}
+			report.Imported = append(report.Imported, key)
+		}
+	}
+
+	if len(secure) > 0 {
+		result := i.entries.entryAdapter.Upsert(ctx, secure)
+		for _, entry := range secure {
+			if err := result[entry.Key]; err != nil {
+				report.Conflicts = append(report.Conflicts, models.ImportConflict{Key: entry.Key, Parameter: parameterName(entry.Value), Reason: err.Error()})
+				continue
+			}
+			i.entries.index(ctx, entry)
+			report.Imported = append(report.Imported, entry.Key)
+		}
+	}
+}
+
+func (i *ImportUseCase) allowed(key string) bool {
+	key = strings.ToLower(key)
+	for _, prefix := range i.entries.config.AllowedPrefixes {
+		if strings.HasPrefix(key, strings.Trim(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameImport the existing entry has the value of the parameter, or references it
+func sameImport(existing *models.Entry, entry models.Entry) bool {
+	if entry.Secure {
+		return parameterName(existing.Value) == parameterName(entry.Value)
+	}
+	return existing.Value == entry.Value
+}
@@ -0,0 +1,74 @@
+package usecases
+
+import (
+	"context"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+type mockParameterSource struct {
+	parameters []models.ExternalParameter
+}
+
+func (m *mockParameterSource) Parameters(ctx context.Context, path string) ([]models.ExternalParameter, error) {
+	return m.parameters, nil
+}
+
+func TestImportUseCase_Import(t *testing.T) {
+	config := *testConfig
+	config.ParameterShortArn = true
+
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/payments", Key: "timeout", Value: "10"},
+		{Path: "production/payments", Key: "debug", Value: "false"},
+		{Path: "production/payments", Key: "db_port", Value: "5432"},
+		{Path: "production/payments", Key: "region", Value: "us-east-1"},
+	}}
+	source := &mockParameterSource{parameters: []models.ExternalParameter{
+		{Name: "/production/payments/db_host", Type: "String", Value: "db.internal"},
+		{Name: "/production/payments/db_password", ARN: "arn:aws:ssm:us-east-1:111111111111:parameter/production/payments/db_password", Type: "SecureString"},
+		{Name: "/production/payments/timeout", Type: "String", Value: "30"},
+		{Name: "/production/payments/debug", Type: "String", Value: "false"},
+		{Name: "/production/payments/DB_PORT", Type: "String", Value: "5432"},
+		{Name: "/production/payments/Region", Type: "String", Value: "eu-west-1"},
+		{Name: "/legacy/payments/token", Type: "String", Value: "x"},
+	}}
+	entries := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, nil, &config)
+	useCase := NewImportUseCase(entries, source)
+
+	report, err := useCase.Import(context.Background(), "/production/payments", false)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if expected := []string{"production/payments/db_host", "production/payments/db_password"}; !reflect.DeepEqual(report.Imported, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, report.Imported)
+	}
+	conflicts := make([]string, 0)
+	for _, conflict := range report.Conflicts {
+		conflicts = append(conflicts, conflict.Key)
+	}
+	if expected := []string{"legacy/payments/token", "production/payments/Region", "production/payments/timeout"}; !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf(`Expected conflicts %v got: %v`, expected, conflicts)
+	}
+	if report.Unchanged != 2 {
+		t.Errorf(`Expected the existing debug and DB_PORT unchanged got: %d`, report.Unchanged)
+	}
+
+	for _, entry := range mockEntry.upserted {
+		if entry.Key == "production/payments/db_password" && (!entry.Secure || entry.Value != "/production/payments/db_password") {
+			t.Errorf(`Expected a reference to the existing parameter got: %v`, entry)
+		}
+		entry.Path, entry.Key = NewPathUseCase().PathWithoutKey(entry.Key), NewPathUseCase().BaseKey(entry.Key)
+		mockEntry.entries = append(mockEntry.entries, entry)
+	}
+
+	report, err = useCase.Import(context.Background(), "/production/payments", false)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(report.Imported) != 0 || report.Unchanged != 4 {
+		t.Errorf(`Expected only the delta imported again got: %+v`, report)
+	}
+}
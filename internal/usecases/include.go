@@ -0,0 +1,149 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ExpressionInclude = `{{>\s*(.*?)\s*}}` // ExpressionInclude partial reference {{> common/sidecars}}
+	OverlayBaseKey    = "$base"            // OverlayBaseKey names the partial a template overlay patches
+	MaxIncludeDepth   = 16
+)
+
+var (
+	ErrIncludeCycle   = errors.New("include cycle detected")
+	ErrIncludeDepth   = errors.New("include depth exceeded")
+	ErrInvalidOverlay = errors.New("invalid overlay")
+	ErrInvalidPartial = errors.New("invalid partial name")
+)
+
+var (
+	includePattern = regexp.MustCompile(ExpressionInclude)
+	partialName    = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+)
+
+// ValidatePartialName a partial name is a path of segments, e.g. common/sidecars, without
+// empty, relative (. or ..) or leading and trailing / segments, the names {{> name}} includes
+func ValidatePartialName(name string) error {
+	if !partialName.MatchString(name) {
+		return fmt.Errorf("%w: %q must match %s", ErrInvalidPartial, name, partialName)
+	}
+	return nil
+}
+
+// Compose retrieves a stored template and resolves its partials and base overlay.
+// The result still contains the {{ }} placeholders and :args, ready for VarsBuilder.
+func (b *BoxUseCase) Compose(ctx context.Context, service string, stage string, template string) (string, error) {
+	box, err := b.templateAdapter.RetrieveBox(ctx, service, stage, template)
+	if err != nil {
+		return "", err
+	}
+
+	return b.ComposeTemplate(ctx, fmt.Sprintf("%s/%s/%s", service, stage, template), box)
+}
+
+// ComposeTemplate resolves {{> partial}} includes and, when the template is a JSON
+// object with a "$base" member, applies it as a merge patch over that base partial.
+func (b *BoxUseCase) ComposeTemplate(ctx context.Context, name string, tmpl []byte) (string, error) {
+	return b.compose(ctx, name, tmpl, []string{})
+}
+
+func (b *BoxUseCase) compose(ctx context.Context, name string, tmpl []byte, stack []string) (string, error) {
+	for _, s := range stack {
+		if s == name {
+			return "", fmt.Errorf("%w: %s -> %s", ErrIncludeCycle, strings.Join(stack, " -> "), name)
+		}
+	}
+
+	if len(stack) >= MaxIncludeDepth {
+		return "", fmt.Errorf("%w: %s", ErrIncludeDepth, name)
+	}
+
+	stack = append(stack, name)
+
+	resolved, err := b.resolveIncludes(ctx, string(tmpl), stack)
+	if err != nil {
+		return "", err
+	}
+
+	return b.applyOverlay(ctx, resolved, stack)
+}
+
+func (b *BoxUseCase) resolveIncludes(ctx context.Context, tmpl string, stack []string) (string, error) {
+	var err error
+
+	resolved := includePattern.ReplaceAllStringFunc(tmpl, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		partial := strings.TrimSpace(includePattern.FindStringSubmatch(match)[1])
+		if err = ValidatePartialName(partial); err != nil {
+			return match
+		}
+		content, e := b.templateAdapter.RetrievePartial(ctx, partial)
+		if e != nil {
+			err = fmt.Errorf("partial %s: %w", partial, e)
+			return match
+		}
+
+		composed, e := b.compose(ctx, partial, content, stack)
+		if e != nil {
+			err = e
+			return match
+		}
+
+		return composed
+	})
+
+	return resolved, err
+}
+
+// applyOverlay a JSON object declaring the "$base" member must be a valid overlay, other
+// templates are returned as they are
+func (b *BoxUseCase) applyOverlay(ctx context.Context, tmpl string, stack []string) (string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(tmpl), "{") || !strings.Contains(tmpl, `"`+OverlayBaseKey+`"`) {
+		return tmpl, nil
+	}
+
+	var overlay map[string]interface{}
+	if err := decodeJson([]byte(tmpl), &overlay); err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrInvalidOverlay, stack[len(stack)-1], err)
+	}
+
+	base, exists := overlay[OverlayBaseKey]
+	if !exists {
+		return tmpl, nil
+	}
+	baseName, ok := base.(string)
+	if !ok || ValidatePartialName(baseName) != nil {
+		return "", fmt.Errorf("%w: %s: %s must name a partial", ErrInvalidOverlay, stack[len(stack)-1], OverlayBaseKey)
+	}
+	delete(overlay, OverlayBaseKey)
+
+	content, err := b.templateAdapter.RetrievePartial(ctx, baseName)
+	if err != nil {
+		return "", fmt.Errorf("base %s: %w", baseName, err)
+	}
+
+	composed, err := b.compose(ctx, baseName, content, stack)
+	if err != nil {
+		return "", err
+	}
+
+	patch, err := encodeJson(overlay)
+	if err != nil {
+		return "", err
+	}
+
+	merged, err := MergePatch([]byte(composed), patch)
+	if err != nil {
+		return "", fmt.Errorf("overlay %s: %w", baseName, err)
+	}
+
+	return string(merged), nil
+}
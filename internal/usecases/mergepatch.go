@@ -0,0 +1,72 @@
+package usecases
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7386) to target and returns
+// the resulting document. Objects are merged recursively, null removes a
+// member and any other value replaces the target member.
+func MergePatch(target []byte, patch []byte) ([]byte, error) {
+	var t, p interface{}
+
+	if err := decodeJson(target, &t); err != nil {
+		return nil, err
+	}
+
+	if err := decodeJson(patch, &p); err != nil {
+		return nil, err
+	}
+
+	return encodeJson(mergeValue(t, p))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for k, v := range patchObject {
+		if v == nil {
+			delete(targetObject, k)
+			continue
+		}
+		targetObject[k] = mergeValue(targetObject[k], v)
+	}
+
+	return targetObject
+}
+
+// decodeJson keeps numbers as json.Number so templates are not reformatted
+// (e.g. 256 -> 256.0) when they are merged. Data after the document is an error.
+func decodeJson(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+func encodeJson(v interface{}) ([]byte, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
@@ -0,0 +1,377 @@
+package usecases
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+)
+
+const MigrationBatchSize = 25 // MigrationBatchSize entries written and checkpointed together
+
+// Backend the adapters of one storage implementation and its config
+type Backend struct {
+	Entries   domain.EntryAdapter
+	Templates domain.TemplateAdapter
+	Secrets   domain.SecretAdapter
+	Config    *application.Config
+}
+
+// MigrationUseCase copies the entries, secrets, templates and history of a backend
+// into another one through the adapters
+type MigrationUseCase struct {
+	pathUseCase *PathUseCase
+}
+
+func NewMigrationUseCase(pathUseCase *PathUseCase) *MigrationUseCase {
+	return &MigrationUseCase{pathUseCase: pathUseCase}
+}
+
+// Migrate streams the allowed prefixes and the templates of the source into the target
+// in batches. Each batch is recorded in the checkpoint and saved, a resumed migration
+// skips what the checkpoint has. Secure entries are written to the target secret store
+// with the value read from the source. Both backends are verified at the end.
+func (m *MigrationUseCase) Migrate(
+	ctx context.Context,
+	source Backend,
+	target Backend,
+	checkpoint *models.MigrationCheckpoint,
+	save func(checkpoint *models.MigrationCheckpoint) error,
+) (*models.MigrationReport, error) {
+	if checkpoint.Done == nil {
+		checkpoint.Done = map[string]bool{}
+	}
+	report := &models.MigrationReport{Warnings: make([]string, 0)}
+
+	seen := map[string]bool{}
+	batch := make([]models.Entry, 0, MigrationBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := m.entries(ctx, source, target, batch, checkpoint, report)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		return save(checkpoint)
+	}
+
+	for _, prefix := range source.Config.AllowedPrefixes {
+		err := walk(ctx, source.Entries, m.pathUseCase, prefix, func(key string, entry models.Entry) error {
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+			if checkpoint.Done[key] {
+				report.Resumed++
+				return nil
+			}
+
+			entry.Key = key
+			entry.Path = ""
+			entry.Expired = false
+			batch = append(batch, entry)
+
+			if len(batch) == MigrationBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	err := m.boxes(ctx, source.Templates, func(box models.BoxSummary, content []byte) error {
+		path := "box:" + box.Path
+		if checkpoint.Done[path] {
+			report.Resumed++
+			return nil
+		}
+
+		written := target.Templates.UpsertBox(ctx, &models.Box{
+			Service: box.Service,
+			Stage: map[string]models.Stage{box.Stage: {
+				Templates:  []models.Template{{Name: box.Template, Value: base64.StdEncoding.EncodeToString(content), Parameters: box.Parameters}},
+				Resolution: box.Resolution,
+			}},
+		})
+		if len(written) == 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: template not written", path))
+			return nil
+		}
+		report.Templates++
+
+		if err := m.tracking(ctx, source, target, []string{path}, report); err != nil {
+			return err
+		}
+
+		checkpoint.Done[path] = true
+		return save(checkpoint)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	verification, err := m.Verify(ctx, source, target)
+	if err != nil {
+		return nil, err
+	}
+	report.Verification = *verification
+
+	sort.Strings(report.Warnings)
+
+	return report, nil
+}
+
+// entries writes the secrets and then the entries of the batch, with the reference of
+// the target, and copies their history. Failed keys aren't checkpointed.
+func (m *MigrationUseCase) entries(
+	ctx context.Context,
+	source Backend,
+	target Backend,
+	batch []models.Entry,
+	checkpoint *models.MigrationCheckpoint,
+	report *models.MigrationReport,
+) error {
+	failed := map[string]bool{}
+
+	secrets := make([]models.Entry, 0)
+	for _, entry := range batch {
+		if !entry.Secure {
+			continue
+		}
+		value, err := source.Secrets.Retrieve(ctx, entry.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Key, err)
+		}
+		secret := entry
+		secret.Value = value
+		secrets = append(secrets, secret)
+	}
+
+	if len(secrets) > 0 {
+		for key, err := range target.Secrets.Upsert(ctx, secrets) {
+			if err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", key, err))
+				failed[key] = true
+			}
+		}
+	}
+
+	entries := make([]models.Entry, 0, len(batch))
+	for _, entry := range batch {
+		if failed[entry.Key] {
+			continue
+		}
+		if entry.Secure {
+			reference, err := target.Secrets.Reference(ctx, entry.Key)
+			if err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", entry.Key, err))
+				failed[entry.Key] = true
+				continue
+			}
+			entry.Value = reference
+			report.Secrets++
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		for key, err := range target.Entries.Upsert(ctx, entries) {
+			if err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", key, err))
+				failed[key] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !failed[entry.Key] {
+			keys = append(keys, entry.Key)
+		}
+	}
+	report.Entries += len(keys)
+
+	if err := m.tracking(ctx, source, target, keys, report); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		checkpoint.Done[key] = true
+	}
+
+	return nil
+}
+
+// tracking copies the history of the keys as it is
+func (m *MigrationUseCase) tracking(ctx context.Context, source Backend, target Backend, keys []string, report *models.MigrationReport) error {
+	tracking := make([]models.Tracking, 0)
+	for _, key := range keys {
+		history, err := source.Entries.Tracking(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		for _, t := range history {
+			t.Key = key
+			tracking = append(tracking, t)
+		}
+	}
+	if len(tracking) == 0 {
+		return nil
+	}
+
+	if err := target.Entries.ImportTracking(ctx, tracking); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("tracking %s: %s", strings.Join(keys, ", "), err))
+		return nil
+	}
+	report.Tracking += len(tracking)
+
+	return nil
+}
+
+// boxes visits every template of the adapter with its content
+func (m *MigrationUseCase) boxes(ctx context.Context, adapter domain.TemplateAdapter, fn func(box models.BoxSummary, content []byte) error) error {
+	filter := models.BoxFilter{}
+	for {
+		page, err := adapter.List(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, box := range page.Boxes {
+			content, err := adapter.RetrieveBox(ctx, box.Service, box.Stage, box.Template)
+			if err != nil {
+				return fmt.Errorf("%s: %w", box.Path, err)
+			}
+			if err = fn(box, content); err != nil {
+				return err
+			}
+		}
+
+		if page.Cursor == "" {
+			return nil
+		}
+		filter.Cursor = page.Cursor
+	}
+}
+
+// Verify compares the count and the hash of every entry and template of the allowed
+// prefixes of the source in both backends
+func (m *MigrationUseCase) Verify(ctx context.Context, source Backend, target Backend) (*models.MigrationVerify, error) {
+	before, err := m.hashes(ctx, source, source.Config.AllowedPrefixes)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	after, err := m.hashes(ctx, target, source.Config.AllowedPrefixes)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+
+	verify := &models.MigrationVerify{
+		SourceHash: digest(before),
+		TargetHash: digest(after),
+		Mismatches: make([]string, 0),
+	}
+	for id := range before {
+		if strings.HasPrefix(id, "box:") {
+			verify.SourceTemplates++
+		} else {
+			verify.SourceEntries++
+		}
+		if before[id] != after[id] {
+			verify.Mismatches = append(verify.Mismatches, id)
+		}
+	}
+	for id := range after {
+		if strings.HasPrefix(id, "box:") {
+			verify.TargetTemplates++
+		} else {
+			verify.TargetEntries++
+		}
+		if _, ok := before[id]; !ok {
+			verify.Mismatches = append(verify.Mismatches, id)
+		}
+	}
+	sort.Strings(verify.Mismatches)
+
+	return verify, nil
+}
+
+// hashes of the entries under the prefixes and of the templates of the backend
+func (m *MigrationUseCase) hashes(ctx context.Context, backend Backend, prefixes []string) (map[string]string, error) {
+	hashes := map[string]string{}
+
+	for _, prefix := range prefixes {
+		err := walk(ctx, backend.Entries, m.pathUseCase, prefix, func(key string, entry models.Entry) error {
+			if entry.Secure {
+				value, err := backend.Secrets.Retrieve(ctx, entry.Value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				entry.Value = value
+			}
+			entry.Key = key
+			entry.Path = ""
+			entry.Expired = false
+			hashes[key] = hash(entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := m.boxes(ctx, backend.Templates, func(box models.BoxSummary, content []byte) error {
+		if len(box.Parameters) == 0 {
+			box.Parameters = nil
+		}
+		if len(box.Resolution) == 0 {
+			box.Resolution = nil
+		}
+		hashes["box:"+box.Path] = hash(struct {
+			Content    []byte
+			Parameters []models.Parameter
+			Resolution []string
+		}{content, box.Parameters, box.Resolution})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+func hash(value any) string {
+	content, _ := json.Marshal(value)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// digest of the sorted id and hash lines
+func digest(hashes map[string]string) string {
+	ids := make([]string, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		_, _ = fmt.Fprintf(h, "%s %s\n", id, hashes[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
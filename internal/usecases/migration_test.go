@@ -0,0 +1,112 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain/models"
+	"testing"
+)
+
+func TestMigrationUseCase_Migrate(t *testing.T) {
+	sourceConfig := *testConfig
+	sourceConfig.AllowedPrefixes = []string{"production/"}
+	targetConfig := sourceConfig
+	targetConfig.RegionName = "eu-west-1"
+	targetConfig.AccountId = "222222222222"
+
+	source := Backend{
+		Entries: &mockEntryAdapter{entries: []models.Entry{
+			{Path: "production", Key: "db_host", Value: "db.internal", Owner: "payments"},
+			{Path: "production", Key: "db_password", Value: "/production/db_password", Secure: true},
+		}},
+		Templates: &mockTemplateAdapter{},
+		Secrets:   &mockSecretAdapter{secrets: map[string]string{"/production/db_password": "s3cr3t"}},
+		Config:    &sourceConfig,
+	}
+	reference := "arn:aws:ssm:eu-west-1:222222222222:parameter/production/db_password"
+	targetEntries := &mockEntryAdapter{entries: []models.Entry{}}
+	target := Backend{
+		Entries:   targetEntries,
+		Templates: &mockTemplateAdapter{},
+		Secrets:   &mockSecretAdapter{config: &targetConfig, secrets: map[string]string{reference: "s3cr3t"}},
+		Config:    &targetConfig,
+	}
+
+	useCase := NewMigrationUseCase(NewPathUseCase())
+	checkpoint := &models.MigrationCheckpoint{}
+	saves := 0
+	save := func(*models.MigrationCheckpoint) error {
+		saves++
+		return nil
+	}
+
+	report, err := useCase.Migrate(context.Background(), source, target, checkpoint, save)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Entries != 2 || report.Secrets != 1 || saves == 0 {
+		t.Errorf(`Expected both entries migrated and checkpointed got: %+v`, report)
+	}
+	if !checkpoint.Done["production/db_host"] || !checkpoint.Done["production/db_password"] {
+		t.Errorf(`Expected the checkpoint with both keys got: %v`, checkpoint.Done)
+	}
+	if report.Verification.Verified() || len(report.Verification.Mismatches) != 2 {
+		t.Errorf(`Expected the empty target reported got: %+v`, report.Verification)
+	}
+
+	written := map[string]models.Entry{}
+	for _, entry := range targetEntries.upserted {
+		written[entry.Key] = entry
+	}
+	if written["production/db_password"].Value != reference || written["production/db_host"].Owner != "payments" {
+		t.Errorf(`Expected the target reference and the metadata kept got: %v`, written)
+	}
+
+	for _, entry := range targetEntries.upserted {
+		entry.Key = NewPathUseCase().BaseKey(entry.Key)
+		targetEntries.entries = append(targetEntries.entries, entry)
+	}
+	verification, err := useCase.Verify(context.Background(), source, target)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !verification.Verified() || verification.SourceEntries != 2 || verification.TargetEntries != 2 {
+		t.Errorf(`Expected both backends verified got: %+v`, verification)
+	}
+
+	targetEntries.upserted = nil
+	report, err = useCase.Migrate(context.Background(), source, target, checkpoint, save)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Resumed != 2 || report.Entries != 0 || len(targetEntries.upserted) != 0 {
+		t.Errorf(`Expected the resumed migration to skip the checkpoint got: %+v`, report)
+	}
+}
+
+func TestMigrationUseCase_MigrateFailedBatch(t *testing.T) {
+	config := *testConfig
+	config.AllowedPrefixes = []string{"production/"}
+
+	source := Backend{
+		Entries:   &mockEntryAdapter{entries: []models.Entry{{Path: "production", Key: "db_host", Value: "db.internal"}}},
+		Templates: &mockTemplateAdapter{},
+		Secrets:   &mockSecretAdapter{},
+		Config:    &config,
+	}
+	target := Backend{
+		Entries:   &mockEntryAdapter{entries: []models.Entry{}, err: errors.New("throttled")},
+		Templates: &mockTemplateAdapter{},
+		Secrets:   &mockSecretAdapter{},
+		Config:    &config,
+	}
+
+	checkpoint := &models.MigrationCheckpoint{}
+	report, err := NewMigrationUseCase(NewPathUseCase()).Migrate(context.Background(), source, target, checkpoint, func(*models.MigrationCheckpoint) error { return nil })
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if checkpoint.Done["production/db_host"] || report.Entries != 0 || len(report.Warnings) == 0 {
+		t.Errorf(`Expected the failed key not checkpointed got: %+v %v`, report, checkpoint.Done)
+	}
+}
@@ -0,0 +1,291 @@
+package usecases
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"nbox/internal/domain/models"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidMove  = errors.New("invalid move")
+	ErrMoveConflict = errors.New("move target already exists")
+	ErrMoveNotFound = errors.New("nothing to move")
+)
+
+// MoveUseCase renames keys and prefixes, carrying over their history, secrets
+// and, optionally, the placeholders of the templates that use them
+type MoveUseCase struct {
+	entries *EntryUseCase
+	boxes   *BoxUseCase
+}
+
+func NewMoveUseCase(entryUseCase *EntryUseCase, boxUseCase *BoxUseCase) *MoveUseCase {
+	return &MoveUseCase{entries: entryUseCase, boxes: boxUseCase}
+}
+
+// Move moves the key, or every key under the prefix, to the new location. With
+// DryRun nothing is written and the result previews the moves and rewrites.
+func (m *MoveUseCase) Move(ctx context.Context, command models.MoveCommand) (*models.MoveResult, error) {
+	if strings.Trim(command.From, "/ ") == "" || strings.Trim(command.To, "/ ") == "" {
+		return nil, fmt.Errorf("%w: from and to are required", ErrInvalidMove)
+	}
+
+	from := m.entries.storedKey(command.From)
+	to := m.entries.storedKey(command.To)
+	if from == to || strings.HasPrefix(to, from+"/") {
+		return nil, fmt.Errorf("%w: %s can't be moved into itself", ErrInvalidMove, from)
+	}
+
+	moves, entries, err := m.plan(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.MoveResult{
+		DryRun:    command.DryRun,
+		Moves:     moves,
+		Templates: make([]models.TemplateRewrite, 0),
+		Warnings:  make([]string, 0),
+	}
+
+	rewrites := map[string]string{}
+	for _, move := range moves {
+		rewrites[move.From] = move.To
+	}
+
+	var templates map[string]string
+	if command.Rewrite {
+		templates, err = m.rewrites(ctx, rewrites, result)
+	} else {
+		err = m.usages(ctx, moves, result)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if command.DryRun {
+		return result, nil
+	}
+
+	for _, move := range moves {
+		if err = m.move(ctx, move, entries[move.From]); err != nil {
+			return result, err
+		}
+	}
+
+	for _, rewrite := range result.Templates {
+		if err = m.store(ctx, rewrite.Box, templates[rewrite.Box]); err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: template not rewritten. %s", rewrite.Box, err))
+		}
+	}
+
+	return result, nil
+}
+
+// plan keys to move, the key itself and the keys under it as a prefix
+func (m *MoveUseCase) plan(ctx context.Context, from string, to string) ([]models.KeyMove, map[string]models.Entry, error) {
+	moves := make([]models.KeyMove, 0)
+	entries := map[string]models.Entry{}
+
+	entry, err := m.entries.entryAdapter.Retrieve(ctx, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry != nil {
+		moves = append(moves, models.KeyMove{From: from, To: to, Secure: entry.Secure})
+		entries[from] = *entry
+	}
+
+	err = m.entries.Walk(ctx, from, func(key string, child models.Entry) error {
+		child.Key = key
+		child.Path = ""
+		moves = append(moves, models.KeyMove{From: key, To: to + strings.TrimPrefix(key, from), Secure: child.Secure})
+		entries[key] = child
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(moves) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrMoveNotFound, from)
+	}
+
+	for _, move := range moves {
+		existing, err := m.entries.entryAdapter.Retrieve(ctx, move.To)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrMoveConflict, move.To)
+		}
+	}
+
+	sort.Slice(moves, func(i, j int) bool { return moves[i].From < moves[j].From })
+
+	return moves, entries, nil
+}
+
+// move writes the entry under the new key, links its history and removes the old one
+func (m *MoveUseCase) move(ctx context.Context, move models.KeyMove, entry models.Entry) error {
+	var err error
+	value := entry.Value
+
+	if entry.Secure {
+		if value, err = m.entries.secretAdapter.Retrieve(ctx, entry.Value); err != nil {
+			return fmt.Errorf("%s: %w", move.From, err)
+		}
+	}
+
+	moved := entry
+	moved.Key = move.To
+	moved.Path = ""
+	moved.Value = value
+	moved.Resolved = ""
+	moved.Expired = false
+
+	if err = m.entries.Upsert(ctx, []models.Entry{moved})[move.To]; err != nil {
+		return fmt.Errorf("%s: %w", move.To, err)
+	}
+
+	if err = m.entries.entryAdapter.MoveTracking(ctx, move.From, move.To); err != nil {
+		log.Printf("Err move tracking %s -> %s. %v\n", move.From, move.To, err)
+	}
+
+	// the secret is only deleted once the old entry is gone, a failed purge leaves the
+	// old key working
+	if err = m.entries.entryAdapter.Purge(ctx, move.From); err != nil {
+		return fmt.Errorf("%s: %w", move.From, err)
+	}
+
+	if entry.Secure {
+		if err = m.entries.secretAdapter.Delete(ctx, entry.Value); err != nil {
+			log.Printf("Err delete secret %s. %v\n", entry.Value, err)
+		}
+	}
+	if err = m.entries.searchAdapter.Replace(ctx, move.From, nil); err != nil {
+		log.Printf("Err search index not updated %s. %v\n", move.From, err)
+	}
+
+	return nil
+}
+
+// usages warns about the templates that still use the moved keys when they aren't rewritten,
+// they fail to build until their placeholders are updated
+func (m *MoveUseCase) usages(ctx context.Context, moves []models.KeyMove, result *models.MoveResult) error {
+	for _, move := range moves {
+		boxes, err := m.entries.usageAdapter.Usages(ctx, move.From)
+		if err != nil {
+			return err
+		}
+		if len(boxes) > 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s, not rewritten", (&UsageError{Key: move.From, Boxes: boxes}).Error()))
+		}
+	}
+	return nil
+}
+
+// rewrites replaces the placeholders of the moved keys in the templates that use
+// them, found through the where-used index. It returns the rewritten templates.
+func (m *MoveUseCase) rewrites(ctx context.Context, rewrites map[string]string, result *models.MoveResult) (map[string]string, error) {
+	boxes := map[string]bool{}
+	for from := range rewrites {
+		usages, err := m.entries.usageAdapter.Usages(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+		for _, box := range usages {
+			boxes[box] = true
+		}
+	}
+
+	names := make([]string, 0, len(boxes))
+	for box := range boxes {
+		names = append(names, box)
+	}
+	sort.Strings(names)
+
+	templates := map[string]string{}
+	for _, box := range names {
+		components := strings.SplitN(box, "/", 3)
+		if len(components) != 3 {
+			continue
+		}
+
+		raw, err := m.boxes.templateAdapter.RetrieveBox(ctx, components[0], components[1], components[2])
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: %s", box, err))
+			continue
+		}
+
+		rewritten, placeholders := m.rewrite(string(raw), components[0], components[1], components[2], rewrites)
+		if len(placeholders) == 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: uses a moved key through a partial or an arg, not rewritten", box))
+			continue
+		}
+
+		templates[box] = rewritten
+		result.Templates = append(result.Templates, models.TemplateRewrite{Box: box, Placeholders: placeholders})
+	}
+
+	return templates, nil
+}
+
+// rewrite replaces the placeholders that resolve to a moved key, keeping their
+// modifiers and the :stage arg when the new key is still under the stage
+func (m *MoveUseCase) rewrite(tmpl string, service string, stage string, template string, rewrites map[string]string) (string, map[string]string) {
+	placeholders := map[string]string{}
+
+	rewritten := regexp.MustCompile(ExpressionDouble).ReplaceAllStringFunc(tmpl, func(match string) string {
+		inner := match[2 : len(match)-2]
+		if strings.HasPrefix(strings.TrimSpace(inner), ">") {
+			return match
+		}
+
+		key, _ := PlaceholderKey(inner)
+		to, ok := rewrites[m.boxes.VarsBuilder(key, service, stage, template, map[string]string{})]
+		if !ok {
+			return match
+		}
+
+		replacement := to
+		if strings.HasPrefix(key, ":stage/") && strings.HasPrefix(to, stage+"/") {
+			replacement = ":stage/" + strings.TrimPrefix(to, stage+"/")
+		}
+
+		placeholders[key] = replacement
+		return "{{" + strings.Replace(inner, key, replacement, 1) + "}}"
+	})
+
+	return rewritten, placeholders
+}
+
+// store saves the rewritten template keeping the parameters and resolution of its stage
+func (m *MoveUseCase) store(ctx context.Context, box string, tmpl string) error {
+	components := strings.SplitN(box, "/", 3)
+	service, stage, template := components[0], components[1], components[2]
+
+	record := m.boxes.stage(ctx, service, stage)
+	s := models.Stage{
+		Templates: []models.Template{{
+			Name:       template,
+			Value:      base64.StdEncoding.EncodeToString([]byte(tmpl)),
+			Parameters: m.boxes.parameters(record, template),
+		}},
+	}
+	if record != nil {
+		s.Resolution = record.Resolution
+	}
+
+	stored := m.boxes.UpsertBox(ctx, &models.Box{Service: service, Stage: map[string]models.Stage{stage: s}})
+	if len(stored.Boxes) == 0 {
+		return fmt.Errorf("%s", strings.Join(stored.Warnings, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+func newTestMove(template *mockTemplateAdapter, entry *mockEntryAdapter, usage *mockUsageAdapter) *MoveUseCase {
+	references := NewReferenceUseCase(entry, &mockSecretAdapter{}, testConfig)
+	entries := NewEntryUseCase(entry, &mockSecretAdapter{}, usage, &mockSearchAdapter{}, NewPathUseCase(), references, nil, testConfig)
+	boxes, _ := NewBox(template, entry, usage, NewPathUseCase(), references, entries, testConfig)
+	return NewMoveUseCase(entries, boxes)
+}
+
+func TestMoveUseCase_Move(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "db_host", Value: "db.internal", Owner: "payments"},
+	}}
+	mockTemplate := &mockTemplateAdapter{template: `{"host": "{{ :stage/api/db_host | default:'localhost' }}", "other": "{{other}}"}`}
+	mockUsage := &mockUsageAdapter{usages: map[string][]string{
+		"production/api/db_host": {"payments/production/app.json"},
+	}}
+	useCase := newTestMove(mockTemplate, mockEntry, mockUsage)
+
+	preview, err := useCase.Move(context.Background(), models.MoveCommand{
+		From: "production/api", To: "production/backend", Rewrite: true, DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	expectedMoves := []models.KeyMove{{From: "production/api/db_host", To: "production/backend/db_host"}}
+	if !reflect.DeepEqual(preview.Moves, expectedMoves) {
+		t.Errorf(`Expected moves %v got: %v`, expectedMoves, preview.Moves)
+	}
+	expectedRewrites := []models.TemplateRewrite{{
+		Box:          "payments/production/app.json",
+		Placeholders: map[string]string{":stage/api/db_host": ":stage/backend/db_host"},
+	}}
+	if !reflect.DeepEqual(preview.Templates, expectedRewrites) {
+		t.Errorf(`Expected rewrites %v got: %v`, expectedRewrites, preview.Templates)
+	}
+	if len(mockEntry.upserted) != 0 {
+		t.Errorf(`Expected nothing written on dry run got: %v`, mockEntry.upserted)
+	}
+
+	result, err := useCase.Move(context.Background(), models.MoveCommand{
+		From: "production/api", To: "production/backend",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result.Templates) != 0 {
+		t.Errorf(`Expected no rewrites without rewrite got: %v`, result.Templates)
+	}
+	expectedWarnings := []string{"production/api/db_host referenced by payments/production/app.json, not rewritten"}
+	if !reflect.DeepEqual(result.Warnings, expectedWarnings) {
+		t.Errorf(`Expected warnings %v got: %v`, expectedWarnings, result.Warnings)
+	}
+	if len(mockEntry.upserted) != 1 || mockEntry.upserted[0].Key != "production/backend/db_host" ||
+		mockEntry.upserted[0].Value != "db.internal" || mockEntry.upserted[0].Owner != "payments" {
+		t.Errorf(`Expected the entry written under the new key got: %v`, mockEntry.upserted)
+	}
+}
+
+func TestMoveUseCase_MoveInvalid(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "db_host", Value: "db.internal"},
+		{Path: "production/backend", Key: "db_host", Value: "db.internal"},
+	}}
+	useCase := newTestMove(&mockTemplateAdapter{}, mockEntry, &mockUsageAdapter{})
+
+	commands := map[string]struct {
+		command  models.MoveCommand
+		expected error
+	}{
+		"empty":     {models.MoveCommand{From: "production/api"}, ErrInvalidMove},
+		"into self": {models.MoveCommand{From: "production/api", To: "production/api/v2"}, ErrInvalidMove},
+		"conflict":  {models.MoveCommand{From: "production/api/db_host", To: "production/backend/db_host"}, ErrMoveConflict},
+	}
+
+	for name, tc := range commands {
+		if _, err := useCase.Move(context.Background(), tc.command); !errors.Is(err, tc.expected) {
+			t.Errorf(`%s: expected %v got: %v`, name, tc.expected, err)
+		}
+	}
+}
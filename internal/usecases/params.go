@@ -0,0 +1,141 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"nbox/internal/domain/models"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ExpressionArg = `:([A-Za-z0-9_-]+)` // ExpressionArg template :arg
+
+var ErrInvalidParameters = errors.New("invalid template parameters")
+
+var argPattern = regexp.MustCompile(ExpressionArg)
+
+// ParameterError query args that don't match the template declaration
+type ParameterError struct {
+	violations []string
+}
+
+func (p *ParameterError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidParameters, strings.Join(p.violations, "; "))
+}
+
+func (p *ParameterError) Unwrap() error {
+	return ErrInvalidParameters
+}
+
+func (p *ParameterError) Violations() []string {
+	return p.violations
+}
+
+// ValidateArgs checks the args against the declared parameters and returns them with
+// the defaults applied. Templates without declaration accept any arg.
+func ValidateArgs(parameters []models.Parameter, args map[string]string) (map[string]string, error) {
+	if len(parameters) == 0 {
+		return args, nil
+	}
+
+	var violations []string
+	result := map[string]string{}
+	declared := map[string]bool{}
+
+	for _, parameter := range parameters {
+		declared[parameter.Name] = true
+
+		value, ok := args[parameter.Name]
+		if !ok || value == "" {
+			if parameter.Required && parameter.Default == "" {
+				violations = append(violations, fmt.Sprintf("%s is required", parameter.Name))
+				continue
+			}
+			if parameter.Default == "" {
+				continue
+			}
+			value = parameter.Default
+		}
+
+		if violation := validateParameter(parameter, value); violation != "" {
+			violations = append(violations, violation)
+			continue
+		}
+		result[parameter.Name] = value
+	}
+
+	for name := range args {
+		if !declared[name] {
+			violations = append(violations, fmt.Sprintf("%s is not declared", name))
+		}
+	}
+
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return nil, &ParameterError{violations: violations}
+	}
+
+	return result, nil
+}
+
+func validateParameter(parameter models.Parameter, value string) string {
+	var err error
+
+	switch parameter.Type {
+	case "", "string":
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	default:
+		return fmt.Sprintf("%s has unknown type %s", parameter.Name, parameter.Type)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s must be %s", parameter.Name, parameter.Type)
+	}
+
+	if len(parameter.Allowed) > 0 && !slices.Contains(parameter.Allowed, value) {
+		return fmt.Sprintf("%s must be one of %s", parameter.Name, strings.Join(parameter.Allowed, ", "))
+	}
+
+	if parameter.Pattern != "" {
+		matched, err := regexp.MatchString(fmt.Sprintf("^(?:%s)$", parameter.Pattern), value)
+		if err != nil || !matched {
+			return fmt.Sprintf("%s must match %s", parameter.Name, parameter.Pattern)
+		}
+	}
+
+	return ""
+}
+
+// replaceArgs replaces the :name tokens, the longest name wins and a name only
+// matches up to a token boundary so :service doesn't match inside :services.
+func replaceArgs(tmpl string, values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	return argPattern.ReplaceAllStringFunc(tmpl, func(match string) string {
+		token := match[1:]
+		for _, name := range names {
+			if !strings.HasPrefix(token, name) {
+				continue
+			}
+			if len(token) == len(name) || !isWordChar(token[len(name)]) {
+				return values[name] + token[len(name):]
+			}
+		}
+		return match
+	})
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
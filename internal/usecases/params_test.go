@@ -0,0 +1,61 @@
+package usecases
+
+import (
+	"errors"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+func TestValidateArgs(t *testing.T) {
+	parameters := []models.Parameter{
+		{Name: "image", Required: true, Pattern: `[a-z]+:[a-z0-9.]+`},
+		{Name: "replicas", Type: "int", Default: "2"},
+		{Name: "size", Allowed: []string{"small", "large"}},
+	}
+
+	args, err := ValidateArgs(parameters, map[string]string{"image": "nginx:latest"})
+	if err != nil {
+		t.Fatalf(`Expected no error got: %s`, err)
+	}
+	if !reflect.DeepEqual(args, map[string]string{"image": "nginx:latest", "replicas": "2"}) {
+		t.Errorf(`Expected defaults to be applied got: %v`, args)
+	}
+
+	_, err = ValidateArgs(parameters, map[string]string{"replicas": "three", "size": "medium", "other": "x"})
+	if !errors.Is(err, ErrInvalidParameters) {
+		t.Fatalf(`Expected ErrInvalidParameters got: %v`, err)
+	}
+
+	var parameterErr *ParameterError
+	errors.As(err, &parameterErr)
+	expected := []string{
+		"image is required",
+		"other is not declared",
+		"replicas must be int",
+		"size must be one of small, large",
+	}
+	if !reflect.DeepEqual(parameterErr.Violations(), expected) {
+		t.Errorf(`Expected %v got: %v`, expected, parameterErr.Violations())
+	}
+
+	args, err = ValidateArgs(nil, map[string]string{"any": "value"})
+	if err != nil || args["any"] != "value" {
+		t.Errorf(`Expected undeclared templates to accept any arg got: %v, err %v`, args, err)
+	}
+}
+
+func TestBoxUseCase_VarsBuilder(t *testing.T) {
+	useCase := newTestBox(&mockTemplateAdapter{}, &mockEntryAdapter{})
+
+	result := useCase.VarsBuilder(
+		`:service :services :service_name /ecs/nginx_:stage-api :image-name :image arn:aws:ssm`,
+		"api", "production", "task.json",
+		map[string]string{"image": "nginx", "image-name": "nginx:1", "services": "a,b"},
+	)
+
+	expected := `api a,b :service_name /ecs/nginx_production-api nginx:1 nginx arn:aws:ssm`
+	if result != expected {
+		t.Errorf(`Expected %s got: %s`, expected, result)
+	}
+}
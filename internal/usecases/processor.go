@@ -1,7 +1,7 @@
 package usecases
 
 import (
-	"fmt"
+	"encoding/json"
 	"path"
 	"regexp"
 	"strings"
@@ -10,18 +10,42 @@ import (
 type Processor struct {
 	tmpl       string
 	subPattern string
+	format     Format
+	unquoted   map[string]bool
 	vars       []string
 }
 
+type ProcessorOption func(*Processor)
+
 const (
 	ExpressionSingle = `{([^{}]*)}`
 	ExpressionDouble = `{{(.*?)}}` // ExpressionDouble double curly braces
+	ModifierRaw      = "raw"       // ModifierRaw {{ key | raw }} skips the escaping
 )
 
-func NewProcessor(tmpl string) *Processor {
+// WithFormat escapes the replaced values for the template format
+func WithFormat(format Format) ProcessorOption {
+	return func(p *Processor) {
+		p.format = format
+	}
+}
+
+// WithUnquoted keys of typed values, a JSON string holding only the placeholder
+// of one of them is replaced by the value as a literal, "{{replicas}}" -> 3
+func WithUnquoted(keys map[string]bool) ProcessorOption {
+	return func(p *Processor) {
+		p.unquoted = keys
+	}
+}
+
+func NewProcessor(tmpl string, optFns ...ProcessorOption) *Processor {
 	processor := &Processor{
 		tmpl:       tmpl,
 		subPattern: ExpressionDouble,
+		format:     FormatRaw,
+	}
+	for _, optFn := range optFns {
+		optFn(processor)
 	}
 	processor.vars = processor.populateVars()
 	return processor
@@ -45,7 +69,7 @@ func (p *Processor) GetPrefixes() []string {
 	prefixes := map[string]bool{}
 	var k []string
 	for _, v := range p.vars {
-		cleaned := strings.TrimSpace(v)
+		cleaned, _ := PlaceholderKey(v)
 		prefix := path.Dir(cleaned)
 		if prefix == "." {
 			prefix = ""
@@ -58,11 +82,62 @@ func (p *Processor) GetPrefixes() []string {
 	return k
 }
 
+// Replace the placeholders by their values escaped for the quote
+// context where each placeholder is found.
 func (p *Processor) Replace(values map[string]string) string {
-	var oldnew []string
-	for _, v := range p.vars {
-		cleaned := strings.TrimSpace(v)
-		oldnew = append(oldnew, fmt.Sprintf(`{{%s}}`, v), values[cleaned])
+	var out strings.Builder
+	r := regexp.MustCompile(p.subPattern)
+	state := contextNone
+	last := 0
+
+	for _, loc := range r.FindAllStringSubmatchIndex(p.tmpl, -1) {
+		previous := state
+		state = p.format.scanContext(state, p.tmpl[last:loc[0]])
+		key, raw := PlaceholderKey(p.tmpl[loc[2]:loc[3]])
+
+		if p.literal(previous, last, loc, key, values[key]) {
+			out.WriteString(p.tmpl[last : loc[0]-1])
+			out.WriteString(values[key])
+			state = contextNone
+			last = loc[1] + 1
+			continue
+		}
+
+		out.WriteString(p.tmpl[last:loc[0]])
+		if raw {
+			out.WriteString(values[key])
+		} else {
+			out.WriteString(p.format.Escape(state, values[key]))
+		}
+		last = loc[1]
+	}
+	out.WriteString(p.tmpl[last:])
+
+	return out.String()
+}
+
+// literal the placeholder at loc is the whole content of a JSON string and its
+// typed value is a valid JSON literal
+func (p *Processor) literal(previous quoteContext, last int, loc []int, key string, value string) bool {
+	if p.format != FormatJson || !p.unquoted[key] || !json.Valid([]byte(value)) {
+		return false
+	}
+	if loc[0] <= last || p.tmpl[loc[0]-1] != '"' || loc[1] >= len(p.tmpl) || p.tmpl[loc[1]] != '"' {
+		return false
+	}
+	// the quote before the placeholder opens the string, it isn't an escaped quote
+	return p.format.scanContext(previous, p.tmpl[last:loc[0]-1]) == contextNone
+}
+
+// PlaceholderKey entry key of a placeholder and whether it uses the raw modifier
+func PlaceholderKey(v string) (string, bool) {
+	parts := strings.Split(v, "|")
+	key := strings.TrimSpace(parts[0])
+	raw := false
+	for _, modifier := range parts[1:] {
+		if strings.TrimSpace(modifier) == ModifierRaw {
+			raw = true
+		}
 	}
-	return strings.NewReplacer(oldnew...).Replace(p.tmpl)
+	return key, raw
 }
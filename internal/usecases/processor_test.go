@@ -0,0 +1,76 @@
+package usecases
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProcessor_ReplaceEscaping(t *testing.T) {
+	values := map[string]string{
+		"global/quote":    `say "hi"\now`,
+		"global/multi":    "line1\nline2",
+		"global/replicas": "3",
+		"global/single":   "it's",
+	}
+
+	cases := []struct {
+		format   Format
+		tmpl     string
+		expected string
+	}{
+		{FormatJson, `{"a": "{{global/quote}}", "b": {{ global/replicas }}}`, `{"a": "say \"hi\"\\now", "b": 3}`},
+		{FormatJson, `{"a": "{{ global/multi | raw }}"}`, "{\"a\": \"line1\nline2\"}"},
+		{FormatYaml, "a: {{global/multi}}\nb: '{{global/single}}'\nc: {{global/replicas}}", "a: \"line1\\nline2\"\nb: 'it''s'\nc: 3"},
+		{FormatDotenv, "A={{global/single}}\nB=\"{{global/quote}}\"\nC={{global/replicas}}", "A='it'\\''s'\nB=\"say \\\"hi\\\"\\\\now\"\nC=3"},
+		{FormatRaw, `{{global/quote}}`, `say "hi"\now`},
+	}
+
+	for _, c := range cases {
+		result := NewProcessor(c.tmpl, WithFormat(c.format)).Replace(values)
+		if result != c.expected {
+			t.Errorf(`[%s] Expected %s got: %s`, c.format, c.expected, result)
+		}
+		if err := c.format.Validate(result); err != nil && c.format != FormatJson {
+			t.Errorf(`[%s] Expected valid output got: %s`, c.format, err)
+		}
+	}
+}
+
+func TestFormat_Validate(t *testing.T) {
+	if err := FormatJson.Validate(`{"a": "x"y"}`); !errors.Is(err, ErrInvalidOutput) {
+		t.Errorf(`Expected ErrInvalidOutput got: %v`, err)
+	}
+
+	if err := FormatYaml.Validate("a: [b"); !errors.Is(err, ErrInvalidOutput) {
+		t.Errorf(`Expected ErrInvalidOutput got: %v`, err)
+	}
+
+	if err := FormatDotenv.Validate("# comment\nA=1\nnot a var"); !errors.Is(err, ErrInvalidOutput) {
+		t.Errorf(`Expected ErrInvalidOutput got: %v`, err)
+	}
+
+	if TemplateFormat("task_definition.json") != FormatJson || TemplateFormat("app.yml") != FormatYaml || TemplateFormat(".env") != FormatDotenv {
+		t.Errorf(`Expected formats from template extension`)
+	}
+}
+
+func TestProcessor_ReplaceUnquoted(t *testing.T) {
+	values := map[string]string{
+		"global/replicas": "3",
+		"global/debug":    "true",
+		"global/name":     "api",
+		"global/missing":  "",
+	}
+	unquoted := map[string]bool{"global/replicas": true, "global/debug": true, "global/missing": true}
+
+	tmpl := `{"replicas": "{{global/replicas}}", "debug": "{{ global/debug }}", "name": "{{global/name}}", "label": "x-{{global/replicas}}", "escaped": "\"{{global/debug}}\"", "missing": "{{global/missing}}"}`
+	expected := `{"replicas": 3, "debug": true, "name": "api", "label": "x-3", "escaped": "\"true\"", "missing": ""}`
+
+	result := NewProcessor(tmpl, WithFormat(FormatJson), WithUnquoted(unquoted)).Replace(values)
+	if result != expected {
+		t.Errorf(`Expected %s got: %s`, expected, result)
+	}
+	if err := FormatJson.Validate(result); err != nil {
+		t.Errorf(`Expected valid output got: %s`, err)
+	}
+}
@@ -0,0 +1,137 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"regexp"
+	"strings"
+)
+
+const (
+	ExpressionReference = `\$\{ref:([^}]*)\}` // ExpressionReference entry reference ${ref:path/key}
+	MaxReferenceDepth   = 16
+)
+
+var (
+	ErrReferenceCycle    = errors.New("reference cycle detected")
+	ErrReferenceNotFound = errors.New("reference not found")
+	ErrReferenceSecure   = errors.New("reference to a secure entry")
+)
+
+var referencePattern = regexp.MustCompile(ExpressionReference)
+
+// ReferenceUseCase resolves entry values built from other entries
+type ReferenceUseCase struct {
+	entryAdapter  domain.EntryAdapter
+	secretAdapter domain.SecretAdapter
+	config        *application.Config
+}
+
+func NewReferenceUseCase(entryAdapter domain.EntryAdapter, secretAdapter domain.SecretAdapter, config *application.Config) *ReferenceUseCase {
+	return &ReferenceUseCase{entryAdapter: entryAdapter, secretAdapter: secretAdapter, config: config}
+}
+
+// HasReferences value contains ${ref:...} expressions
+func HasReferences(value string) bool {
+	return referencePattern.MatchString(value)
+}
+
+// Resolve replaces the ${ref:path/key} expressions of the value, recursively.
+// Secure entries are only read from the secret store when reveal is set.
+func (r *ReferenceUseCase) Resolve(ctx context.Context, key string, value string, reveal bool) (string, error) {
+	return r.resolve(ctx, value, reveal, []string{r.config.StoredKey(key)}, map[string]string{})
+}
+
+func (r *ReferenceUseCase) resolve(ctx context.Context, value string, reveal bool, stack []string, cache map[string]string) (string, error) {
+	var err error
+
+	resolved := referencePattern.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		var v string
+		v, err = r.reference(ctx, referencePattern.FindStringSubmatch(match)[1], reveal, stack, cache)
+		if err != nil {
+			return match
+		}
+		return v
+	})
+
+	return resolved, err
+}
+
+// reference value of the key, the key is read as the entries backend stores it, e.g.
+// ${ref:Production/db/host} reads production/db/host and ${ref:db/host} global/db/host
+func (r *ReferenceUseCase) reference(ctx context.Context, key string, reveal bool, stack []string, cache map[string]string) (string, error) {
+	key = r.config.StoredKey(key)
+
+	if v, ok := cache[key]; ok {
+		return v, nil
+	}
+
+	for _, s := range stack {
+		if s == key {
+			return "", fmt.Errorf("%w: %s -> %s", ErrReferenceCycle, strings.Join(stack, " -> "), key)
+		}
+	}
+
+	if len(stack) >= MaxReferenceDepth {
+		return "", fmt.Errorf("%w: %s", ErrReferenceCycle, key)
+	}
+
+	entry, err := r.entryAdapter.Retrieve(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", fmt.Errorf("%w: %s", ErrReferenceNotFound, key)
+	}
+
+	value := entry.Value
+	if entry.Secure {
+		if !reveal {
+			return "", fmt.Errorf("%w: %s", ErrReferenceSecure, key)
+		}
+		value, err = r.secretAdapter.Retrieve(ctx, entry.Value)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	value, err = r.resolve(ctx, value, reveal, append(stack, key), cache)
+	if err != nil {
+		return "", err
+	}
+
+	cache[key] = value
+	return value, nil
+}
+
+// Targets keys referenced by the value, directly or through the values of the referenced
+// entries. Secure entries aren't read, only their key is a target.
+func (r *ReferenceUseCase) Targets(ctx context.Context, value string) []string {
+	targets := make([]string, 0)
+	r.targets(ctx, value, map[string]bool{}, &targets)
+	return targets
+}
+
+func (r *ReferenceUseCase) targets(ctx context.Context, value string, seen map[string]bool, targets *[]string) {
+	for _, match := range referencePattern.FindAllStringSubmatch(value, -1) {
+		key := r.config.StoredKey(match[1])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		*targets = append(*targets, key)
+
+		entry, err := r.entryAdapter.Retrieve(ctx, key)
+		if err != nil || entry == nil || entry.Secure {
+			continue
+		}
+		r.targets(ctx, entry.Value, seen, targets)
+	}
+}
@@ -0,0 +1,103 @@
+package usecases
+
+import (
+	"context"
+	"nbox/internal/domain/models"
+	pkgPath "path"
+	"strings"
+)
+
+// resolvedEntry entry found for a placeholder and the key it was read from
+type resolvedEntry struct {
+	models.Entry
+	Source string
+}
+
+// Candidates keys looked up for a placeholder, in order. The key itself goes first,
+// then its base name under every layer of the chain. Without a configured chain
+// the layers are the parents of the key followed by the same parents under the
+// default prefix, e.g. production/api/timeout:
+// production/api -> production -> global/api -> global
+func (b *BoxUseCase) Candidates(key string, chain []string) []string {
+	candidates := []string{key}
+	name := pkgPath.Base(key)
+
+	if len(chain) == 0 {
+		chain = b.defaultChain(key)
+	}
+
+	for _, layer := range chain {
+		layer = strings.Trim(strings.TrimSpace(layer), "/")
+		candidate := name
+		if layer != "" {
+			candidate = layer + "/" + name
+		}
+		if candidate != key {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates
+}
+
+func (b *BoxUseCase) defaultChain(key string) []string {
+	components := strings.Split(strings.Trim(key, "/"), "/")
+	if len(components) < 2 || !b.allowedPrefix(components[0]) {
+		return nil
+	}
+
+	stage := components[0]
+	rest := components[1 : len(components)-1]
+	defaultPrefix := strings.Trim(b.config.DefaultPrefix, "/")
+
+	var chain []string
+	for _, prefix := range []string{stage, defaultPrefix} {
+		for i := len(rest); i >= 0; i-- {
+			chain = append(chain, strings.Join(append([]string{prefix}, rest[:i]...), "/"))
+		}
+		if stage == defaultPrefix {
+			break
+		}
+	}
+
+	return chain
+}
+
+func (b *BoxUseCase) allowedPrefix(stage string) bool {
+	for _, prefix := range b.config.AllowedPrefixes {
+		if strings.Trim(prefix, "/") == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve finds every key in the entries backend following the resolution chain,
+// each prefix is listed only once. Expired entries are skipped in exclude mode.
+func (b *BoxUseCase) resolve(ctx context.Context, keys []string, chain []string, expired string) map[string]resolvedEntry {
+	listed := map[string]map[string]models.Entry{}
+	resolved := map[string]resolvedEntry{}
+
+	for _, key := range keys {
+		for _, candidate := range b.Candidates(key, chain) {
+			prefix := pkgPath.Dir(candidate)
+			if prefix == "." {
+				prefix = ""
+			}
+
+			if _, ok := listed[prefix]; !ok {
+				listed[prefix] = b.lookup(ctx, []string{prefix})
+			}
+
+			if entry, ok := listed[prefix][candidate]; ok {
+				if entry.Expired && expired == ExpiredExclude {
+					continue
+				}
+				resolved[key] = resolvedEntry{Entry: entry, Source: candidate}
+				break
+			}
+		}
+	}
+
+	return resolved
+}
@@ -0,0 +1,167 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"net/mail"
+	"net/url"
+	"os"
+	pkgPath "path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeFloat    = "float"
+	TypeBool     = "bool"
+	TypeDuration = "duration"
+	TypeUrl      = "url"
+	TypeEmail    = "email"
+	TypeJson     = "json"
+	TypeEnum     = "enum"
+)
+
+var ErrInvalidValue = errors.New("invalid value")
+
+// SchemaUseCase per prefix schemas of the entries, read from NBOX_ENTRY_SCHEMA_FILE
+type SchemaUseCase struct {
+	schemas map[string]models.PrefixSchema
+}
+
+func NewSchemaUseCase(config *application.Config) (*SchemaUseCase, error) {
+	schemas := map[string]models.PrefixSchema{}
+
+	if config.EntrySchemaFile != "" {
+		content, err := os.ReadFile(config.EntrySchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		// yaml is a superset of json, both formats are accepted
+		if err = yaml.Unmarshal(content, &schemas); err != nil {
+			return nil, fmt.Errorf("%s: %w", config.EntrySchemaFile, err)
+		}
+	}
+
+	cleaned := make(map[string]models.PrefixSchema, len(schemas))
+	for prefix, schema := range schemas {
+		cleaned[strings.Trim(prefix, "/")] = schema
+	}
+
+	return &SchemaUseCase{schemas: cleaned}, nil
+}
+
+// Schema of the key declared by the nearest prefix, nil when the key isn't typed
+func (s *SchemaUseCase) Schema(key string) *models.ValueSchema {
+	if s == nil {
+		return nil
+	}
+
+	key = strings.Trim(key, "/")
+	name := pkgPath.Base(key)
+
+	for prefix := pkgPath.Dir(key); ; prefix = pkgPath.Dir(prefix) {
+		if prefix == "." {
+			prefix = ""
+		}
+		if schema, ok := s.schemas[prefix].Keys[name]; ok {
+			return &schema
+		}
+		if prefix == "" {
+			return nil
+		}
+	}
+}
+
+// Required keys of the schemas at or under the prefix
+func (s *SchemaUseCase) Required(prefix string) []string {
+	if s == nil {
+		return nil
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	keys := make([]string, 0)
+
+	for p, schema := range s.schemas {
+		if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		for _, name := range schema.Required {
+			keys = append(keys, NewPathUseCase().Concat(p, name))
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ValidateValue returns the violation of the schema by the value, empty when it's valid
+func ValidateValue(schema models.ValueSchema, value string) string {
+	var err error
+
+	switch schema.Type {
+	case "", TypeString, TypeEnum:
+	case TypeInt:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case TypeFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case TypeBool:
+		_, err = strconv.ParseBool(value)
+	case TypeDuration:
+		_, err = time.ParseDuration(value)
+	case TypeUrl:
+		var u *url.URL
+		if u, err = url.ParseRequestURI(value); err == nil && (u.Scheme == "" || u.Host == "") {
+			err = errors.New("missing scheme or host")
+		}
+	case TypeEmail:
+		var address *mail.Address
+		if address, err = mail.ParseAddress(value); err == nil && address.Address != value {
+			err = errors.New("not a bare address")
+		}
+	case TypeJson:
+		if !json.Valid([]byte(value)) {
+			err = errors.New("invalid json")
+		}
+	default:
+		return fmt.Sprintf("unknown type %s", schema.Type)
+	}
+	if err != nil {
+		return fmt.Sprintf("must be %s", schema.Type)
+	}
+
+	if (schema.Type == TypeEnum || len(schema.Allowed) > 0) && !slices.Contains(schema.Allowed, value) {
+		return fmt.Sprintf("must be one of %s", strings.Join(schema.Allowed, ", "))
+	}
+
+	if schema.Pattern != "" {
+		matched, err := regexp.MatchString(fmt.Sprintf("^(?:%s)$", schema.Pattern), value)
+		if err != nil || !matched {
+			return fmt.Sprintf("must match %s", schema.Pattern)
+		}
+	}
+
+	return ""
+}
+
+// Unquoted typed values rendered as JSON literals instead of strings
+func Unquoted(schema *models.ValueSchema) bool {
+	if schema == nil {
+		return false
+	}
+	switch schema.Type {
+	case TypeInt, TypeFloat, TypeBool, TypeJson:
+		return true
+	}
+	return false
+}
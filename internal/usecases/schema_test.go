@@ -0,0 +1,92 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/application"
+	"nbox/internal/domain/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateValue(t *testing.T) {
+	cases := []struct {
+		schema models.ValueSchema
+		value  string
+		valid  bool
+	}{
+		{models.ValueSchema{Type: TypeInt}, "3", true},
+		{models.ValueSchema{Type: TypeInt}, "three", false},
+		{models.ValueSchema{Type: TypeFloat}, "0.5", true},
+		{models.ValueSchema{Type: TypeBool}, "yes", false},
+		{models.ValueSchema{Type: TypeDuration}, "1m30s", true},
+		{models.ValueSchema{Type: TypeDuration}, "90", false},
+		{models.ValueSchema{Type: TypeUrl}, "https://api.example.com/v1", true},
+		{models.ValueSchema{Type: TypeUrl}, "api.example.com", false},
+		{models.ValueSchema{Type: TypeEmail}, "team@example.com", true},
+		{models.ValueSchema{Type: TypeEmail}, "Team <team@example.com>", false},
+		{models.ValueSchema{Type: TypeJson}, `{"a": [1, 2]}`, true},
+		{models.ValueSchema{Type: TypeJson}, `{"a": }`, false},
+		{models.ValueSchema{Type: TypeEnum, Allowed: []string{"debug", "info"}}, "info", true},
+		{models.ValueSchema{Type: TypeEnum, Allowed: []string{"debug", "info"}}, "trace", false},
+		{models.ValueSchema{Pattern: `[a-z]{2}-[a-z]+-\d`}, "us-east-1", true},
+		{models.ValueSchema{Pattern: `[a-z]{2}-[a-z]+-\d`}, "us-east-1a", false},
+		{models.ValueSchema{Type: "uuid"}, "x", false},
+	}
+
+	for _, c := range cases {
+		if violation := ValidateValue(c.schema, c.value); (violation == "") != c.valid {
+			t.Errorf(`ValidateValue(%+v, %q) expected valid=%v got: %q`, c.schema, c.value, c.valid, violation)
+		}
+	}
+}
+
+func TestSchemaUseCase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schemas.yaml")
+	content := `
+production/payments:
+  required: [db_url]
+  keys:
+    replicas: {type: int}
+production:
+  keys:
+    log_level: {type: enum, allowed: [debug, info]}
+`
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	schemas, err := NewSchemaUseCase(&application.Config{EntrySchemaFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema := schemas.Schema("production/payments/replicas"); schema == nil || schema.Type != TypeInt {
+		t.Errorf(`Expected int schema got: %v`, schema)
+	}
+	if schema := schemas.Schema("production/payments/api/log_level"); schema == nil || schema.Type != TypeEnum {
+		t.Errorf(`Expected schema of the parent prefix got: %v`, schema)
+	}
+	if schema := schemas.Schema("development/payments/replicas"); schema != nil {
+		t.Errorf(`Expected no schema got: %v`, schema)
+	}
+	if required := schemas.Required("production"); !reflect.DeepEqual(required, []string{"production/payments/db_url"}) {
+		t.Errorf(`Expected required keys got: %v`, required)
+	}
+
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{}}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), nil, schemas, testConfig)
+
+	result := useCase.Upsert(context.Background(), []models.Entry{
+		{Key: "production/payments/replicas", Value: "three"},
+		{Key: "production/payments/timeout", Value: "30s", Schema: &models.ValueSchema{Type: TypeDuration}},
+	})
+	if !errors.Is(result["production/payments/replicas"], ErrInvalidValue) || result["production/payments/timeout"] != nil {
+		t.Errorf(`Expected replicas rejected got: %v`, result)
+	}
+	if len(mockEntry.upserted) != 1 || mockEntry.upserted[0].Key != "production/payments/timeout" {
+		t.Errorf(`Expected only the valid entry upserted got: %v`, mockEntry.upserted)
+	}
+}
@@ -0,0 +1,204 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"nbox/internal/domain/models"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	SearchInKey   = "key"
+	SearchInValue = "value"
+	SearchInLabel = "label"
+
+	MaxSearchTerms      = 256 // MaxSearchTerms indexed per entry value
+	MaxSearchTermLength = 128
+)
+
+var ErrInvalidSearch = errors.New("invalid search")
+
+// Tokens lower case words of the text, split on anything but letters and digits
+func Tokens(text string) []string {
+	seen := map[string]bool{}
+	tokens := make([]string, 0)
+
+	for _, token := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if seen[token] || len(token) > MaxSearchTermLength {
+			continue
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+
+	return tokens
+}
+
+// Terms indexed for the entry: key and value tokens and its labels.
+// Values of secure entries are never indexed.
+func Terms(key string, entry models.Entry) []string {
+	terms := make([]string, 0)
+
+	for _, token := range Tokens(key) {
+		terms = append(terms, term(SearchInKey, token))
+	}
+
+	if !entry.Secure {
+		tokens := Tokens(entry.Value)
+		if len(tokens) > MaxSearchTerms {
+			tokens = tokens[:MaxSearchTerms]
+		}
+		for _, token := range tokens {
+			terms = append(terms, term(SearchInValue, token))
+		}
+	}
+
+	for k, v := range entry.Labels {
+		k, v = strings.ToLower(k), strings.ToLower(v)
+		terms = append(terms, term(SearchInLabel, k), term(SearchInLabel, fmt.Sprintf("%s:%s", k, v)))
+	}
+
+	return terms
+}
+
+func term(field string, token string) string {
+	return fmt.Sprintf("%s#%s", field, token)
+}
+
+// Search entries whose key, value or label match the query across every stage.
+// Keys and values match when they contain the query, labels are searched as
+// name or name:value. Secure values are never matched.
+func (e *EntryUseCase) Search(ctx context.Context, query string, in []string, prefix string) ([]models.Entry, error) {
+	query = strings.TrimSpace(query)
+	if len(in) == 0 {
+		in = []string{SearchInKey, SearchInValue, SearchInLabel}
+	}
+
+	prefix = strings.ToLower(strings.Trim(strings.TrimSpace(prefix), "/"))
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	matches := map[string]*models.Entry{}
+	for _, field := range in {
+		var terms []string
+		switch field {
+		case SearchInKey, SearchInValue:
+			for _, token := range Tokens(query) {
+				terms = append(terms, term(field, token))
+			}
+		case SearchInLabel:
+			if query != "" {
+				terms = []string{term(field, strings.ToLower(query))}
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown field %s", ErrInvalidSearch, field)
+		}
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("%w: empty query", ErrInvalidSearch)
+		}
+
+		keys, err := e.searchTerms(ctx, terms, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if _, ok := matches[key]; ok {
+				continue
+			}
+			entry, err := e.entryAdapter.Retrieve(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil && searchMatch(field, query, *entry) {
+				matches[key] = entry
+			}
+		}
+	}
+
+	entries := make([]models.Entry, 0, len(matches))
+	for _, entry := range matches {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries, nil
+}
+
+// searchTerms keys indexed with all the terms
+func (e *EntryUseCase) searchTerms(ctx context.Context, terms []string, prefix string) ([]string, error) {
+	var keys []string
+
+	for i, t := range terms {
+		found, err := e.searchAdapter.Search(ctx, t, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			keys = found
+			continue
+		}
+
+		set := map[string]bool{}
+		for _, key := range found {
+			set[key] = true
+		}
+		intersection := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if set[key] {
+				intersection = append(intersection, key)
+			}
+		}
+		keys = intersection
+	}
+
+	return keys, nil
+}
+
+// searchMatch the stored entry still matches, the index only holds whole tokens
+func searchMatch(field string, query string, entry models.Entry) bool {
+	query = strings.ToLower(query)
+
+	switch field {
+	case SearchInKey:
+		return strings.Contains(strings.ToLower(entry.Key), query)
+	case SearchInValue:
+		return !entry.Secure && strings.Contains(strings.ToLower(entry.Value), query)
+	case SearchInLabel:
+		k, v, withValue := strings.Cut(query, ":")
+		for name, label := range entry.Labels {
+			if strings.ToLower(name) == k && (!withValue || strings.ToLower(label) == v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// index replaces the search terms of the stored entry
+func (e *EntryUseCase) index(ctx context.Context, entry models.Entry) {
+	key := e.storedKey(entry.Key)
+	if err := e.searchAdapter.Replace(ctx, key, Terms(key, entry)); err != nil {
+		log.Printf("Err search index not updated %s. %v\n", key, err)
+	}
+}
+
+// Reindex rebuilds the search terms of the entries under the prefix
+func (e *EntryUseCase) Reindex(ctx context.Context, prefix string) (int, error) {
+	count := 0
+	err := e.Walk(ctx, prefix, func(key string, entry models.Entry) error {
+		if err := e.searchAdapter.Replace(ctx, key, Terms(key, entry)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,78 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	terms := Terms("production/api/db_url", models.Entry{
+		Value:  "postgres://db-old.internal:5432",
+		Labels: map[string]string{"Team": "Payments"},
+	})
+
+	expected := []string{
+		"key#production", "key#api", "key#db", "key#url",
+		"value#postgres", "value#db", "value#old", "value#internal", "value#5432",
+		"label#team", "label#team:payments",
+	}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, terms)
+	}
+
+	if terms = Terms("production/api/password", models.Entry{Value: "s3cr3t", Secure: true}); len(terms) != 3 {
+		t.Errorf(`Expected only key terms for secure entries got: %v`, terms)
+	}
+}
+
+func TestEntryUseCase_Search(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production/api", Key: "db_url", Value: "postgres://db-old.internal:5432", Labels: map[string]string{"team": "payments"}},
+		{Path: "development/api", Key: "db_url", Value: "postgres://db-new.internal:5432"},
+		{Path: "production/api", Key: "db_password", Value: "/production/api/db_password", Secure: true},
+		{Path: "global/api", Key: "note", Value: "old db internal"},
+	}}
+	search := &mockSearchAdapter{}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, search, NewPathUseCase(), nil, nil, testConfig)
+
+	for _, entry := range mockEntry.entries {
+		key := NewPathUseCase().Concat(entry.Path, entry.Key)
+		_ = search.Replace(context.Background(), key, Terms(key, entry))
+	}
+
+	keys := func(entries []models.Entry) []string {
+		result := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			result = append(result, entry.Key)
+		}
+		return result
+	}
+
+	cases := []struct {
+		query    string
+		in       []string
+		prefix   string
+		expected []string
+	}{
+		{"db-old.internal", []string{SearchInValue}, "", []string{"production/api/db_url"}},
+		{"internal", []string{SearchInValue}, "production", []string{"production/api/db_url"}},
+		{"db_password", nil, "", []string{"production/api/db_password"}},
+		{"production", []string{SearchInValue}, "", []string{}},
+		{"team:payments", []string{SearchInLabel}, "", []string{"production/api/db_url"}},
+		{"db_url", []string{SearchInKey}, "", []string{"development/api/db_url", "production/api/db_url"}},
+	}
+
+	for _, c := range cases {
+		entries, err := useCase.Search(context.Background(), c.query, c.in, c.prefix)
+		if err != nil || !reflect.DeepEqual(keys(entries), c.expected) {
+			t.Errorf(`Search(%q, %v, %q) expected %v got: %v, err %v`, c.query, c.in, c.prefix, c.expected, keys(entries), err)
+		}
+	}
+
+	if _, err := useCase.Search(context.Background(), "--", nil, ""); !errors.Is(err, ErrInvalidSearch) {
+		t.Errorf(`Expected ErrInvalidSearch got: %v`, err)
+	}
+}
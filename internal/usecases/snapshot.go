@@ -0,0 +1,397 @@
+package usecases
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"nbox/internal/application"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSnapshot  = errors.New("invalid snapshot")
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+var snapshotName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// SnapshotUseCase named snapshots of a stage, diffed against and restored over the current state
+type SnapshotUseCase struct {
+	snapshotAdapter domain.SnapshotAdapter
+	entries         *EntryUseCase
+	boxes           *BoxUseCase
+}
+
+func NewSnapshotUseCase(snapshotAdapter domain.SnapshotAdapter, entryUseCase *EntryUseCase, boxUseCase *BoxUseCase) *SnapshotUseCase {
+	return &SnapshotUseCase{snapshotAdapter: snapshotAdapter, entries: entryUseCase, boxes: boxUseCase}
+}
+
+// Create freezes the current state of the stage under the name, names can't be reused
+func (s *SnapshotUseCase) Create(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	if err := s.validate(stage, name); err != nil {
+		return nil, err
+	}
+
+	existing, err := s.snapshotAdapter.Retrieve(ctx, stage, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrSnapshotExists, stage, name)
+	}
+
+	snapshot, err := s.current(ctx, stage)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Name = name
+	snapshot.CreatedAt = time.Now().UTC()
+	snapshot.CreatedBy, _ = ctx.Value(application.RequestUserName).(string)
+
+	if err = s.snapshotAdapter.Save(ctx, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (s *SnapshotUseCase) Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	if err := s.validate(stage, name); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := s.snapshotAdapter.Retrieve(ctx, stage, name)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrSnapshotNotFound, stage, name)
+	}
+
+	return snapshot, nil
+}
+
+func (s *SnapshotUseCase) List(ctx context.Context, stage string) ([]models.SnapshotSummary, error) {
+	if !s.boxes.allowedPrefix(stage) {
+		return nil, fmt.Errorf("%w: stage %s not allowed", ErrInvalidSnapshot, stage)
+	}
+	return s.snapshotAdapter.List(ctx, stage)
+}
+
+// Diff changes of the current state of the stage since the snapshot, a secure entry with a
+// new version of the same value isn't a change
+func (s *SnapshotUseCase) Diff(ctx context.Context, stage string, name string) (*models.SnapshotDiff, error) {
+	snapshot, err := s.Retrieve(ctx, stage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.current(ctx, stage)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := DiffSnapshot(snapshot, current)
+	s.sameSecrets(ctx, diff, snapshot, current)
+	return diff, nil
+}
+
+// Restore reverts the stage to the snapshot. Changed and removed entries are written
+// again, secure ones with the value of the snapshot parameter version, and entries
+// created after the snapshot are soft deleted. Templates are handled the same way.
+// The reverted diff is returned, failures are reported as warnings.
+func (s *SnapshotUseCase) Restore(ctx context.Context, stage string, name string) (*models.SnapshotDiff, error) {
+	snapshot, err := s.Retrieve(ctx, stage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.current(ctx, stage)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := DiffSnapshot(snapshot, current)
+	s.sameSecrets(ctx, diff, snapshot, current)
+	diff.Warnings = make([]string, 0)
+
+	entries := map[string]models.SnapshotEntry{}
+	for _, entry := range snapshot.Entries {
+		entries[entry.Key] = entry
+	}
+
+	upserts := make([]models.Entry, 0)
+	for _, key := range append(append([]string{}, diff.Entries.Removed...), diff.Entries.Changed...) {
+		entry := entries[key]
+		if entry.Secure {
+			value, err := s.entries.secretAdapter.Retrieve(ctx, versioned(entry.Value, entry.Version))
+			if err != nil {
+				diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s: %s", key, err))
+				continue
+			}
+			entry.Value = value
+		}
+		upserts = append(upserts, entry.Entry)
+	}
+	if len(upserts) > 0 {
+		for key, err := range s.entries.Upsert(ctx, upserts) {
+			if err != nil {
+				diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s: %s", key, err))
+			}
+		}
+	}
+
+	for _, key := range diff.Entries.Added {
+		if _, err = s.entries.remove(ctx, key, []string{key}, true); err != nil {
+			diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+
+	templates := map[string]models.SnapshotTemplate{}
+	for _, template := range snapshot.Templates {
+		templates[template.Path(stage)] = template
+	}
+
+	for _, path := range append(append([]string{}, diff.Templates.Removed...), diff.Templates.Changed...) {
+		template := templates[path]
+		result := s.boxes.UpsertBox(ctx, &models.Box{
+			Service: template.Service,
+			Stage: map[string]models.Stage{stage: {
+				Templates:  []models.Template{{Name: template.Template, Value: template.Value, Parameters: template.Parameters}},
+				Resolution: template.Resolution,
+			}},
+		})
+		if len(result.Boxes) == 0 {
+			diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s: template not restored", path))
+		}
+	}
+
+	for _, path := range diff.Templates.Added {
+		components := strings.SplitN(path, "/", 3)
+		if _, err = s.boxes.DeleteBox(ctx, components[0], components[1], components[2]); err != nil {
+			diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s: %s", path, err))
+		}
+	}
+
+	sort.Strings(diff.Warnings)
+
+	return diff, nil
+}
+
+// sameSecrets drops from the changed entries the secure ones whose only change is a new
+// version with the value of the snapshot version, as written by a restore. The values are
+// read only for those entries, a failed read keeps the entry changed.
+func (s *SnapshotUseCase) sameSecrets(ctx context.Context, diff *models.SnapshotDiff, snapshot *models.Snapshot, current *models.Snapshot) {
+	before := map[string]models.SnapshotEntry{}
+	after := map[string]models.SnapshotEntry{}
+	for _, entry := range snapshot.Entries {
+		before[entry.Key] = entry
+	}
+	for _, entry := range current.Entries {
+		after[entry.Key] = entry
+	}
+
+	changed := make([]string, 0, len(diff.Entries.Changed))
+	for _, key := range diff.Entries.Changed {
+		b, a := before[key], after[key]
+		if !b.Secure || !a.Secure || b.Version == a.Version {
+			changed = append(changed, key)
+			continue
+		}
+		version := a.Version
+		a.Version = b.Version
+		if !sameEntry(b, a) {
+			changed = append(changed, key)
+			continue
+		}
+
+		old, err := s.entries.secretAdapter.Retrieve(ctx, versioned(b.Value, b.Version))
+		if err != nil {
+			changed = append(changed, key)
+			continue
+		}
+		value, err := s.entries.secretAdapter.Retrieve(ctx, versioned(a.Value, version))
+		if err != nil || value != old {
+			changed = append(changed, key)
+		}
+	}
+	diff.Entries.Changed = changed
+}
+
+func (s *SnapshotUseCase) validate(stage string, name string) error {
+	if !s.boxes.allowedPrefix(stage) {
+		return fmt.Errorf("%w: stage %s not allowed", ErrInvalidSnapshot, stage)
+	}
+	if !snapshotName.MatchString(name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidSnapshot, snapshotName)
+	}
+	return nil
+}
+
+// current state of the stage: every entry under it and the templates of its boxes
+func (s *SnapshotUseCase) current(ctx context.Context, stage string) (*models.Snapshot, error) {
+	snapshot := &models.Snapshot{
+		Stage:     stage,
+		Entries:   make([]models.SnapshotEntry, 0),
+		Templates: make([]models.SnapshotTemplate, 0),
+	}
+
+	err := s.entries.Walk(ctx, stage, func(key string, entry models.Entry) error {
+		entry.Key = key
+		entry.Path = ""
+		entry.Expired = false
+
+		captured := models.SnapshotEntry{Entry: entry}
+		if entry.Secure {
+			version, err := s.entries.secretAdapter.Version(ctx, entry.Value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			captured.Version = models.SecretVersion(version)
+		}
+		snapshot.Entries = append(snapshot.Entries, captured)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := models.BoxFilter{Stage: stage}
+	for {
+		page, err := s.boxes.templateAdapter.List(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, box := range page.Boxes {
+			content, err := s.boxes.templateAdapter.RetrieveBox(ctx, box.Service, stage, box.Template)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", box.Path, err)
+			}
+			snapshot.Templates = append(snapshot.Templates, models.SnapshotTemplate{
+				Service:    box.Service,
+				Template:   box.Template,
+				Value:      base64.StdEncoding.EncodeToString(content),
+				Parameters: box.Parameters,
+				Resolution: box.Resolution,
+			})
+		}
+
+		if page.Cursor == "" {
+			break
+		}
+		filter.Cursor = page.Cursor
+	}
+
+	sort.Slice(snapshot.Entries, func(i, j int) bool { return snapshot.Entries[i].Key < snapshot.Entries[j].Key })
+	sort.Slice(snapshot.Templates, func(i, j int) bool {
+		return snapshot.Templates[i].Path(stage) < snapshot.Templates[j].Path(stage)
+	})
+
+	return snapshot, nil
+}
+
+// DiffSnapshot changes of the current state against the snapshot
+func DiffSnapshot(snapshot *models.Snapshot, current *models.Snapshot) *models.SnapshotDiff {
+	diff := &models.SnapshotDiff{Name: snapshot.Name, Stage: snapshot.Stage}
+
+	before := map[string]models.SnapshotEntry{}
+	after := map[string]models.SnapshotEntry{}
+	for _, entry := range snapshot.Entries {
+		before[entry.Key] = entry
+	}
+	for _, entry := range current.Entries {
+		after[entry.Key] = entry
+	}
+	diff.Entries = diffSet(before, after, sameEntry)
+
+	beforeTemplates := map[string]models.SnapshotTemplate{}
+	afterTemplates := map[string]models.SnapshotTemplate{}
+	for _, template := range snapshot.Templates {
+		beforeTemplates[template.Path(snapshot.Stage)] = template
+	}
+	for _, template := range current.Templates {
+		afterTemplates[template.Path(snapshot.Stage)] = template
+	}
+	diff.Templates = diffSet(beforeTemplates, afterTemplates, sameTemplate)
+
+	return diff
+}
+
+func diffSet[T any](before map[string]T, after map[string]T, same func(a, b T) bool) models.DiffSet {
+	set := models.DiffSet{Added: make([]string, 0), Removed: make([]string, 0), Changed: make([]string, 0)}
+
+	for key, b := range before {
+		a, ok := after[key]
+		switch {
+		case !ok:
+			set.Removed = append(set.Removed, key)
+		case !same(b, a):
+			set.Changed = append(set.Changed, key)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			set.Added = append(set.Added, key)
+		}
+	}
+
+	sort.Strings(set.Added)
+	sort.Strings(set.Removed)
+	sort.Strings(set.Changed)
+
+	return set
+}
+
+// sameEntry value, secure version and metadata are equal
+func sameEntry(a models.SnapshotEntry, b models.SnapshotEntry) bool {
+	if a.Value != b.Value || a.Secure != b.Secure || a.Version != b.Version {
+		return false
+	}
+	if (a.ExpiresAt == nil) != (b.ExpiresAt == nil) || (a.ExpiresAt != nil && !a.ExpiresAt.Equal(*b.ExpiresAt)) {
+		return false
+	}
+
+	am, bm := a.Metadata(), b.Metadata()
+	am.ExpiresAt, bm.ExpiresAt = nil, nil
+	if len(am.Labels) == 0 && len(bm.Labels) == 0 {
+		am.Labels, bm.Labels = nil, nil
+	}
+	return reflect.DeepEqual(am, bm)
+}
+
+// sameTemplate content, parameters and resolution are equal, empty and missing lists are the same
+func sameTemplate(a models.SnapshotTemplate, b models.SnapshotTemplate) bool {
+	for _, t := range []*models.SnapshotTemplate{&a, &b} {
+		if len(t.Parameters) == 0 {
+			t.Parameters = nil
+		}
+		if len(t.Resolution) == 0 {
+			t.Resolution = nil
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// versioned reference of the version, SSM selector name:version and the version id of
+// the secrets manager ARN, arn:...:secret:<name>:<json-key>::<version-id>
+func versioned(reference string, version models.SecretVersion) string {
+	if version == "" {
+		return reference
+	}
+	parts := strings.Split(reference, ":")
+	if secretsManagerReference(reference) && len(parts) >= 7 {
+		parts = append(parts, make([]string, 10-min(len(parts), 10))...)[:10]
+		parts[8], parts[9] = "", string(version)
+		return strings.Join(parts, ":")
+	}
+	return fmt.Sprintf("%s:%s", reference, version)
+}
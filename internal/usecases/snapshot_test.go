@@ -0,0 +1,146 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+type mockSnapshotAdapter struct {
+	snapshots map[string]*models.Snapshot
+}
+
+func (m *mockSnapshotAdapter) Save(ctx context.Context, snapshot *models.Snapshot) error {
+	m.snapshots[snapshot.Stage+"/"+snapshot.Name] = snapshot
+	return nil
+}
+
+func (m *mockSnapshotAdapter) Retrieve(ctx context.Context, stage string, name string) (*models.Snapshot, error) {
+	return m.snapshots[stage+"/"+name], nil
+}
+
+func (m *mockSnapshotAdapter) List(ctx context.Context, stage string) ([]models.SnapshotSummary, error) {
+	return nil, nil
+}
+
+func TestSnapshotUseCase_Restore(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production", Key: "db_host", Value: "db-new.internal"},
+		{Path: "production", Key: "db_password", Value: "/production/db_password", Secure: true},
+		{Path: "production", Key: "debug", Value: "true"},
+		{Path: "production", Key: "added", Value: "x"},
+	}}
+	mockSecret := &mockSecretAdapter{
+		secrets:  map[string]string{"/production/db_password:2": "old-s3cr3t"},
+		versions: map[string]string{"/production/db_password": "3"},
+	}
+	snapshots := &mockSnapshotAdapter{snapshots: map[string]*models.Snapshot{}}
+
+	references := NewReferenceUseCase(mockEntry, mockSecret, testConfig)
+	entries := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), references, nil, testConfig)
+	boxes, _ := NewBox(&mockTemplateAdapter{}, mockEntry, &mockUsageAdapter{}, NewPathUseCase(), references, entries, testConfig)
+	useCase := NewSnapshotUseCase(snapshots, entries, boxes)
+
+	if _, err := useCase.Diff(context.Background(), "production", "before-migration"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf(`Expected ErrSnapshotNotFound got: %v`, err)
+	}
+
+	snapshots.snapshots["production/before-migration"] = &models.Snapshot{
+		Name:  "before-migration",
+		Stage: "production",
+		Entries: []models.SnapshotEntry{
+			{Entry: models.Entry{Key: "production/db_host", Value: "db-old.internal"}},
+			{Entry: models.Entry{Key: "production/db_password", Value: "/production/db_password", Secure: true}, Version: "2"},
+			{Entry: models.Entry{Key: "production/debug", Value: "true"}},
+			{Entry: models.Entry{Key: "production/removed", Value: "y"}},
+		},
+	}
+
+	diff, err := useCase.Restore(context.Background(), "production", "before-migration")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	expected := models.DiffSet{
+		Added:   []string{"production/added"},
+		Removed: []string{"production/removed"},
+		Changed: []string{"production/db_host", "production/db_password"},
+	}
+	if !reflect.DeepEqual(diff.Entries, expected) {
+		t.Errorf(`Expected %v got: %v`, expected, diff.Entries)
+	}
+
+	restored := map[string]string{}
+	for _, entry := range mockEntry.upserted {
+		restored[entry.Key] = entry.Value
+	}
+	if restored["production/db_host"] != "db-old.internal" || restored["production/removed"] != "y" {
+		t.Errorf(`Expected the snapshot values restored got: %v`, restored)
+	}
+	if _, ok := restored["production/db_password"]; !ok {
+		t.Errorf(`Expected the secure entry restored from its version got: %v`, restored)
+	}
+	if _, ok := restored["production/debug"]; ok {
+		t.Errorf(`Expected unchanged entries not written got: %v`, restored)
+	}
+}
+
+func TestSnapshotUseCase_DiffSecretValue(t *testing.T) {
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{
+		{Path: "production", Key: "db_password", Value: "/production/db_password", Secure: true},
+		{Path: "production", Key: "api_token", Value: "/production/api_token", Secure: true},
+	}}
+	// db_password was restored, a new version with the snapshot value, and api_token rotated
+	mockSecret := &mockSecretAdapter{
+		secrets: map[string]string{
+			"/production/db_password:2": "old-s3cr3t", "/production/db_password:3": "old-s3cr3t",
+			"/production/api_token:1": "t0k3n", "/production/api_token:2": "r0t4t3d",
+		},
+		versions: map[string]string{"/production/db_password": "3", "/production/api_token": "2"},
+	}
+	snapshots := &mockSnapshotAdapter{snapshots: map[string]*models.Snapshot{
+		"production/before-migration": {
+			Name:  "before-migration",
+			Stage: "production",
+			Entries: []models.SnapshotEntry{
+				{Entry: models.Entry{Key: "production/db_password", Value: "/production/db_password", Secure: true}, Version: "2"},
+				{Entry: models.Entry{Key: "production/api_token", Value: "/production/api_token", Secure: true}, Version: "1"},
+			},
+		},
+	}}
+
+	references := NewReferenceUseCase(mockEntry, mockSecret, testConfig)
+	entries := NewEntryUseCase(mockEntry, mockSecret, &mockUsageAdapter{}, &mockSearchAdapter{}, NewPathUseCase(), references, nil, testConfig)
+	boxes, _ := NewBox(&mockTemplateAdapter{}, mockEntry, &mockUsageAdapter{}, NewPathUseCase(), references, entries, testConfig)
+	useCase := NewSnapshotUseCase(snapshots, entries, boxes)
+
+	diff, err := useCase.Diff(context.Background(), "production", "before-migration")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expected := []string{"production/api_token"}; !reflect.DeepEqual(diff.Entries.Changed, expected) {
+		t.Errorf(`Expected %v changed got: %v`, expected, diff.Entries.Changed)
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	cases := map[string]string{
+		"/production/db_password": "/production/db_password:3",
+		"arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf::AWSCURRENT:": "arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf:::3",
+		"arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf:password":     "arn:aws:secretsmanager:us-east-1:111111111111:secret:app-AbCdEf:password::3",
+	}
+	for reference, expected := range cases {
+		if versioned(reference, "3") != expected {
+			t.Errorf(`Expected %s got: %s`, expected, versioned(reference, "3"))
+		}
+	}
+
+	// snapshots taken before secrets manager stored the parameter version as a number
+	var entry models.SnapshotEntry
+	if err := json.Unmarshal([]byte(`{"key": "production/db_password", "version": 2}`), &entry); err != nil || entry.Version != "2" {
+		t.Errorf(`Expected the numeric version read got: %v %v`, entry.Version, err)
+	}
+}
@@ -0,0 +1,55 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+)
+
+var ErrRestoreConflict = errors.New("entry already exists")
+
+// Trash soft deleted entries under the prefix that can still be restored
+func (e *EntryUseCase) Trash(ctx context.Context, prefix string) ([]models.TrashEntry, error) {
+	return e.entryAdapter.Trash(ctx, prefix)
+}
+
+// Restore restores the soft deleted key and the keys under it. Keys written again
+// after the delete aren't overwritten, nothing is restored when there is a conflict.
+// Keys past the restore window are skipped with a warning, the restore fails with
+// ErrRestoreWindowExpired only when every key expired.
+func (e *EntryUseCase) Restore(ctx context.Context, key string) (*models.TrashRestore, error) {
+	trashed, err := e.entryAdapter.Trash(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range trashed {
+		k := e.pathUseCase.Concat(entry.Path, entry.Key)
+		existing, err := e.entryAdapter.Retrieve(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("%w: %s", ErrRestoreConflict, k)
+		}
+	}
+
+	result := &models.TrashRestore{Warnings: make([]string, 0)}
+	result.Restored, err = e.entryAdapter.Restore(ctx, key)
+	if errors.Is(err, domain.ErrRestoreWindowExpired) && len(result.Restored) > 0 {
+		result.Warnings = append(result.Warnings, err.Error())
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range trashed {
+		entry.Entry.Key = e.pathUseCase.Concat(entry.Path, entry.Key)
+		e.index(ctx, entry.Entry)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,50 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"nbox/internal/domain"
+	"nbox/internal/domain/models"
+	"reflect"
+	"testing"
+)
+
+func TestEntryUseCase_Restore(t *testing.T) {
+	trash := []models.TrashEntry{
+		{Entry: models.Entry{Path: "production/api", Key: "db_host", Value: "db.internal", Labels: map[string]string{"team": "payments"}}},
+		{Entry: models.Entry{Path: "production/api", Key: "db_password", Value: "/production/api/db_password", Secure: true}},
+	}
+	mockEntry := &mockEntryAdapter{entries: []models.Entry{}, trash: trash}
+	search := &mockSearchAdapter{}
+	useCase := NewEntryUseCase(mockEntry, &mockSecretAdapter{}, &mockUsageAdapter{}, search, NewPathUseCase(), nil, nil, testConfig)
+
+	restored, err := useCase.Restore(context.Background(), "production/api")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	expected := []string{"production/api/db_host", "production/api/db_password"}
+	if !reflect.DeepEqual(restored.Restored, expected) || len(restored.Warnings) != 0 {
+		t.Errorf(`Expected %v got: %v`, expected, restored)
+	}
+	if len(search.terms["production/api/db_host"]) == 0 || len(search.terms["production/api/db_password"]) == 0 {
+		t.Errorf(`Expected the restored entries indexed got: %v`, search.terms)
+	}
+
+	// the expired keys are skipped with a warning, the rest is restored
+	mockEntry.expired = []string{"production/api/legacy_url"}
+	if restored, err = useCase.Restore(context.Background(), "production/api"); err != nil || len(restored.Restored) != 2 || len(restored.Warnings) != 1 {
+		t.Errorf(`Expected 2 keys restored with 1 warning got: %v, err %v`, restored, err)
+	}
+
+	mockEntry.trash = nil
+	if _, err = useCase.Restore(context.Background(), "production/api"); !errors.Is(err, domain.ErrRestoreWindowExpired) {
+		t.Errorf(`Expected %v when every key expired got: %v`, domain.ErrRestoreWindowExpired, err)
+	}
+	mockEntry.trash, mockEntry.expired = trash, nil
+
+	mockEntry.entries = []models.Entry{{Path: "production/api", Key: "db_host", Value: "db.new"}}
+	if _, err = useCase.Restore(context.Background(), "production/api"); !errors.Is(err, ErrRestoreConflict) {
+		t.Errorf(`Expected %v got: %v`, ErrRestoreConflict, err)
+	}
+}